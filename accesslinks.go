@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLink opens a proofing gallery to whoever has its URL, typically a
+// client. As with API tokens, only a hash of the token in the URL is kept.
+type accessLink struct {
+	Hash       string
+	Gallery    string
+	Label      string
+	Created    time.Time
+	Expires    time.Time
+	Views      int
+	LastViewed time.Time
+}
+
+// accessLinksLock serialises changes to the access links file.
+var accessLinksLock sync.Mutex
+
+const (
+	accessLinkPath = "/proof/"
+
+	// accessCookiePrefix names the cookies remembering the links a visitor
+	// has followed, one per link so that a client can hold several.
+	accessCookiePrefix = "access-"
+)
+
+// Expired reports whether the link has passed its expiry time.
+func (l accessLink) Expired() bool {
+	return !l.Expires.IsZero() && !time.Now().Before(l.Expires)
+}
+
+// readAccessLinks reads the access links file, one tab-separated hash,
+// gallery directory, label, creation time, expiry time, view count and
+// last view time per line. A missing file means no links.
+func readAccessLinks() ([]accessLink, error) {
+	data, err := ioutil.ReadFile(conf.Admin.AccessLinksFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var links []accessLink
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) != 7 || fields[0] == "" {
+			continue
+		}
+
+		l := accessLink{Hash: fields[0], Gallery: fields[1], Label: fields[2]}
+		l.Created, _ = time.Parse(time.RFC3339, fields[3])
+		l.Expires, _ = time.Parse(time.RFC3339, fields[4])
+		l.Views, _ = strconv.Atoi(fields[5])
+		l.LastViewed, _ = time.Parse(time.RFC3339, fields[6])
+		links = append(links, l)
+	}
+
+	return links, nil
+}
+
+func writeAccessLinks(links []accessLink) error {
+	return writeFileAtomic(conf.Admin.AccessLinksFile, func(w io.Writer) error {
+		for _, l := range links {
+			_, err := fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", l.Hash, l.Gallery, l.Label,
+				l.Created.Format(time.RFC3339), formatOptionalTime(l.Expires), l.Views, formatOptionalTime(l.LastViewed))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// updateAccessLinks applies change to the stored links and writes them
+// back.
+func updateAccessLinks(change func([]accessLink) []accessLink) error {
+	accessLinksLock.Lock()
+	defer accessLinksLock.Unlock()
+
+	links, err := readAccessLinks()
+	if err != nil {
+		return err
+	}
+
+	return writeAccessLinks(change(links))
+}
+
+// issueAccessLink creates a link to the gallery in directory dir and returns
+// its URL.
+func issueAccessLink(dir, label string, expires time.Time) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	link := accessLink{Hash: hashToken(token), Gallery: dir, Label: label, Created: time.Now(), Expires: expires}
+	err = updateAccessLinks(func(links []accessLink) []accessLink {
+		return append(links, link)
+	})
+
+	return absoluteURL(accessLinkPath + token), err
+}
+
+// revokeAccessLink removes the link with the given hash and returns it, if
+// there was one.
+func revokeAccessLink(hash string) (accessLink, bool, error) {
+	var revoked accessLink
+	found := false
+	err := updateAccessLinks(func(links []accessLink) []accessLink {
+		kept := make([]accessLink, 0, len(links))
+		for _, l := range links {
+			if l.Hash == hash {
+				revoked, found = l, true
+				continue
+			}
+			kept = append(kept, l)
+		}
+
+		return kept
+	})
+
+	return revoked, found, err
+}
+
+// renameAccessLinks moves a gallery's links with it when it is renamed.
+func renameAccessLinks(old, new string) {
+	err := updateAccessLinks(func(links []accessLink) []accessLink {
+		for i := range links {
+			if links[i].Gallery == old {
+				links[i].Gallery = new
+			}
+		}
+
+		return links
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func recordAccessLinkView(hash string) {
+	if conf.ReadOnly {
+		return
+	}
+
+	err := updateAccessLinks(func(links []accessLink) []accessLink {
+		for i := range links {
+			if links[i].Hash == hash {
+				links[i].Views++
+				links[i].LastViewed = time.Now()
+			}
+		}
+
+		return links
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// findAccessLink returns the issued, unrevoked link that token is, if any.
+// The link may have expired.
+func findAccessLink(token string) (accessLink, bool) {
+	links, err := readAccessLinks()
+	if err != nil {
+		log.Println(err)
+		return accessLink{}, false
+	}
+
+	hash := []byte(hashToken(token))
+	var found accessLink
+	ok := false
+	for _, l := range links {
+		if subtle.ConstantTimeCompare(hash, []byte(l.Hash)) == 1 {
+			found, ok = l, true
+		}
+	}
+
+	return found, ok
+}
+
+// accessLinkFor returns the unexpired link to g that the request's cookies
+// show it followed, if any.
+func accessLinkFor(r *http.Request, g gallery) (accessLink, bool) {
+	for _, c := range r.Cookies() {
+		if !strings.HasPrefix(c.Name, accessCookiePrefix) {
+			continue
+		}
+
+		l, ok := findAccessLink(c.Value)
+		if ok && l.Gallery == g.Dir && !l.Expired() {
+			return l, true
+		}
+	}
+
+	return accessLink{}, false
+}
+
+// accessLinkHandler remembers the link in a cookie, so that the gallery's
+// page and pictures can be fetched without the token in every URL, and
+// sends the visitor on to the gallery.
+func accessLinkHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, accessLinkPath)
+	l, ok := findAccessLink(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if l.Expired() {
+		httpError(w, r, "This link has expired.", http.StatusGone)
+		return
+	}
+
+	g, ok := galleryByDir(l.Gallery)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	cookie := &http.Cookie{
+		Name:     accessCookiePrefix + l.Hash[:16],
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if !l.Expires.IsZero() {
+		cookie.Expires = l.Expires
+	}
+	http.SetCookie(w, cookie)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, g.URL(), http.StatusFound)
+}
+
+func adminAccessLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok {
+		adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		return
+	}
+	if !g.proofing() {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("%v is not a proofing gallery; set visibility: proofing in its %v first.", g.Title, manifestFile))
+		return
+	}
+
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" || strings.ContainsAny(label, "\t\r\n") {
+		adminError(w, r, http.StatusBadRequest, "Say who the link is for, on one line.")
+		return
+	}
+
+	var expires time.Time
+	if s := strings.TrimSpace(r.FormValue("expires")); s != "" {
+		var err error
+		expires, err = parseManifestTime(s)
+		if err != nil {
+			adminError(w, r, http.StatusBadRequest, "Could not read the expiry time.")
+			return
+		}
+	}
+
+	link, err := issueAccessLink(g.Dir, label, expires)
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not create the link.")
+		return
+	}
+	audit(r, "issued access link", contentPath("galleries", g.Dir), label)
+
+	if isTokenRequest(r) {
+		writeJSON(w, http.StatusOK, struct {
+			adminResult
+			URL string `json:"url"`
+		}{adminResult{"issued", g.Title}, link})
+		return
+	}
+
+	vm := newAdminViewModel(r)
+	vm.NewAccessLink = link
+	vm.Message = fmt.Sprintf("Created a link to %v for %v. Copy it now; it won't be shown again.", g.Title, label)
+	renderTemplate(r.Context(), "admin", vm, w)
+}
+
+func adminRevokeAccessLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	l, revoked, err := revokeAccessLink(r.FormValue("link"))
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not revoke the link.")
+		return
+	}
+	if !revoked {
+		adminError(w, r, http.StatusBadRequest, "No such link.")
+		return
+	}
+	dropSelects(l.Hash)
+	audit(r, "revoked access link", contentPath("galleries", l.Gallery), l.Label)
+
+	adminDone(w, r, "revoked-link", l.Label)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTimeFormat is how Apache writes the time in its access logs.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+var accessLogLock sync.Mutex
+
+// accessLogLine formats a request in Apache's Combined Log Format, which
+// GoAccess and AWStats read as they are. As in the server's log, the
+// referer and user agent are left out for visitors who asked not to be
+// tracked.
+func accessLogLine(r *http.Request, status int, bytes int64, t time.Time) string {
+	host := loggedIP(r)
+	if host == "" {
+		host = "-"
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.FormatInt(bytes, 10)
+	}
+	referer, userAgent := "-", "-"
+	if !doNotTrack(r) {
+		referer, userAgent = accessLogField(r.Referer()), accessLogField(r.UserAgent())
+	}
+
+	return fmt.Sprintf("%v - - [%v] \"%v\" %v %v \"%v\" \"%v\"",
+		host, t.Format(accessLogTimeFormat),
+		accessLogField(r.Method+" "+r.RequestURI+" "+r.Proto),
+		status, size, referer, userAgent)
+}
+
+// accessLogField escapes s to go between double quotes, as Apache does, or
+// gives "-" if it is empty.
+func accessLogField(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// appendAccessLog adds a request to log.accessLog, if it is set, and to the
+// system log if log.systemAccessLog is. Unless it is rotated with the
+// server's log, the file is opened afresh each time, so that logrotate can
+// move it away.
+func appendAccessLog(r *http.Request, status int, bytes int64, t time.Time) {
+	if conf.Log.AccessLog == "" && accessSystemLog == nil {
+		return
+	}
+	line := accessLogLine(r, status, bytes, t)
+
+	if accessSystemLog != nil {
+		err := accessSystemLog.send(slog.LevelInfo, line)
+		if err != nil {
+			logRequestError(r, err)
+		}
+	}
+	if conf.Log.AccessLog == "" {
+		return
+	}
+
+	if accessLogFile != nil {
+		_, err := fmt.Fprintln(accessLogFile, line)
+		if err != nil {
+			logRequestError(r, err)
+		}
+		return
+	}
+
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+
+	f, err := os.OpenFile(conf.Log.AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		logRequestError(r, err)
+		return
+	}
+
+	_, err = fmt.Fprintln(f, line)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
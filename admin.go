@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// previewWidth is the width of the preview.jpg generated for a gallery that
+// has no cover yet, matching the gallery slider.
+const previewWidth = 724
+
+type adminViewModel struct {
+	Meta          pageMetadata
+	Galleries     []galleryLinkViewModel
+	Documents     []markdownDocument
+	Tokens        []apiToken
+	NewToken      string
+	AccessLinks   []accessLink
+	NewAccessLink string
+	ShortLinks    []shortLink
+	Selects       map[string]int
+	CSRF          string
+	Message       string
+	Error         string
+
+	// RequestID goes with an Error, to quote when reporting it.
+	RequestID string
+}
+
+// adminResult is what an admin action tells a script using a token.
+type adminResult struct {
+	Done    string `json:"done"`
+	Gallery string `json:"gallery"`
+}
+
+type adminLoginViewModel struct {
+	Meta     pageMetadata
+	Next     string
+	Password bool
+	TOTP     bool
+	OIDC     string
+	OIDCURL  string
+	Error    string
+
+	// RequestID goes with an Error, to quote when reporting it.
+	RequestID string
+}
+
+// requireAdmin only lets signed-in requests, or ones with an API token,
+// through to an admin handler, sending anyone else to the login page.
+// Changes made with a session must come from our own pages, with the
+// session's CSRF token; their forms are parsed here, within the upload size
+// limit, so that the token can be checked before the handler runs. In
+// read-only mode, only reads are let through.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if refuseWrite(w, r) {
+			return
+		}
+
+		if token, ok := bearerToken(r); ok {
+			t, ok := findToken(token)
+			if !ok {
+				refuseToken(w)
+				return
+			}
+
+			r = withAPIToken(r, t)
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				if !parseAdminForm(w, r) {
+					return
+				}
+				if r.MultipartForm != nil {
+					defer r.MultipartForm.RemoveAll()
+				}
+			}
+
+			handler(w, r)
+			return
+		}
+
+		id, ok := sessions.get(r)
+		if !ok {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				q := url.Values{"next": {r.URL.RequestURI()}}
+				http.Redirect(w, r, "/admin/login?"+q.Encode(), http.StatusFound)
+				return
+			}
+
+			httpError(w, r, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r = withActor(withSessionID(r, id), sessions.actor(id))
+
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			httpError(w, r, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+
+		if !parseAdminForm(w, r) {
+			return
+		}
+		if r.MultipartForm != nil {
+			defer r.MultipartForm.RemoveAll()
+		}
+
+		if !validCSRF(r) {
+			httpError(w, r, "missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// parseAdminForm parses a change's form, which may carry uploads, within the
+// upload size limit.
+func parseAdminForm(w http.ResponseWriter, r *http.Request) bool {
+	maxBytes := int64(conf.Admin.MaxUploadMB) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	err := r.ParseMultipartForm(maxBytes)
+	if err == http.ErrNotMultipart {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		adminError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Uploads are limited to %v MB.", conf.Admin.MaxUploadMB))
+		return false
+	}
+
+	return true
+}
+
+// isAdmin reports whether the request is from the signed-in admin or a
+// script with an API token, who may see drafts.
+func isAdmin(r *http.Request) bool {
+	if token, ok := bearerToken(r); ok {
+		_, ok = findToken(token)
+		return ok
+	}
+
+	_, ok := sessions.get(r)
+	return ok
+}
+
+// protectStats puts a stats handler behind the admin credentials, unless the
+// stats are configured to be public.
+func protectStats(handler http.HandlerFunc) http.HandlerFunc {
+	if conf.StatsPublic {
+		return handler
+	}
+
+	if conf.Admin.PasswordHash == "" && !oidcEnabled() {
+		log.Println("stats need the admin credentials, but neither admin.passwordHash nor admin.oidc is set")
+	}
+
+	return requireAdmin(handler)
+}
+
+func checkAdminCredentials(username, password string) bool {
+	userOk := subtle.ConstantTimeCompare([]byte(username), []byte(conf.Admin.Username)) == 1
+	passwordOk := bcrypt.CompareHashAndPassword([]byte(conf.Admin.PasswordHash), []byte(password)) == nil
+	return userOk && passwordOk
+}
+
+// sameOrigin reports whether a request came from one of our own pages, so
+// that another site cannot post changes using the admin's session.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// adminLoginHandler serves the login form and, on POST, checks the
+// credentials and starts a session before going on to next.
+func adminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	vm := newAdminLoginViewModel(r.FormValue("next"))
+
+	if r.Method != http.MethodPost {
+		renderTemplate(r.Context(), "admin_login", vm, w)
+		return
+	}
+
+	if !sameOrigin(r) {
+		httpError(w, r, "cross-origin request refused", http.StatusForbidden)
+		return
+	}
+
+	// The code is only checked, and so used up, once the password is right.
+	if !checkAdminCredentials(r.PostFormValue("username"), r.PostFormValue("password")) || !checkTOTP(r.PostFormValue("code")) {
+		vm.Error = "Wrong username, password or code."
+		w.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(r.Context(), "admin_login", vm, w)
+		return
+	}
+
+	err := sessions.create(w, conf.Admin.Username)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	appendAudit(conf.Admin.Username, "signed in", "", "password")
+	http.Redirect(w, r, vm.Next, http.StatusSeeOther)
+}
+
+// newAdminLoginViewModel offers the password form if a password is set and
+// the provider's button if OpenID Connect is configured.
+func newAdminLoginViewModel(next string) adminLoginViewModel {
+	vm := adminLoginViewModel{
+		Meta:     newPageMetadata("Sign in", "", "", "/admin/login"),
+		Next:     localRedirect(next),
+		Password: conf.Admin.PasswordHash != "",
+		TOTP:     totpEnabled(),
+	}
+
+	if oidcEnabled() {
+		vm.OIDC = conf.Admin.OIDC.Name
+		vm.OIDCURL = oidcLoginPath + "?" + url.Values{"next": {vm.Next}}.Encode()
+	}
+
+	return vm
+}
+
+// adminLogoutHandler ends the session.
+func adminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+
+	if id, ok := sessions.get(r); ok {
+		r = withSessionID(r, id)
+		if !sameOrigin(r) || !validCSRF(r) {
+			httpError(w, r, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+
+		appendAudit(sessions.actor(id), "signed out", "", "")
+	}
+
+	sessions.destroy(w, r)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// localRedirect returns next if it is a path on this site, or /admin.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin"
+	}
+
+	return next
+}
+
+// adminMessages are shown after an admin action redirects back to /admin
+// with ?done=, formatted with ?gallery=.
+var adminMessages = map[string]string{
+	"uploaded":           "Uploaded the images to %v.",
+	"created":            "Created %v.",
+	"renamed":            "Renamed the gallery to %v.",
+	"deleted":            "Moved %v to the trash.",
+	"revoked":            "Revoked the token %v.",
+	"revoked-link":       "Revoked the access link for %v.",
+	"created-short-link": "Created the short link %v.",
+	"deleted-short-link": "Deleted the short link %v.",
+}
+
+// adminHandler serves /admin, the upload and gallery management forms.
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	vm := newAdminViewModel(r)
+	if format, ok := adminMessages[r.URL.Query().Get("done")]; ok {
+		vm.Message = fmt.Sprintf(format, r.URL.Query().Get("gallery"))
+	}
+
+	renderTemplate(r.Context(), "admin", vm, w)
+}
+
+// adminDone redirects back to /admin to report a successful action, or
+// reports it in JSON to a script using a token.
+func adminDone(w http.ResponseWriter, r *http.Request, done, gallery string) {
+	if isTokenRequest(r) {
+		writeJSON(w, http.StatusOK, adminResult{done, gallery})
+		return
+	}
+
+	q := url.Values{"done": {done}, "gallery": {gallery}}
+	http.Redirect(w, r, "/admin?"+q.Encode(), http.StatusSeeOther)
+}
+
+func newAdminViewModel(r *http.Request) adminViewModel {
+	tokens, err := readTokens()
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	links, err := readAccessLinks()
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	shortLinks, err := readShortLinks()
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	return adminViewModel{
+		Meta:        newPageMetadata("Admin", "", "", "/admin"),
+		CSRF:        csrfToken(r),
+		Galleries:   getGalleryLinks(listGalleries()),
+		Documents:   markdownDocuments(),
+		Tokens:      tokens,
+		AccessLinks: links,
+		ShortLinks:  shortLinks,
+		Selects:     selectCounts(),
+	}
+}
+
+// adminError re-renders the admin page with an error message, or reports it
+// in JSON to a script using a token.
+func adminError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isTokenRequest(r) {
+		writeJSON(w, status, apiError{message})
+		return
+	}
+
+	vm := newAdminViewModel(r)
+	vm.Error = message
+	vm.RequestID = requestID(r.Context())
+
+	w.WriteHeader(status)
+	renderTemplate(r.Context(), "admin", vm, w)
+}
+
+// adminUploadHandler accepts a multipart POST of one or more JPEGs into an
+// existing gallery. Either every file is valid and saved or none is.
+func adminUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+	if r.MultipartForm == nil {
+		adminError(w, r, http.StatusBadRequest, "Choose at least one image.")
+		return
+	}
+
+	g, _, ok := findGallery(r.FormValue("gallery"))
+	if !ok {
+		adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		return
+	}
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		adminError(w, r, http.StatusBadRequest, "Choose at least one image.")
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, fh := range files {
+		err := validateUpload(g, fh)
+		if err == nil && names[fh.Filename] {
+			err = fmt.Errorf("%v was chosen twice", fh.Filename)
+		}
+		if err != nil {
+			adminError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		names[fh.Filename] = true
+	}
+
+	saved := make([]string, 0, len(files))
+	for _, fh := range files {
+		dst := contentPath("galleries", g.Dir, filepath.Base(fh.Filename))
+		err := saveUpload(fh, dst)
+		if err != nil {
+			logRequestError(r, err)
+			adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Could not save %v.", fh.Filename))
+			return
+		}
+		audit(r, "uploaded", dst, "")
+
+		saved = append(saved, dst)
+	}
+
+	err := ensurePreview(g, saved[0])
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	go warmDerivedImages(g, saved)
+	go rebuildIndexes()
+
+	adminDone(w, r, "uploaded", g.Title)
+}
+
+// validateUpload checks that an uploaded file is a JPEG that would not
+// replace an existing file.
+func validateUpload(g gallery, fh *multipart.FileHeader) error {
+	err := validateJpeg(fh)
+	if err != nil {
+		return err
+	}
+
+	if fileExists(contentPath("galleries", g.Dir, fh.Filename)) {
+		return fmt.Errorf("%v is already in %v", fh.Filename, g.Title)
+	}
+
+	return nil
+}
+
+// validateJpeg checks that an uploaded file is a JPEG, by name and by
+// content.
+func validateJpeg(fh *multipart.FileHeader) error {
+	name := filepath.Base(fh.Filename)
+	if name != fh.Filename || strings.HasPrefix(name, ".") || !isJpeg(name) {
+		return fmt.Errorf("%v: only .jpg and .jpeg files can be uploaded", fh.Filename)
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if http.DetectContentType(head[:n]) != "image/jpeg" {
+		return fmt.Errorf("%v is not a JPEG", name)
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("%v: %v", name, err)
+	}
+
+	c, err := jpeg.DecodeConfig(f)
+	if err != nil || c.Width < 1 || c.Height < 1 {
+		return fmt.Errorf("%v is not a readable JPEG", name)
+	}
+
+	return nil
+}
+
+func saveUpload(fh *multipart.FileHeader, dst string) error {
+	f, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	})
+}
+
+// ensurePreview generates the gallery's cover from src when the gallery has
+// none, so a new gallery shows on the index as soon as it has an image.
+func ensurePreview(g gallery, src string) error {
+	dst := contentPath("galleries", g.Dir, g.Cover)
+	if fileExists(dst) {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writePreview(dst, f)
+}
+
+// writePreview scales the JPEG read from r to the preview width and writes
+// it to dst.
+func writePreview(dst string, r io.Reader) error {
+	img, err := jpeg.Decode(r)
+	if err != nil {
+		return fmt.Errorf("%v: %v", dst, err)
+	}
+
+	return writeImage(dst, scaleToWidth(img, previewWidth), formatJpeg, conf.Images.DefaultQuality)
+}
+
+// warmDerivedImages generates the srcset variants of newly uploaded images
+// so the first visitor does not wait for them.
+func warmDerivedImages(g gallery, filenames []string) {
+	for _, filename := range filenames {
+		for _, width := range conf.Images.SrcsetWidths {
+			rr := resizeRequest{
+				Src:     g.Dir + "/" + filepath.Base(filename),
+				Width:   width,
+				Quality: conf.Images.DefaultQuality,
+				Format:  formatJpeg,
+			}
+
+			_, err := getDerivedImage(context.Background(), rr)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// adminTokensHandler issues an API token for a script and shows it, once.
+// Tokens can only be managed when signed in, not with another token.
+func adminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) || !signedIn(w, r) {
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || strings.ContainsAny(name, "\t\r\n") {
+		adminError(w, r, http.StatusBadRequest, "Give the token a name on one line.")
+		return
+	}
+
+	token, err := issueToken(name)
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not issue the token.")
+		return
+	}
+	audit(r, "issued token", conf.Admin.TokensFile, name)
+
+	vm := newAdminViewModel(r)
+	vm.NewToken = token
+	vm.Message = fmt.Sprintf("Issued the token %v. Copy it now; it won't be shown again.", name)
+	renderTemplate(r.Context(), "admin", vm, w)
+}
+
+// adminRevokeTokenHandler revokes the token with the posted hash.
+func adminRevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) || !signedIn(w, r) {
+		return
+	}
+
+	token, revoked, err := revokeToken(r.FormValue("token"))
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not revoke the token.")
+		return
+	}
+	if !revoked {
+		adminError(w, r, http.StatusBadRequest, "No such token.")
+		return
+	}
+	audit(r, "revoked token", conf.Admin.TokensFile, token.Name)
+
+	adminDone(w, r, "revoked", token.Name)
+}
+
+// signedIn refuses requests authorized by a token rather than a session.
+func signedIn(w http.ResponseWriter, r *http.Request) bool {
+	if isTokenRequest(r) {
+		adminError(w, r, http.StatusForbidden, "Tokens can only be managed when signed in.")
+		return false
+	}
+
+	return true
+}
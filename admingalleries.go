@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// validGalleryName reports whether name can be used as a gallery directory:
+// a single path element that is neither hidden nor awkward in a URL.
+func validGalleryName(name string) bool {
+	return name != "" &&
+		name == strings.TrimSpace(name) &&
+		!strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, "/\\?#\t\r\n")
+}
+
+// galleryByDir returns the gallery in directory dir. Unlike findGallery it
+// ignores slugs and redirects, since the admin forms name galleries by
+// directory.
+func galleryByDir(dir string) (gallery, bool) {
+	for _, g := range listGalleries() {
+		if g.Dir == dir {
+			return g, true
+		}
+	}
+
+	return gallery{}, false
+}
+
+// adminForm reports whether the request is a form post, which requireAdmin
+// has already parsed, and sends anything else back to the admin page.
+func adminForm(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return false
+	}
+
+	return true
+}
+
+// adminCreateHandler makes a new gallery directory with an optional title,
+// blurb and preview image.
+func adminCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	name := r.FormValue("name")
+	if !validGalleryName(name) {
+		adminError(w, r, http.StatusBadRequest, "Gallery names can't be empty, start with a dot or contain / \\ ? or #.")
+		return
+	}
+
+	if _, _, ok := findGallery(name); ok {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("There is already a gallery called %v.", name))
+		return
+	}
+
+	var preview []byte
+	if r.MultipartForm != nil && len(r.MultipartForm.File["preview"]) > 0 {
+		fh := r.MultipartForm.File["preview"][0]
+		err := validateJpeg(fh)
+		if err != nil {
+			adminError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		f, err := fh.Open()
+		if err == nil {
+			preview, err = ioutil.ReadAll(f)
+			f.Close()
+		}
+		if err != nil {
+			logRequestError(r, err)
+			adminError(w, r, http.StatusInternalServerError, "Could not read the preview image.")
+			return
+		}
+	}
+
+	dir := contentPath("galleries", name)
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Could not create %v.", name))
+		return
+	}
+
+	audit(r, "created gallery", dir, "")
+
+	err = writeNewGalleryFiles(dir, r.FormValue("title"), r.FormValue("blurb"), r.FormValue("draft") != "", preview)
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Created %v, but could not write all of its files.", name))
+		return
+	}
+
+	go rebuildIndexes()
+
+	adminDone(w, r, "created", name)
+}
+
+func writeNewGalleryFiles(dir, title, blurb string, draft bool, preview []byte) error {
+	manifest := make(map[string]string)
+	if title = strings.TrimSpace(title); title != "" {
+		manifest["title"] = title
+	}
+	if draft {
+		manifest["visibility"] = visibilityDraft
+	}
+
+	if len(manifest) > 0 {
+		data, err := yaml.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+
+		err = ioutil.WriteFile(filepath.Join(dir, manifestFile), data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if strings.TrimSpace(blurb) != "" {
+		err := ioutil.WriteFile(filepath.Join(dir, "blurb.markdown"), []byte(blurb), 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if preview != nil {
+		return writePreview(filepath.Join(dir, "preview.jpg"), bytes.NewReader(preview))
+	}
+
+	return nil
+}
+
+// adminRenameHandler renames a gallery's directory. If that changes its
+// URL, the old name is added to the redirects file so existing links keep
+// working, and its hit count moves with it.
+func adminRenameHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok {
+		adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		return
+	}
+
+	name := r.FormValue("name")
+	if !validGalleryName(name) {
+		adminError(w, r, http.StatusBadRequest, "Gallery names can't be empty, start with a dot or contain / \\ ? or #.")
+		return
+	}
+
+	if name == g.Dir {
+		adminDone(w, r, "renamed", name)
+		return
+	}
+
+	if other, _, ok := findGallery(name); ok && other.Dir != g.Dir {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("There is already a gallery called %v.", name))
+		return
+	}
+
+	err := os.Rename(contentPath("galleries", g.Dir), contentPath("galleries", name))
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Could not rename %v.", g.Dir))
+		return
+	}
+	audit(r, "renamed gallery", contentPath("galleries", g.Dir), "to "+name)
+
+	// A slug set in the manifest is kept, so only galleries named after
+	// their directory move.
+	if g.Slug == g.Dir {
+		err = addRename(g.Dir, name)
+		if err != nil {
+			logRequestError(r, err)
+		}
+	}
+
+	renameHitCounts(g.Dir, name)
+	renameAccessLinks(g.Dir, name)
+	go rebuildIndexes()
+
+	adminDone(w, r, "renamed", name)
+}
+
+// adminDeleteHandler moves a gallery into the trash directory, from where it
+// can be restored by hand.
+func adminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok {
+		adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		return
+	}
+
+	trashed := filepath.Join(conf.Admin.TrashDir, fmt.Sprintf("%v-%v", g.Dir, time.Now().Format("20060102-150405")))
+	err := os.MkdirAll(conf.Admin.TrashDir, 0755)
+	if err == nil {
+		err = os.Rename(contentPath("galleries", g.Dir), trashed)
+	}
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Could not move %v to the trash.", g.Dir))
+		return
+	}
+	audit(r, "deleted gallery", contentPath("galleries", g.Dir), "moved to "+auditPath(trashed))
+
+	go rebuildIndexes()
+
+	adminDone(w, r, "deleted", g.Title)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// maxMarkdownSize bounds a markdown document saved from the admin editor.
+const maxMarkdownSize = 1 << 20
+
+// markdownDocument is one of the markdown files the admin editor can change.
+type markdownDocument struct {
+	// Name identifies the document in admin URLs: about, bio or
+	// gallery/<directory>.
+	Name     string
+	Title    string
+	filename string
+}
+
+// findMarkdownDocument resolves a document name to its file. The file need
+// not exist yet.
+func findMarkdownDocument(name string) (markdownDocument, bool) {
+	switch name {
+	case "about":
+		return markdownDocument{name, "About", contentPath("about.markdown")}, true
+	case "bio":
+		return markdownDocument{name, "Bio", contentPath("bio.markdown")}, true
+	}
+
+	if dir := strings.TrimPrefix(name, "gallery/"); dir != name {
+		g, ok := galleryByDir(dir)
+		if ok {
+			return markdownDocument{name, g.Title + " blurb", contentPath("galleries", g.Dir, "blurb.markdown")}, true
+		}
+	}
+
+	return markdownDocument{}, false
+}
+
+// URL is where the raw markdown is read and written.
+func (d markdownDocument) URL() string {
+	return "/admin/markdown/" + escapeDocumentName(d.Name)
+}
+
+// EditURL is the editor page for the document.
+func (d markdownDocument) EditURL() string {
+	return "/admin/edit/" + escapeDocumentName(d.Name)
+}
+
+func escapeDocumentName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (d markdownDocument) read() ([]byte, error) {
+	markdown, err := ioutil.ReadFile(d.filename)
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	}
+
+	return markdown, err
+}
+
+// adminMarkdownHandler serves /admin/markdown/<document>: GET returns the raw
+// markdown, empty if the file does not exist yet, and PUT replaces it.
+func adminMarkdownHandler(w http.ResponseWriter, r *http.Request) {
+	doc, ok := findMarkdownDocument(strings.TrimPrefix(r.URL.Path, "/admin/markdown/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		markdown, err := doc.read()
+		if err != nil {
+			logRequestError(r, err)
+			httpError(w, r, "could not read "+doc.Name, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Write(markdown)
+
+	case http.MethodPut:
+		markdown, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMarkdownSize))
+		if err != nil {
+			httpError(w, r, "markdown documents are limited to 1 MB", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		err = writeFileAtomic(doc.filename, func(w io.Writer) error {
+			_, err := w.Write(markdown)
+			return err
+		})
+		if err != nil {
+			logRequestError(r, err)
+			httpError(w, r, "could not save "+doc.Name, http.StatusInternalServerError)
+			return
+		}
+		audit(r, "edited", doc.filename, doc.Title)
+
+		go rebuildIndexes()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminMarkdownPreviewHandler renders POSTed markdown exactly as the public
+// pages would.
+func adminMarkdownPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	markdown, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMarkdownSize))
+	if err != nil {
+		httpError(w, r, "markdown documents are limited to 1 MB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(renderMarkdown(markdown)))
+}
+
+type adminEditViewModel struct {
+	Meta     pageMetadata
+	Document markdownDocument
+	Markdown string
+	Preview  template.HTML
+	CSRF     string
+}
+
+// adminEditHandler serves /admin/edit/<document>, an editor for the
+// document's markdown with a live preview.
+func adminEditHandler(w http.ResponseWriter, r *http.Request) {
+	doc, ok := findMarkdownDocument(strings.TrimPrefix(r.URL.Path, "/admin/edit/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	markdown, err := doc.read()
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not read "+doc.Name, http.StatusInternalServerError)
+		return
+	}
+
+	vm := adminEditViewModel{
+		Meta:     newPageMetadata("Edit "+doc.Title, "", "", doc.EditURL()),
+		Document: doc,
+		Markdown: string(markdown),
+		Preview:  renderMarkdown(markdown),
+		CSRF:     csrfToken(r),
+	}
+
+	renderTemplate(r.Context(), "admin_edit", vm, w)
+}
+
+// markdownDocuments lists every document the editor can change, for the
+// admin page.
+func markdownDocuments() []markdownDocument {
+	result := make([]markdownDocument, 0)
+	for _, name := range []string{"about", "bio"} {
+		doc, _ := findMarkdownDocument(name)
+		result = append(result, doc)
+	}
+
+	for _, g := range listGalleries() {
+		doc, ok := findMarkdownDocument("gallery/" + g.Dir)
+		if ok {
+			result = append(result, doc)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// adminUploadZipHandler unpacks a zip of JPEGs into an existing gallery, or
+// into a new one when a name is given instead. Anything in the archive that
+// is not a readable JPEG is skipped.
+func adminUploadZipHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+	if r.MultipartForm == nil || len(r.MultipartForm.File["archive"]) == 0 {
+		adminError(w, r, http.StatusBadRequest, "Choose a zip archive.")
+		return
+	}
+
+	fh := r.MultipartForm.File["archive"][0]
+	f, err := fh.Open()
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not read the archive.")
+		return
+	}
+	defer f.Close()
+
+	archive, err := zip.NewReader(f, fh.Size)
+	if err != nil {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("%v is not a zip archive.", fh.Filename))
+		return
+	}
+
+	g, created, ok := zipTargetGallery(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := unpackImages(g, archive)
+	if len(saved) == 0 && created {
+		os.RemoveAll(contentPath("galleries", g.Dir))
+	}
+	if len(saved) > 0 && created {
+		audit(r, "created gallery", contentPath("galleries", g.Dir), "")
+	}
+	for _, dst := range saved {
+		audit(r, "uploaded", dst, "from "+fh.Filename)
+	}
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not unpack the archive.")
+		return
+	}
+	if len(saved) == 0 {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("%v has no JPEGs in it.", fh.Filename))
+		return
+	}
+
+	err = ensurePreview(g, saved[0])
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	go warmDerivedImages(g, saved)
+	go rebuildIndexes()
+
+	adminDone(w, r, "uploaded", g.Title)
+}
+
+// zipTargetGallery returns the gallery chosen in the form, first creating
+// it if the form names a new one. created says whether it did.
+func zipTargetGallery(w http.ResponseWriter, r *http.Request) (g gallery, created bool, ok bool) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		g, ok := galleryByDir(r.FormValue("gallery"))
+		if !ok {
+			adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		}
+		return g, false, ok
+	}
+
+	if !validGalleryName(name) {
+		adminError(w, r, http.StatusBadRequest, "Gallery names can't be empty, start with a dot or contain / \\ ? or #.")
+		return gallery{}, false, false
+	}
+
+	if _, _, ok := findGallery(name); ok {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("There is already a gallery called %v.", name))
+		return gallery{}, false, false
+	}
+
+	dir := contentPath("galleries", name)
+	err := os.Mkdir(dir, 0755)
+	if err == nil {
+		err = writeNewGalleryFiles(dir, "", "", r.FormValue("draft") != "", nil)
+	}
+	if err != nil {
+		logRequestError(r, err)
+		os.RemoveAll(dir)
+		adminError(w, r, http.StatusInternalServerError, fmt.Sprintf("Could not create %v.", name))
+		return gallery{}, false, false
+	}
+
+	return loadGallery(name), true, true
+}
+
+// unpackImages writes every JPEG in the archive into the gallery under a
+// normalized name, and returns the paths written in archive order.
+func unpackImages(g gallery, archive *zip.Reader) ([]string, error) {
+	maxBytes := int64(conf.Admin.MaxUploadMB) << 20
+	saved := make([]string, 0)
+
+	for _, entry := range archive.File {
+		if !isArchivedImage(entry) || entry.UncompressedSize64 > uint64(maxBytes) {
+			continue
+		}
+
+		data, err := readArchivedFile(entry, maxBytes)
+		if err != nil {
+			log.Println(entry.Name, err)
+			continue
+		}
+
+		if http.DetectContentType(data) != "image/jpeg" {
+			continue
+		}
+		if _, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil {
+			continue
+		}
+
+		dst := uniqueImagePath(g, normalizeImageName(entry.Name))
+		err = writeFileAtomic(dst, func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return saved, err
+		}
+
+		saved = append(saved, dst)
+	}
+
+	return saved, nil
+}
+
+// isArchivedImage skips directories, hidden files and the resource forks
+// macOS adds to archives, keeping only files named like JPEGs.
+func isArchivedImage(entry *zip.File) bool {
+	if entry.FileInfo().IsDir() || strings.HasPrefix(entry.Name, "__MACOSX/") {
+		return false
+	}
+
+	name := path.Base(entry.Name)
+	return !strings.HasPrefix(name, ".") && isJpeg(name)
+}
+
+// readArchivedFile reads an entry without trusting the size it claims.
+func readArchivedFile(entry *zip.File, maxBytes int64) ([]byte, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(rc, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("larger than %v MB", conf.Admin.MaxUploadMB)
+	}
+
+	return data, nil
+}
+
+// normalizeImageName turns an archive path into a plain file name: the
+// base name with anything but letters, digits, dots, dashes and underscores
+// replaced by dashes, and a lower-case .jpg extension.
+func normalizeImageName(name string) string {
+	base := path.Base(strings.Replace(name, "\\", "/", -1))
+	stem := strings.TrimSuffix(base, path.Ext(base))
+
+	var b strings.Builder
+	for _, r := range stem {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+
+	stem = strings.Trim(b.String(), "-.")
+	for strings.Contains(stem, "--") {
+		stem = strings.Replace(stem, "--", "-", -1)
+	}
+	if stem == "" {
+		stem = "image"
+	}
+
+	return stem + ".jpg"
+}
+
+// uniqueImagePath returns where to write name in the gallery, adding a
+// number if a file of that name is already there.
+func uniqueImagePath(g gallery, name string) string {
+	stem := strings.TrimSuffix(name, ".jpg")
+	for i := 2; fileExists(contentPath("galleries", g.Dir, name)); i++ {
+		name = fmt.Sprintf("%v-%v.jpg", stem, i)
+	}
+
+	return contentPath("galleries", g.Dir, name)
+}
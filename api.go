@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const apiGalleriesPath = "/api/v1/galleries"
+
+// apiGallerySummary is a gallery as listed by /api/v1/galleries.
+type apiGallerySummary struct {
+	Name         string   `json:"name"`
+	Title        string   `json:"title"`
+	Description  string   `json:"description,omitempty"`
+	URL          string   `json:"url"`
+	APIURL       string   `json:"apiUrl"`
+	PreviewImage string   `json:"previewImage"`
+	Year         int      `json:"year"`
+	Tags         []string `json:"tags"`
+	Visibility   string   `json:"visibility"`
+}
+
+// apiGallery is a single gallery from /api/v1/galleries/{name}, with its
+// blurb and every image rather than one page of them.
+type apiGallery struct {
+	apiGallerySummary
+	BlurbHTML     string     `json:"blurbHtml"`
+	BlurbMarkdown string     `json:"blurbMarkdown"`
+	Images        []apiImage `json:"images"`
+}
+
+type apiImage struct {
+	URL         string `json:"url"`
+	Srcset      string `json:"srcset"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	CaptionHTML string `json:"captionHtml,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIGallerySummary(g gallery) apiGallerySummary {
+	tags := g.Tags
+	if tags == nil {
+		tags = make([]string, 0)
+	}
+
+	return apiGallerySummary{
+		Name:         g.Slug,
+		Title:        g.Title,
+		Description:  g.Description,
+		URL:          g.URL(),
+		APIURL:       apiGalleriesPath + "/" + url.PathEscape(g.Slug),
+		PreviewImage: g.previewImage(),
+		Year:         g.year(),
+		Tags:         tags,
+		Visibility:   g.Visibility,
+	}
+}
+
+// apiGalleriesHandler serves /api/v1/galleries, the listed galleries in index
+// order. With an API token, unlisted galleries are included too.
+func apiGalleriesHandler(w http.ResponseWriter, r *http.Request) {
+	authorized, ok := apiTokenAuthorized(w, r)
+	if !ok {
+		return
+	}
+
+	galleries := listedGalleries()
+	if authorized {
+		galleries = listGalleries()
+	}
+
+	result := make([]apiGallerySummary, 0)
+	for _, g := range galleries {
+		result = append(result, newAPIGallerySummary(g))
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiGalleryHandler serves /api/v1/galleries/{name}, where name is a slug or,
+// like on the gallery pages, a directory name that redirects to the slug.
+func apiGalleryHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := apiTokenAuthorized(w, r); !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, apiGalleriesPath+"/")
+
+	g, canonical, ok := findGallery(name)
+	if !ok || g.hiddenFrom(r) {
+		writeJSON(w, http.StatusNotFound, apiError{"no gallery " + name})
+		return
+	}
+
+	if !canonical {
+		http.Redirect(w, r, apiGalleriesPath+"/"+url.PathEscape(g.Slug), http.StatusMovedPermanently)
+		return
+	}
+
+	if g.unpublished() {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	markdown, err := ioutil.ReadFile(contentPath("galleries", g.Dir, "blurb.markdown"))
+	if err != nil && !os.IsNotExist(err) {
+		logRequestError(r, err)
+	}
+
+	result := apiGallery{
+		apiGallerySummary: newAPIGallerySummary(g),
+		BlurbHTML:         string(renderMarkdown(markdown)),
+		BlurbMarkdown:     string(markdown),
+		Images:            make([]apiImage, 0),
+	}
+
+	for _, image := range getImages(r.Context(), g) {
+		result.Images = append(result.Images, apiImage{
+			URL:         image.URL,
+			Srcset:      image.Srcset,
+			Width:       image.Width,
+			Height:      image.Height,
+			CaptionHTML: string(image.Caption),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// assetDirs maps the URL prefixes of the assets that are fingerprinted to
+// their directories among the site files.
+var assetDirs = map[string]string{
+	"/css/": "css",
+	"/js/":  "js",
+}
+
+// assetHashLength is how many hex digits of its hash go in an asset's
+// fingerprinted name, as in bootstrap.min.0123456789.css.
+const assetHashLength = 10
+
+// assetMaxAge is how long browsers may keep a fingerprinted asset, which
+// never changes under the same name.
+const assetMaxAge = 365 * 24 * 60 * 60
+
+// assetHash is the hash of a file as it was when last hashed.
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+var (
+	assetHashesLock sync.Mutex
+	assetHashes     = make(map[string]assetHash)
+)
+
+// hashAsset returns the start of the hash of the contents of name in the
+// static directory dir, hashing it again only once it has changed.
+func hashAsset(dir, name string) (string, error) {
+	files := siteDir(dir)
+	info, err := fs.Stat(files, name)
+	if err != nil {
+		return "", err
+	}
+
+	key := dir + "/" + name
+	assetHashesLock.Lock()
+	defer assetHashesLock.Unlock()
+
+	h, ok := assetHashes[key]
+	if ok && h.modTime.Equal(info.ModTime()) && h.size == info.Size() {
+		return h.hash, nil
+	}
+
+	f, err := files.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	_, err = io.Copy(sum, f)
+	if err != nil {
+		return "", err
+	}
+
+	h = assetHash{modTime: info.ModTime(), size: info.Size(), hash: hex.EncodeToString(sum.Sum(nil))[:assetHashLength]}
+	assetHashes[key] = h
+
+	return h.hash, nil
+}
+
+// assetURL returns the fingerprinted URL of the stylesheet or script at u,
+// such as /css/site.0123456789.css for /css/site.css, which changes
+// whenever the file does. Anything else, or a file that can't be read, is
+// returned as it is.
+func assetURL(u string) string {
+	for prefix, dir := range assetDirs {
+		name, ok := strings.CutPrefix(u, prefix)
+		if !ok {
+			continue
+		}
+
+		hash, err := hashAsset(dir, path.Clean("/" + name)[1:])
+		if err != nil {
+			return u
+		}
+
+		ext := path.Ext(name)
+		return prefix + strings.TrimSuffix(name, ext) + "." + hash + ext
+	}
+
+	return u
+}
+
+// splitFingerprint returns the name an asset's fingerprinted name was made
+// from, and the hash in it.
+func splitFingerprint(name string) (string, string, bool) {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	hashExt := path.Ext(stem)
+	hash := strings.TrimPrefix(hashExt, ".")
+	if len(hash) != assetHashLength {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", "", false
+	}
+
+	return strings.TrimSuffix(stem, hashExt) + ext, hash, true
+}
+
+// fingerprintedAssets serves the fingerprinted names of the files in the
+// static directory dir with the files themselves, for handler to serve.
+// Only a name with the file's current hash may be kept for good; an older
+// one still gets the file, for pages rendered before it changed.
+func fingerprintedAssets(dir string, handler http.Handler) http.Handler {
+	files := siteDir(dir)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)[1:]
+		if _, err := fs.Stat(files, name); err == nil || name == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		original, hash, ok := splitFingerprint(name)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if _, err := fs.Stat(files, original); err != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if current, err := hashAsset(dir, original); err == nil && current == hash {
+			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(assetMaxAge)+", immutable")
+		}
+
+		r = r.Clone(r.Context())
+		r.URL.Path = original
+		r.URL.RawPath = ""
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditPageSize is how many of the latest entries /admin/audit shows.
+const auditPageSize = 500
+
+const actorKey contextKey = "actor"
+
+// auditEntry is one line of the audit log: who did what to which file.
+type auditEntry struct {
+	Time   time.Time
+	Actor  string
+	Action string
+	Path   string
+	Detail string
+}
+
+var auditLock sync.Mutex
+
+// withActor records who is making an admin request, for the audit log.
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey, actor))
+}
+
+// audit records an admin action on path, a file under ContentRoot or
+// elsewhere, by whoever made the request.
+func audit(r *http.Request, action, path, detail string) {
+	actor, _ := r.Context().Value(actorKey).(string)
+	appendAudit(actor, action, auditPath(path), detail)
+}
+
+// auditPath shortens paths under ContentRoot to be relative to it.
+func auditPath(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel(conf.ContentRoot, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+
+	return rel
+}
+
+// appendAudit adds a line to the audit log. The file is only ever appended
+// to; a failure to write it is logged but doesn't stop the action. In
+// read-only mode, where nothing gets changed, it isn't written at all.
+func appendAudit(actor, action, path, detail string) {
+	if conf.ReadOnly {
+		return
+	}
+
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+	line := strings.Join([]string{
+		time.Now().UTC().Format(time.RFC3339),
+		clean.Replace(actor),
+		clean.Replace(action),
+		clean.Replace(path),
+		clean.Replace(detail),
+	}, "\t")
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	f, err := os.OpenFile(conf.Admin.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	_, err = fmt.Fprintln(f, line)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// readAuditLog returns the latest limit entries, newest first.
+func readAuditLog(limit int) ([]auditEntry, error) {
+	f, err := os.Open(conf.Admin.AuditLog)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []auditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 {
+			continue
+		}
+
+		t, _ := time.Parse(time.RFC3339, fields[0])
+		entries = append(entries, auditEntry{t, fields[1], fields[2], fields[3], fields[4]})
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, scanner.Err()
+}
+
+type adminAuditViewModel struct {
+	Meta    pageMetadata
+	Entries []auditEntry
+}
+
+// adminAuditHandler serves /admin/audit, the latest entries of the audit
+// log.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := readAuditLog(auditPageSize)
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	vm := adminAuditViewModel{
+		Meta:    newPageMetadata("Audit log", "", "", "/admin/audit"),
+		Entries: entries,
+	}
+
+	renderTemplate(r.Context(), "admin_audit", vm, w)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// cacheWriter tells caches they may keep a successful response for maxAge
+// seconds, unless the handler said otherwise. Errors aren't kept, so a
+// file that turns up later is found.
+type cacheWriter struct {
+	http.ResponseWriter
+	maxAge      int
+	wroteHeader bool
+}
+
+func (c *cacheWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		h := c.Header()
+		if (status == http.StatusOK || status == http.StatusPartialContent || status == http.StatusNotModified) && h.Get("Cache-Control") == "" {
+			h.Set("Cache-Control", "public, max-age="+strconv.Itoa(c.maxAge))
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection's own writer.
+func (c *cacheWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// cacheFor lets browsers and proxies keep what handler serves for maxAge
+// seconds without asking again. Zero leaves them to decide for themselves.
+// Responses a handler has given a Cache-Control of its own, such as
+// drafts' pictures, keep it.
+func cacheFor(maxAge int, handler http.Handler) http.Handler {
+	if maxAge <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&cacheWriter{ResponseWriter: w, maxAge: maxAge}, r)
+	})
+}
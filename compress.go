@@ -0,0 +1,241 @@
+package main
+
+import (
+	"compress/gzip"
+	"github.com/andybalholm/brotli"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// brotliLevel trades some of brotli's compression for the speed to do it
+// on every request.
+const brotliLevel = 4
+
+// encoder is a gzip or brotli writer, reusable on another response.
+type encoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	"br":   {New: func() interface{} { return brotli.NewWriterLevel(nil, brotliLevel) }},
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+}
+
+// precompressedExtensions are the suffixes of files compressed ahead of time
+// next to the originals, by encoding.
+var precompressedExtensions = map[string]string{"br": ".br", "gzip": ".gz"}
+
+// compressible reports whether a response of contentType is text of some
+// kind, which compresses well. Pictures are compressed already.
+func compressible(contentType string) bool {
+	t := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+
+	return strings.HasPrefix(t, "text/") || t == "image/svg+xml" ||
+		strings.HasSuffix(t, "javascript") || strings.HasSuffix(t, "json") || strings.HasSuffix(t, "xml")
+}
+
+// acceptsEncoding reports whether r's Accept-Encoding takes encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name != encoding && name != "*" {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			return q > 0
+		}
+	}
+
+	return false
+}
+
+// responseEncodings are the encodings r takes, best first: brotli, if
+// compression.brotli is set, then gzip.
+func responseEncodings(r *http.Request) []string {
+	var encodings []string
+	if conf.Compression.Brotli && acceptsEncoding(r, "br") {
+		encodings = append(encodings, "br")
+	}
+	if acceptsEncoding(r, "gzip") {
+		encodings = append(encodings, "gzip")
+	}
+
+	return encodings
+}
+
+// compressWriter holds back the start of a response, up to
+// compression.minBytes, until it can tell whether the response is worth
+// compressing: text, long enough and not encoded already.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	zw       encoder
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) < conf.Compression.MinBytes {
+			return len(b), nil
+		}
+		return len(b), c.decide()
+	}
+
+	if c.zw != nil {
+		return c.zw.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection's own writer.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// decide sends the headers, saying how the body is encoded if it is, and
+// what has been held back.
+func (c *compressWriter) decide() error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	h := c.Header()
+	if h.Get("Content-Type") == "" && h.Get("Content-Encoding") == "" && len(c.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(c.buf))
+	}
+
+	if h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified &&
+		compressible(h.Get("Content-Type")) {
+		h.Add("Vary", "Accept-Encoding")
+		if c.encoding != "" && len(c.buf) >= conf.Compression.MinBytes {
+			h.Set("Content-Encoding", c.encoding)
+			h.Del("Content-Length")
+			c.zw = encoders[c.encoding].Get().(encoder)
+			c.zw.Reset(c.ResponseWriter)
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) == 0 {
+		return nil
+	}
+	var err error
+	if c.zw != nil {
+		_, err = c.zw.Write(c.buf)
+	} else {
+		_, err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+
+	return err
+}
+
+// close sends whatever is still held back and finishes the compressed
+// stream.
+func (c *compressWriter) close() {
+	if !c.decided {
+		c.decide()
+	}
+	if c.zw != nil {
+		c.zw.Close()
+		encoders[c.encoding].Put(c.zw)
+		c.zw = nil
+	}
+}
+
+// compressResponses compresses pages, styles, scripts and other text, with
+// brotli or gzip, for clients that take it, once they are at least
+// compression.minBytes long.
+func compressResponses(handler http.Handler) http.Handler {
+	if !conf.Compression.Enabled {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := &compressWriter{ResponseWriter: w}
+		defer c.close()
+
+		// Ranges are of the uncompressed file, so send them as they are.
+		if encodings := responseEncodings(r); len(encodings) > 0 && r.Header.Get("Range") == "" {
+			c.encoding = encodings[0]
+		}
+		handler.ServeHTTP(c, r)
+	})
+}
+
+// staticFileServer serves the files in root, preferring a brotli or gzip
+// copy made ahead of time, such as site.css.br beside site.css, for
+// clients that take it. Those are smaller than compressing on the fly can
+// afford to make them, and cost nothing to send.
+func staticFileServer(root fs.FS) http.Handler {
+	files := http.FileServer(http.FS(root))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conf.Compression.Enabled && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			name := path.Clean("/" + r.URL.Path)[1:]
+			for _, encoding := range responseEncodings(r) {
+				if servePrecompressed(w, r, root, name, encoding) {
+					return
+				}
+			}
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+// servePrecompressed serves name's copy in encoding from root, if there is
+// one.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, root fs.FS, name, encoding string) bool {
+	f, err := root.Open(name + precompressedExtensions[encoding])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	h := w.Header()
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		h.Set("Content-Type", t)
+	}
+	h.Set("Content-Encoding", encoding)
+	h.Add("Vary", "Accept-Encoding")
+	http.ServeContent(w, r, name, info.ModTime(), content)
+
+	return true
+}
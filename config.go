@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// config holds everything that varies between deployments. It is loaded once
+// at startup from a YAML file; any field missing from the file keeps the
+// value from defaultConfig.
+type config struct {
+	// FileSystemRoot holds the server's own files, such as the stats
+	// database, and with SiteFromDisk the templates and the static js, css
+	// and img directories.
+	FileSystemRoot string `yaml:"fileSystemRoot"`
+
+	// SiteFromDisk reads the templates and static files from
+	// FileSystemRoot, rather than using the copies built into the binary.
+	SiteFromDisk bool `yaml:"siteFromDisk"`
+
+	// ContentRoot holds the editable content: about.markdown and the
+	// galleries directory. Defaults to FileSystemRoot.
+	ContentRoot string `yaml:"contentRoot"`
+
+	// SiteURL is the public origin, used wherever an absolute link is
+	// needed, such as in feeds.
+	SiteURL string `yaml:"siteURL"`
+
+	// TwitterSite is the site's Twitter/X handle, e.g. @chezwatts, named as
+	// twitter:site on shared pages. Left out when empty.
+	TwitterSite string `yaml:"twitterSite"`
+
+	PortHttp  int `yaml:"portHttp"`
+	PortHttps int `yaml:"portHttps"`
+
+	UnixSocket unixSocketConfig `yaml:"unixSocket"`
+
+	// Listeners are servers besides those on portHttp and portHttps or
+	// unixSocket, such as one for monitoring on the internal network.
+	Listeners []listenerConfig `yaml:"listeners"`
+
+	Subdomains subdomainsConfig `yaml:"subdomains"`
+
+	// GalleryDomains serve a gallery, named by its slug or directory, at
+	// the root of a domain of its own, such as dolomites.example.
+	GalleryDomains map[string]string `yaml:"galleryDomains"`
+
+	// VirtualHosts are further sites served on the same listeners, each
+	// from a config of its own, for requests to the hosts it names.
+	VirtualHosts []virtualHostConfig `yaml:"virtualHosts"`
+
+	HttpsRedirectRoot string `yaml:"httpsRedirectRoot"`
+	HttpsCertificate  string `yaml:"httpsCertificate"`
+	HttpsPrivateKey   string `yaml:"httpsPrivateKey"`
+
+	Autocert autocertConfig `yaml:"autocert"`
+
+	HSTS hstsConfig `yaml:"hsts"`
+
+	// GalleryOrder orders the index galleries that are neither in
+	// galleries/order.txt nor given a weight: name, newest or oldest.
+	GalleryOrder string `yaml:"galleryOrder"`
+
+	// GalleryPageSize is how many images a gallery page shows before the
+	// rest are split onto further pages. Zero shows them all on one page.
+	GalleryPageSize int `yaml:"galleryPageSize"`
+
+	// IndexPageSize is how many galleries the index shows per page. Zero
+	// shows them all.
+	IndexPageSize int `yaml:"indexPageSize"`
+
+	// IndexGroupBy groups the index galleries under headings by "year" or
+	// "tag", or not at all when empty. ?group= overrides it per request.
+	IndexGroupBy string `yaml:"indexGroupBy"`
+
+	Images imagesConfig `yaml:"images"`
+
+	Downloads downloadsConfig `yaml:"downloads"`
+
+	Robots robotsConfig `yaml:"robots"`
+
+	Admin adminConfig `yaml:"admin"`
+
+	// IconsDir holds favicon.ico and apple-touch-icon.png, served at the
+	// site root. The touch icon is also listed in the web manifest. A
+	// relative path is resolved against FileSystemRoot.
+	IconsDir string `yaml:"iconsDir"`
+
+	// DevMode re-parses templates on every request so they can be edited
+	// without restarting the server. It implies SiteFromDisk.
+	DevMode bool `yaml:"devMode"`
+
+	// ReadOnly serves the site from content and a stats database that
+	// another server looks after, changing neither: visits aren't counted,
+	// the stats database is opened read-only and not backed up, and the
+	// admin can look but not upload, edit or delete.
+	ReadOnly bool `yaml:"readOnly"`
+
+	// StatsPublic serves the stats pages to anyone. By default they need the
+	// admin credentials.
+	StatsPublic bool `yaml:"statsPublic"`
+
+	// StatsDatabase is the SQLite database hit counts are kept in, per page
+	// per day. A relative path is resolved against FileSystemRoot.
+	StatsDatabase string `yaml:"statsDatabase"`
+
+	// StatsBackups is how many daily backups of StatsDatabase are kept
+	// beside it, as <statsDatabase>.1 (the newest) and so on. A database that
+	// fails its integrity check at startup is replaced by the newest good
+	// one. 0 keeps none.
+	StatsBackups int `yaml:"statsBackups"`
+
+	// StatsFile is the stats.csv of earlier versions. Its totals are
+	// imported when StatsDatabase is first created. A relative path is
+	// resolved against FileSystemRoot.
+	StatsFile string `yaml:"statsFile"`
+
+	// StatsLogGranularity is what /stats-log counts visits per: hourly,
+	// daily or weekly. Periods start on the hour, at midnight and at
+	// midnight on Mondays. Visits per hour are only counted while it is
+	// hourly.
+	StatsLogGranularity string `yaml:"statsLogGranularity"`
+
+	// StatsTimeZone is the IANA time zone, such as Europe/London, whose days
+	// and hours visits are counted in. Empty means the server's.
+	StatsTimeZone string `yaml:"statsTimeZone"`
+
+	Crawlers crawlersConfig `yaml:"crawlers"`
+
+	// TrustedProxies are CIDR ranges of reverse proxies, such as nginx on
+	// the same box or Cloudflare, whose X-Forwarded-For and X-Real-IP
+	// headers are believed. Requests from anywhere else are taken to come
+	// from where they connected from.
+	TrustedProxies []string `yaml:"trustedProxies"`
+
+	// PrivacyMode truncates visitors' addresses before they are logged or
+	// counted, and honours Do Not Track.
+	PrivacyMode bool `yaml:"privacyMode"`
+
+	Log logConfig `yaml:"log"`
+
+	Metrics metricsConfig `yaml:"metrics"`
+
+	Pprof pprofConfig `yaml:"pprof"`
+
+	RateLimit rateLimitConfig `yaml:"rateLimit"`
+
+	SecurityHeaders securityHeadersConfig `yaml:"securityHeaders"`
+
+	Compression compressionConfig `yaml:"compression"`
+
+	Cache cacheConfig `yaml:"cache"`
+
+	PageCache pageCacheConfig `yaml:"pageCache"`
+}
+
+// logConfig controls the server's log, on standard error.
+type logConfig struct {
+	// Format is text, for key=value lines, or json, for a JSON object per
+	// line.
+	Format string `yaml:"format"`
+
+	// AccessLog, if set, is a file, resolved against FileSystemRoot, that
+	// requests are also appended to in Apache's Combined Log Format.
+	AccessLog string `yaml:"accessLog"`
+
+	// Dir, if set, is a directory, resolved against FileSystemRoot, to
+	// write the log to, as server.log, instead of standard error. That and
+	// the access log are rotated once they reach MaxSizeMB or are
+	// MaxAgeHours old. Rotated files are gzipped if Compress is set, and
+	// deleted after KeepDays, or never if it is 0.
+	Dir         string `yaml:"dir"`
+	MaxSizeMB   int    `yaml:"maxSizeMB"`
+	MaxAgeHours int    `yaml:"maxAgeHours"`
+	KeepDays    int    `yaml:"keepDays"`
+	Compress    bool   `yaml:"compress"`
+
+	// System, syslog or journald, sends the log there instead, at
+	// priorities that follow the levels. SystemAccessLog sends the access
+	// log there too, under a name of its own.
+	System          string `yaml:"system"`
+	SystemAccessLog bool   `yaml:"systemAccessLog"`
+}
+
+// metricsConfig controls the Prometheus metrics at /metrics.
+type metricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Public serves the metrics to anyone. By default they need the admin
+	// credentials or an API token.
+	Public bool `yaml:"public"`
+}
+
+// pprofConfig controls the Go runtime's profiles at /debug/pprof/, which
+// need the admin credentials or an API token.
+type pprofConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Listen, such as localhost:6060, also serves the profiles on a port of
+	// their own, with no sign-in. It must be a loopback address.
+	Listen string `yaml:"listen"`
+}
+
+// compressionConfig controls compressing text responses.
+type compressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MinBytes is how long a response must be to be worth compressing.
+	MinBytes int `yaml:"minBytes"`
+
+	// Brotli compresses with brotli, rather than gzip, for clients that
+	// take both.
+	Brotli bool `yaml:"brotli"`
+}
+
+// cacheConfig controls how long browsers and proxies may keep files
+// without asking again, in seconds. Zero sends no Cache-Control.
+type cacheConfig struct {
+	// StaticMaxAge is for the styles, scripts and pictures under css, js
+	// and img.
+	StaticMaxAge int `yaml:"staticMaxAge"`
+
+	// ImagesMaxAge is for gallery pictures and their resized copies,
+	// which may be replaced in place.
+	ImagesMaxAge int `yaml:"imagesMaxAge"`
+}
+
+// pageCacheConfig controls keeping rendered index and gallery pages in
+// memory.
+type pageCacheConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// TTLSeconds is how long a page is kept, at most, before it is
+	// rendered again.
+	TTLSeconds int `yaml:"ttlSeconds"`
+}
+
+// securityHeadersConfig sets the policies sent with every page. An empty
+// one isn't sent.
+type securityHeadersConfig struct {
+	Enabled               bool   `yaml:"enabled"`
+	ContentSecurityPolicy string `yaml:"contentSecurityPolicy"`
+	ReferrerPolicy        string `yaml:"referrerPolicy"`
+	FrameOptions          string `yaml:"frameOptions"`
+	PermissionsPolicy     string `yaml:"permissionsPolicy"`
+}
+
+// rateLimitConfig limits how fast each visitor address can make requests.
+// The stats, gallery zips and the image resizer have limits of their own,
+// as they cost the most to answer.
+type rateLimitConfig struct {
+	Enabled  bool       `yaml:"enabled"`
+	Default  rateConfig `yaml:"default"`
+	Stats    rateConfig `yaml:"stats"`
+	Download rateConfig `yaml:"download"`
+	Images   rateConfig `yaml:"images"`
+}
+
+// rateConfig is a token bucket: Burst requests at once, refilled at RPS
+// requests a second.
+type rateConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// crawlersConfig picks out search engine crawlers and other bots, so that
+// they don't inflate the hit counts.
+type crawlersConfig struct {
+	// Count is separate to count crawlers' hits apart from visitors', or
+	// exclude to not count them at all.
+	Count string `yaml:"count"`
+
+	// UserAgents are extra words, besides the usual ones such as "bot" and
+	// "spider", that mark a user agent as a crawler. Case is ignored.
+	UserAgents []string `yaml:"userAgents"`
+
+	// IPRanges are CIDR ranges that requests from are crawlers whatever
+	// their user agent says.
+	IPRanges []string `yaml:"ipRanges"`
+}
+
+// autocertConfig controls automatic certificate provisioning via Let's
+// Encrypt. When enabled it replaces httpsCertificate and httpsPrivateKey.
+type autocertConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Domains []string `yaml:"domains"`
+	Email   string   `yaml:"email"`
+
+	// CacheDir is where issued certificates are kept between restarts. A
+	// relative path is resolved against FileSystemRoot.
+	CacheDir string `yaml:"cacheDir"`
+}
+
+// unixSocketConfig, once Path is set, serves the site as plain http on a
+// unix socket instead of on portHttp and portHttps, for a proxy in front
+// that takes care of https.
+type unixSocketConfig struct {
+	Path string `yaml:"path"`
+
+	// Mode is the socket file's permissions, in octal, such as 0660.
+	Mode string `yaml:"mode"`
+
+	// Owner and Group, user and group names or ids, own the socket file
+	// if set. Changing them needs the privileges to.
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+}
+
+// listenerConfig is one of the extra servers.
+type listenerConfig struct {
+	// Name tells the listener apart over restarts and in socket
+	// activation's FileDescriptorName=.
+	Name string `yaml:"name"`
+
+	// Address is a host and port, such as 10.0.0.5:8201 or 127.0.0.1:8201.
+	// An internal listener's must be a loopback or private address.
+	Address string `yaml:"address"`
+
+	// Serve is what the listener serves: site, the whole site; redirect,
+	// redirects to https and ACME challenges, as on portHttp; or internal,
+	// the health checks and the metrics and profiles, if enabled, with no
+	// sign-in.
+	Serve string `yaml:"serve"`
+
+	// TLS serves https, with the site's certificates, instead of plain
+	// http.
+	TLS bool `yaml:"tls"`
+}
+
+// subdomainsConfig serves each gallery at a subdomain of its own as well,
+// its slug under Domain, such as dolomites.chezwatts.gallery, and makes
+// that its canonical address.
+type subdomainsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Domain defaults to siteURL's host.
+	Domain string `yaml:"domain"`
+}
+
+// virtualHostConfig is one of the further sites.
+type virtualHostConfig struct {
+	Hosts []string `yaml:"hosts"`
+
+	// Config is the path to the site's own config file, with its own
+	// contentRoot, statsDatabase, images.cacheDir and so on.
+	Config string `yaml:"config"`
+}
+
+// hstsConfig controls the Strict-Transport-Security header sent over https.
+type hstsConfig struct {
+	// MaxAge is how many seconds browsers should keep to https after a
+	// visit. Zero sends no header.
+	MaxAge            int  `yaml:"maxAge"`
+	IncludeSubDomains bool `yaml:"includeSubDomains"`
+
+	// Preload asks to be put on the browsers' built-in list, which needs a
+	// MaxAge of at least a year and IncludeSubDomains.
+	Preload bool `yaml:"preload"`
+}
+
+// imagesConfig controls the on-demand image resizer.
+type imagesConfig struct {
+	// CacheDir holds derived images. A relative path is resolved against
+	// FileSystemRoot.
+	CacheDir string `yaml:"cacheDir"`
+
+	// Workers is how many images may be resized at once. Zero means one per
+	// CPU.
+	Workers int `yaml:"workers"`
+
+	MaxWidth       int `yaml:"maxWidth"`
+	DefaultQuality int `yaml:"defaultQuality"`
+
+	// SrcsetWidths are the widths offered to browsers in each gallery
+	// image's srcset, and Sizes is the matching sizes attribute.
+	SrcsetWidths []int  `yaml:"srcsetWidths"`
+	Sizes        string `yaml:"sizes"`
+
+	// StripMetadata removes EXIF, including GPS, from original images as
+	// they are served. Galleries can override it with a strip-metadata or
+	// keep-metadata marker file.
+	StripMetadata bool `yaml:"stripMetadata"`
+
+	// NoRightClick turns off the context menu and dragging on gallery
+	// pictures. Galleries can override it with a no-right-click or
+	// allow-right-click marker file.
+	NoRightClick bool `yaml:"noRightClick"`
+
+	Avif avifConfig `yaml:"avif"`
+
+	Hotlink hotlinkConfig `yaml:"hotlink"`
+
+	SignedURLs signedURLsConfig `yaml:"signedURLs"`
+
+	Watermark watermarkConfig `yaml:"watermark"`
+}
+
+// hotlinkConfig keeps other sites from embedding the gallery images.
+type hotlinkConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// AllowedReferers are the hosts, besides the site's own, whose pages may
+	// embed the images. "*.example.com" allows every subdomain.
+	AllowedReferers []string `yaml:"allowedReferers"`
+
+	// AllowEmptyReferer lets image requests without a Referer through, as
+	// sent when an image is opened directly, by many feed readers, and by
+	// browsers told not to send one.
+	AllowEmptyReferer bool `yaml:"allowEmptyReferer"`
+
+	// Placeholder is an image served in place of a hotlinked one, such as a
+	// watermarked notice pointing to the site. With none, hotlinks get a
+	// 403. A relative path is resolved against FileSystemRoot.
+	Placeholder string `yaml:"placeholder"`
+}
+
+// signedURLsConfig controls the expiring image links of galleries with
+// signedURLs set.
+type signedURLsConfig struct {
+	// KeyFile holds the secret the links are signed with, made on first
+	// use. Replacing it breaks every link handed out. A relative path is
+	// resolved against FileSystemRoot.
+	KeyFile string `yaml:"keyFile"`
+
+	// ValidMinutes is how long a link works after its page is served.
+	ValidMinutes int `yaml:"validMinutes"`
+}
+
+// watermarkConfig is drawn over every derived image, and every original
+// served from a watermarked gallery.
+type watermarkConfig struct {
+	// Enabled watermarks every gallery that does not say otherwise in its
+	// manifest.
+	Enabled bool `yaml:"enabled"`
+
+	// Image is a PNG to draw, with its own transparency. A relative path is
+	// resolved against FileSystemRoot. Without one, Text is drawn instead.
+	Image string `yaml:"image"`
+	Text  string `yaml:"text"`
+
+	// Position is center, top-left, top-right, bottom-left or bottom-right.
+	Position string `yaml:"position"`
+
+	// Opacity is from 0 (invisible) to 1, and Scale is the watermark's width
+	// as a fraction of the picture's.
+	Opacity float64 `yaml:"opacity"`
+	Scale   float64 `yaml:"scale"`
+}
+
+// avifConfig controls AVIF output, which is much slower to encode than JPEG
+// or WebP.
+type avifConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Quality overrides the requested quality for AVIF output when non-zero.
+	Quality int `yaml:"quality"`
+
+	// Speed trades encoding effort for size, from 0 (slowest, smallest) to
+	// 10 (fastest).
+	Speed int `yaml:"speed"`
+}
+
+// adminConfig controls the /admin area for managing galleries. It is only
+// served when enabled, but its credentials also protect the stats pages.
+type adminConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Username string `yaml:"username"`
+
+	// PasswordHash is a bcrypt hash of the admin password, e.g. from
+	// htpasswd -nbBC 10 "" password | tr -d ':\n'. With none set, nobody
+	// can sign in.
+	PasswordHash string `yaml:"passwordHash"`
+
+	// SessionIdleMinutes signs the admin out after this long without a
+	// request.
+	SessionIdleMinutes int `yaml:"sessionIdleMinutes"`
+
+	// MaxUploadMB bounds the size of a single upload request.
+	MaxUploadMB int `yaml:"maxUploadMB"`
+
+	// TrashDir is where deleted galleries are moved. A relative path is
+	// resolved against ContentRoot, so that it is on the same file system
+	// as the galleries.
+	TrashDir string `yaml:"trashDir"`
+
+	// TokensFile holds the hashes of the API tokens issued from the admin
+	// page. A relative path is resolved against FileSystemRoot.
+	TokensFile string `yaml:"tokensFile"`
+
+	// TOTPFile holds the secret and recovery codes for two-factor sign-in,
+	// once it is set up from /admin/totp. A relative path is resolved
+	// against FileSystemRoot.
+	TOTPFile string `yaml:"totpFile"`
+
+	// AccessLinksFile holds the hashes of the links to proofing galleries
+	// issued from the admin page, with how often each has been viewed. A
+	// relative path is resolved against FileSystemRoot.
+	AccessLinksFile string `yaml:"accessLinksFile"`
+
+	// SelectsFile holds the pictures clients have picked from proofing
+	// galleries. A relative path is resolved against FileSystemRoot.
+	SelectsFile string `yaml:"selectsFile"`
+
+	// AuditLog is appended to with every change made through the admin
+	// area. A relative path is resolved against FileSystemRoot.
+	AuditLog string `yaml:"auditLog"`
+
+	OIDC oidcConfig `yaml:"oidc"`
+}
+
+// oidcConfig lets the admin sign in with an OpenID Connect provider instead
+// of, or as well as, the password. The provider must allow
+// <siteURL>/admin/login/oidc/callback as a redirect URL.
+type oidcConfig struct {
+	// Issuer is the provider's issuer URL, e.g. https://accounts.google.com.
+	// OpenID Connect sign-in is off when it is empty.
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	Scopes       []string `yaml:"scopes"`
+
+	// Name labels the sign-in button.
+	Name string `yaml:"name"`
+
+	// AllowedEmails and AllowedGroups say who may sign in: an account with
+	// one of the emails, verified by the provider, or a member of one of the
+	// groups named in the GroupsClaim claim of its ID token.
+	AllowedEmails []string `yaml:"allowedEmails"`
+	AllowedGroups []string `yaml:"allowedGroups"`
+	GroupsClaim   string   `yaml:"groupsClaim"`
+
+	// UnverifiedEmails lets an email the provider doesn't say it verified
+	// count for AllowedEmails. Only for providers that leave email_verified
+	// out and never let users choose their email.
+	UnverifiedEmails bool `yaml:"unverifiedEmails"`
+}
+
+// downloadsConfig controls /gallery/<name>/download, a zip of a whole
+// gallery.
+type downloadsConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// WebResolution puts the images in the zip at images.maxWidth rather
+	// than as the originals.
+	WebResolution bool `yaml:"webResolution"`
+}
+
+// robotsConfig is what /robots.txt tells crawlers.
+type robotsConfig struct {
+	// Groups are the User-agent sections. With none, every crawler is
+	// allowed everywhere.
+	Groups []robotsGroup `yaml:"groups"`
+
+	// DisallowStats adds the stats pages to every group's Disallow list.
+	DisallowStats bool `yaml:"disallowStats"`
+
+	// Sitemap points crawlers at /sitemap.xml.
+	Sitemap bool `yaml:"sitemap"`
+}
+
+var conf = defaultConfig()
+
+func defaultConfig() *config {
+	return &config{
+		FileSystemRoot:    "/var/www/chezwatts.gallery/",
+		SiteURL:           "https://chezwatts.gallery",
+		PortHttp:          8081,
+		PortHttps:         8443,
+		HttpsRedirectRoot: "https://chezwatts.gallery:443",
+		HttpsCertificate:  "/etc/letsencrypt/live/chezwatts.gallery/fullchain.pem",
+		HttpsPrivateKey:   "/etc/letsencrypt/live/chezwatts.gallery/privkey.pem",
+		StatsDatabase:     "stats.db",
+		StatsBackups:      7,
+		UnixSocket: unixSocketConfig{
+			Mode: "0660",
+		},
+		Crawlers: crawlersConfig{
+			Count:    crawlersSeparate,
+			IPRanges: defaultCrawlerRanges,
+		},
+		Log: logConfig{
+			Format:      logText,
+			MaxSizeMB:   100,
+			MaxAgeHours: 24,
+			KeepDays:    30,
+			Compress:    true,
+		},
+		StatsFile:           "stats.csv",
+		StatsLogGranularity: statsDaily,
+		IconsDir:            "icons",
+		GalleryOrder:        orderByName,
+		GalleryPageSize:     50,
+		Autocert: autocertConfig{
+			Domains:  []string{"chezwatts.gallery", "www.chezwatts.gallery"},
+			CacheDir: "certs",
+		},
+		Images: imagesConfig{
+			CacheDir:       "cache",
+			MaxWidth:       2400,
+			DefaultQuality: 80,
+			SrcsetWidths:   []int{480, 724, 1080, 1448},
+			Sizes:          "(max-width: 724px) 100vw, 724px",
+			Avif: avifConfig{
+				Enabled: true,
+				Speed:   6,
+			},
+			Hotlink: hotlinkConfig{
+				AllowEmptyReferer: true,
+			},
+			SignedURLs: signedURLsConfig{
+				KeyFile:      "url-signing.key",
+				ValidMinutes: 60,
+			},
+			Watermark: watermarkConfig{
+				Position: watermarkBottomRight,
+				Opacity:  0.5,
+				Scale:    0.25,
+			},
+		},
+		Admin: adminConfig{
+			Username:           "admin",
+			MaxUploadMB:        64,
+			SessionIdleMinutes: 30,
+			TrashDir:           "trash",
+			TokensFile:         "api-tokens.txt",
+			TOTPFile:           "totp.yaml",
+			AccessLinksFile:    "access-links.txt",
+			SelectsFile:        "selects.txt",
+			AuditLog:           "audit.log",
+			OIDC: oidcConfig{
+				Scopes:      []string{"openid", "email", "profile"},
+				Name:        "OpenID Connect",
+				GroupsClaim: "groups",
+			},
+		},
+		Compression: compressionConfig{
+			Enabled:  true,
+			MinBytes: 1024,
+			Brotli:   true,
+		},
+		Cache: cacheConfig{
+			StaticMaxAge: 24 * 60 * 60,
+			ImagesMaxAge: 60 * 60,
+		},
+		PageCache: pageCacheConfig{
+			Enabled:    true,
+			TTLSeconds: 5 * 60,
+		},
+		SecurityHeaders: securityHeadersConfig{
+			Enabled:               true,
+			ContentSecurityPolicy: defaultContentSecurityPolicy,
+			ReferrerPolicy:        "strict-origin-when-cross-origin",
+			FrameOptions:          "DENY",
+			PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=(), usb=(), browsing-topics=()",
+		},
+		RateLimit: rateLimitConfig{
+			Default:  rateConfig{RPS: 10, Burst: 50},
+			Stats:    rateConfig{RPS: 1, Burst: 10},
+			Download: rateConfig{RPS: 0.05, Burst: 2},
+			Images:   rateConfig{RPS: 5, Burst: 40},
+		},
+		Robots: robotsConfig{
+			DisallowStats: true,
+			Sitemap:       true,
+		},
+	}
+}
+
+// loadConfig reads the config file, if one is given, over the defaults and
+// checks the result is usable.
+func loadConfig(filename string) (*config, error) {
+	c := defaultConfig()
+
+	if filename != "" {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		err = yaml.UnmarshalStrict(data, c)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", filename, err)
+		}
+	}
+
+	if c.ContentRoot == "" {
+		c.ContentRoot = c.FileSystemRoot
+	}
+
+	if c.TwitterSite != "" && !strings.HasPrefix(c.TwitterSite, "@") {
+		c.TwitterSite = "@" + c.TwitterSite
+	}
+
+	if c.StatsDatabase != "" && !filepath.IsAbs(c.StatsDatabase) {
+		c.StatsDatabase = filepath.Join(c.FileSystemRoot, c.StatsDatabase)
+	}
+
+	if c.StatsFile != "" && !filepath.IsAbs(c.StatsFile) {
+		c.StatsFile = filepath.Join(c.FileSystemRoot, c.StatsFile)
+	}
+
+	if !filepath.IsAbs(c.Autocert.CacheDir) {
+		c.Autocert.CacheDir = filepath.Join(c.FileSystemRoot, c.Autocert.CacheDir)
+	}
+
+	if !filepath.IsAbs(c.Admin.TrashDir) {
+		c.Admin.TrashDir = filepath.Join(c.ContentRoot, c.Admin.TrashDir)
+	}
+
+	if !filepath.IsAbs(c.Admin.TokensFile) {
+		c.Admin.TokensFile = filepath.Join(c.FileSystemRoot, c.Admin.TokensFile)
+	}
+
+	if !filepath.IsAbs(c.Admin.TOTPFile) {
+		c.Admin.TOTPFile = filepath.Join(c.FileSystemRoot, c.Admin.TOTPFile)
+	}
+
+	if !filepath.IsAbs(c.Admin.AccessLinksFile) {
+		c.Admin.AccessLinksFile = filepath.Join(c.FileSystemRoot, c.Admin.AccessLinksFile)
+	}
+
+	if !filepath.IsAbs(c.Admin.SelectsFile) {
+		c.Admin.SelectsFile = filepath.Join(c.FileSystemRoot, c.Admin.SelectsFile)
+	}
+
+	if !filepath.IsAbs(c.Admin.AuditLog) {
+		c.Admin.AuditLog = filepath.Join(c.FileSystemRoot, c.Admin.AuditLog)
+	}
+
+	if c.Log.AccessLog != "" && !filepath.IsAbs(c.Log.AccessLog) {
+		c.Log.AccessLog = filepath.Join(c.FileSystemRoot, c.Log.AccessLog)
+	}
+
+	if c.Log.Dir != "" && !filepath.IsAbs(c.Log.Dir) {
+		c.Log.Dir = filepath.Join(c.FileSystemRoot, c.Log.Dir)
+	}
+
+	if !filepath.IsAbs(c.IconsDir) {
+		c.IconsDir = filepath.Join(c.FileSystemRoot, c.IconsDir)
+	}
+
+	if c.Images.Hotlink.Placeholder != "" && !filepath.IsAbs(c.Images.Hotlink.Placeholder) {
+		c.Images.Hotlink.Placeholder = filepath.Join(c.FileSystemRoot, c.Images.Hotlink.Placeholder)
+	}
+
+	if c.Images.Watermark.Image != "" && !filepath.IsAbs(c.Images.Watermark.Image) {
+		c.Images.Watermark.Image = filepath.Join(c.FileSystemRoot, c.Images.Watermark.Image)
+	}
+
+	if !filepath.IsAbs(c.Images.SignedURLs.KeyFile) {
+		c.Images.SignedURLs.KeyFile = filepath.Join(c.FileSystemRoot, c.Images.SignedURLs.KeyFile)
+	}
+
+	if !filepath.IsAbs(c.Images.CacheDir) {
+		c.Images.CacheDir = filepath.Join(c.FileSystemRoot, c.Images.CacheDir)
+	}
+
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *config) validate() error {
+	for _, dir := range []string{c.FileSystemRoot, c.ContentRoot} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+	}
+
+	for _, port := range []int{c.PortHttp, c.PortHttps} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %v", port)
+		}
+	}
+
+	if c.PortHttp == c.PortHttps {
+		return errors.New("portHttp and portHttps must differ")
+	}
+
+	u, err := url.Parse(c.SiteURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("siteURL must be an absolute URL, got %q", c.SiteURL)
+	}
+
+	if c.HttpsRedirectRoot == "" {
+		return errors.New("httpsRedirectRoot is required")
+	}
+
+	if c.HSTS.MaxAge < 0 {
+		return errors.New("hsts.maxAge must not be negative")
+	}
+
+	if c.HSTS.Preload && (c.HSTS.MaxAge < 31536000 || !c.HSTS.IncludeSubDomains) {
+		return errors.New("hsts.preload needs a maxAge of at least 31536000 and includeSubDomains")
+	}
+
+	if c.UnixSocket.Path != "" {
+		if _, err := socketMode(c.UnixSocket.Mode); err != nil {
+			return err
+		}
+		if c.Autocert.Enabled {
+			return errors.New("autocert needs portHttp and portHttps, so can't be used with unixSocket")
+		}
+	} else if c.Autocert.Enabled {
+		if len(c.Autocert.Domains) == 0 {
+			return errors.New("autocert.domains is required when autocert is enabled")
+		}
+	} else if c.HttpsCertificate == "" || c.HttpsPrivateKey == "" {
+		return errors.New("httpsCertificate and httpsPrivateKey are required unless autocert is enabled")
+	}
+
+	names := map[string]bool{"http": true, "https": true, "unix": true, "pprof": true}
+	for _, l := range c.Listeners {
+		if l.Name == "" || strings.ContainsAny(l.Name, ",:") {
+			return fmt.Errorf("listeners need a name without commas or colons, got %q", l.Name)
+		}
+		if names[l.Name] {
+			return fmt.Errorf("listener name %v is taken", l.Name)
+		}
+		names[l.Name] = true
+
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("listener %v: address must be a host and port, such as 127.0.0.1:8201, got %q", l.Name, l.Address)
+		}
+		if l.Serve == serveInternal && !internalAddress(l.Address) {
+			return fmt.Errorf("listener %v: an internal listener's address must be a loopback or private one, such as 127.0.0.1:8201 or 10.0.0.5:8201, got %q", l.Name, l.Address)
+		}
+		switch l.Serve {
+		case serveSite, serveRedirect, serveInternal:
+		default:
+			return fmt.Errorf("listener %v: serve must be %v, %v or %v", l.Name, serveSite, serveRedirect, serveInternal)
+		}
+		if l.TLS && c.UnixSocket.Path != "" && (c.HttpsCertificate == "" || c.HttpsPrivateKey == "") {
+			return fmt.Errorf("listener %v: tls needs httpsCertificate and httpsPrivateKey", l.Name)
+		}
+	}
+
+	hosts := make(map[string]bool)
+	if u, err := url.Parse(c.SiteURL); err == nil {
+		hosts[strings.ToLower(u.Hostname())] = true
+	}
+	for _, vh := range c.VirtualHosts {
+		if len(vh.Hosts) == 0 {
+			return errors.New("virtualHosts need at least one host")
+		}
+		for _, host := range vh.Hosts {
+			if hosts[strings.ToLower(host)] {
+				return fmt.Errorf("virtual host %v is served already", host)
+			}
+			hosts[strings.ToLower(host)] = true
+		}
+		if _, err := os.Stat(vh.Config); err != nil {
+			return fmt.Errorf("virtual host %v: %v", vh.Hosts[0], err)
+		}
+	}
+
+	for domain, name := range c.GalleryDomains {
+		if hosts[strings.ToLower(domain)] {
+			return fmt.Errorf("galleryDomains: %v is served already", domain)
+		}
+		if name == "" {
+			return fmt.Errorf("galleryDomains: %v needs a gallery", domain)
+		}
+	}
+
+	switch c.GalleryOrder {
+	case orderByName, orderByNewest, orderByOldest:
+	default:
+		return fmt.Errorf("galleryOrder must be %v, %v or %v", orderByName, orderByNewest, orderByOldest)
+	}
+
+	if c.GalleryPageSize < 0 || c.IndexPageSize < 0 {
+		return errors.New("galleryPageSize and indexPageSize must not be negative")
+	}
+
+	switch c.IndexGroupBy {
+	case "", groupByYear, groupByTag:
+	default:
+		return fmt.Errorf("indexGroupBy must be empty, %v or %v", groupByYear, groupByTag)
+	}
+
+	if c.Images.MaxWidth < 1 {
+		return errors.New("images.maxWidth must be positive")
+	}
+
+	if c.Images.DefaultQuality < 1 || c.Images.DefaultQuality > 100 {
+		return errors.New("images.defaultQuality must be between 1 and 100")
+	}
+
+	for _, width := range c.Images.SrcsetWidths {
+		if width < 1 || width > c.Images.MaxWidth {
+			return fmt.Errorf("images.srcsetWidths: %v is not between 1 and images.maxWidth", width)
+		}
+	}
+
+	if c.Images.Avif.Quality < 0 || c.Images.Avif.Quality > 100 {
+		return errors.New("images.avif.quality must be between 0 and 100")
+	}
+
+	if c.Images.Avif.Speed < 0 || c.Images.Avif.Speed > 10 {
+		return errors.New("images.avif.speed must be between 0 and 10")
+	}
+
+	wc := c.Images.Watermark
+	switch wc.Position {
+	case watermarkCenter, watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight:
+	default:
+		return fmt.Errorf("images.watermark.position must be %v, %v, %v, %v or %v",
+			watermarkCenter, watermarkTopLeft, watermarkTopRight, watermarkBottomLeft, watermarkBottomRight)
+	}
+
+	if wc.Opacity < 0 || wc.Opacity > 1 || wc.Scale <= 0 || wc.Scale > 1 {
+		return errors.New("images.watermark.opacity must be between 0 and 1, and scale above 0 and at most 1")
+	}
+
+	if wc.Image != "" {
+		_, err := os.Stat(wc.Image)
+		if err != nil {
+			return fmt.Errorf("images.watermark.image: %v", err)
+		}
+	} else if wc.Enabled && wc.Text == "" {
+		return errors.New("images.watermark needs an image or text when enabled")
+	}
+
+	if c.Images.SignedURLs.ValidMinutes < 1 {
+		return errors.New("images.signedURLs.validMinutes must be positive")
+	}
+
+	if c.Images.Hotlink.Placeholder != "" {
+		_, err := os.Stat(c.Images.Hotlink.Placeholder)
+		if err != nil {
+			return fmt.Errorf("images.hotlink.placeholder: %v", err)
+		}
+	}
+
+	for _, g := range c.Robots.Groups {
+		if g.UserAgent == "" {
+			return errors.New("robots.groups: every group needs a userAgent")
+		}
+	}
+
+	oc := c.Admin.OIDC
+	if c.Admin.PasswordHash != "" || (c.Admin.Enabled && oc.Issuer == "") {
+		if c.Admin.Username == "" {
+			return errors.New("admin.username is required with admin.passwordHash")
+		}
+
+		_, err := bcrypt.Cost([]byte(c.Admin.PasswordHash))
+		if err != nil {
+			return fmt.Errorf("admin.passwordHash must be a bcrypt hash: %v", err)
+		}
+	}
+
+	if oc.Issuer != "" {
+		u, err := url.Parse(oc.Issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("admin.oidc.issuer must be an https URL, got %q", oc.Issuer)
+		}
+
+		if oc.ClientID == "" {
+			return errors.New("admin.oidc.clientID is required with admin.oidc.issuer")
+		}
+
+		// Without this, anyone with an account at the provider could sign
+		// in.
+		if len(oc.AllowedEmails) == 0 && len(oc.AllowedGroups) == 0 {
+			return errors.New("admin.oidc needs allowedEmails or allowedGroups")
+		}
+	}
+
+	if c.Admin.SessionIdleMinutes < 1 {
+		return errors.New("admin.sessionIdleMinutes must be positive")
+	}
+
+	if c.Admin.Enabled {
+		if c.Admin.MaxUploadMB < 1 {
+			return errors.New("admin.maxUploadMB must be positive")
+		}
+	}
+
+	if c.StatsDatabase == "" {
+		return errors.New("statsDatabase is required")
+	}
+
+	if c.StatsBackups < 0 {
+		return errors.New("statsBackups must not be negative")
+	}
+
+	if c.StatsLogGranularity != statsHourly && c.StatsLogGranularity != statsDaily && c.StatsLogGranularity != statsWeekly {
+		return fmt.Errorf("statsLogGranularity must be %v, %v or %v, got %q", statsHourly, statsDaily, statsWeekly, c.StatsLogGranularity)
+	}
+
+	if _, err := time.LoadLocation(c.StatsTimeZone); err != nil {
+		return fmt.Errorf("statsTimeZone: %v", err)
+	}
+
+	if c.Crawlers.Count != crawlersSeparate && c.Crawlers.Count != crawlersExclude {
+		return fmt.Errorf("crawlers.count must be %v or %v, got %q", crawlersSeparate, crawlersExclude, c.Crawlers.Count)
+	}
+
+	if c.Log.Format != logText && c.Log.Format != logJSON {
+		return fmt.Errorf("log.format must be %v or %v, got %q", logText, logJSON, c.Log.Format)
+	}
+
+	if c.Log.System != "" && c.Log.System != logSyslog && c.Log.System != logJournald {
+		return fmt.Errorf("log.system must be empty, %v or %v, got %q", logSyslog, logJournald, c.Log.System)
+	}
+
+	if c.Log.System != "" && c.Log.Dir != "" {
+		return errors.New("log.dir and log.system can't both be set")
+	}
+
+	if c.Log.SystemAccessLog && c.Log.System == "" {
+		return errors.New("log.systemAccessLog needs log.system")
+	}
+
+	if c.Log.MaxSizeMB < 1 || c.Log.MaxAgeHours < 1 {
+		return errors.New("log.maxSizeMB and log.maxAgeHours must be positive")
+	}
+
+	if c.Log.KeepDays < 0 {
+		return errors.New("log.keepDays must not be negative")
+	}
+
+	if c.Compression.MinBytes < 0 {
+		return errors.New("compression.minBytes must not be negative")
+	}
+
+	if c.Cache.StaticMaxAge < 0 || c.Cache.ImagesMaxAge < 0 {
+		return errors.New("cache.staticMaxAge and cache.imagesMaxAge must not be negative")
+	}
+
+	if c.PageCache.Enabled && c.PageCache.TTLSeconds <= 0 {
+		return errors.New("pageCache.ttlSeconds must be positive")
+	}
+
+	for name, limit := range map[string]rateConfig{
+		"default":  c.RateLimit.Default,
+		"stats":    c.RateLimit.Stats,
+		"download": c.RateLimit.Download,
+		"images":   c.RateLimit.Images,
+	} {
+		if limit.RPS <= 0 || limit.Burst < 1 {
+			return fmt.Errorf("rateLimit.%v: rps and burst must be positive", name)
+		}
+	}
+
+	if c.Pprof.Listen != "" && !loopbackAddress(c.Pprof.Listen) {
+		return fmt.Errorf("pprof.listen must be a loopback address and port, such as localhost:6060, got %q", c.Pprof.Listen)
+	}
+
+	for _, cidr := range c.TrustedProxies {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("trustedProxies: %v", err)
+		}
+	}
+
+	for _, cidr := range c.Crawlers.IPRanges {
+		_, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("crawlers.ipRanges: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// sitePath returns the path of a file under FileSystemRoot.
+func sitePath(elem ...string) string {
+	return filepath.Join(append([]string{conf.FileSystemRoot}, elem...)...)
+}
+
+// contentPath returns the path of a file under ContentRoot.
+func contentPath(elem ...string) string {
+	return filepath.Join(append([]string{conf.ContentRoot}, elem...)...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// contentRefreshInterval is how often the galleries directory is checked for
+// changes that the in-memory indexes need to pick up.
+const contentRefreshInterval = time.Minute
+
+// rebuildIndexes rebuilds everything derived from the gallery content.
+func rebuildIndexes() {
+	tags.rebuild()
+	search.rebuild()
+	sitemap.rebuild()
+	renderedPages.rebuild()
+	siteRedirects.rebuild()
+}
+
+// refreshIndexes rebuilds the indexes whenever the content changes or a
+// gallery goes live or expires, until the process exits.
+func refreshIndexes() {
+	last, lastTimed := contentFingerprint(), timedGalleries()
+	for range time.Tick(contentRefreshInterval) {
+		fingerprint, timed := contentFingerprint(), timedGalleries()
+		if fingerprint != last || timed != lastTimed {
+			last, lastTimed = fingerprint, timed
+			rebuildIndexes()
+		}
+	}
+}
+
+// contentFingerprint summarises the modification times and sizes of the
+// site pages, the redirects file and everything under the galleries
+// directory, so that a change to any gallery, manifest, blurb or caption
+// can be noticed cheaply.
+func contentFingerprint() int64 {
+	var fingerprint int64
+	add := func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			fingerprint += info.ModTime().UnixNano() ^ info.Size()
+		}
+		return nil
+	}
+
+	for _, page := range sitePages {
+		info, err := os.Stat(contentPath(page.filename))
+		add(page.filename, info, err)
+	}
+	info, err := os.Stat(contentPath(siteRedirectsFile))
+	add(siteRedirectsFile, info, err)
+
+	filepath.Walk(contentPath("galleries"), add)
+
+	return fingerprint
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// contentWatchDelay is how long the content must be left alone before the
+// indexes are rebuilt, so that copying in a whole gallery rebuilds them
+// once rather than for every file.
+const contentWatchDelay = 500 * time.Millisecond
+
+// watchContent rebuilds the indexes, and with them the cached pages, as
+// soon as anything under the galleries directory or a site page changes,
+// and drops the resized copies of any picture that is replaced or removed.
+// refreshIndexes still catches whatever it misses, such as changes on a
+// filesystem that sends no events.
+func watchContent() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(conf.ContentRoot)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	watchTree(watcher, contentPath("galleries"))
+
+	galleries := contentPath("galleries")
+	rebuild := time.NewTimer(contentWatchDelay)
+	rebuild.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if !watchedContent(event.Name) {
+				continue
+			}
+
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					watchTree(watcher, event.Name)
+				}
+			}
+
+			if src, err := filepath.Rel(galleries, event.Name); err == nil && isJpeg(src) && !event.Has(fsnotify.Chmod) {
+				forgetImage(filepath.ToSlash(src))
+			}
+
+			rebuild.Reset(contentWatchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(err)
+		case <-rebuild.C:
+			rebuildIndexes()
+		}
+	}
+}
+
+// watchTree watches root and every directory under it. fsnotify only
+// watches the directories it is given, not those inside them.
+func watchTree(watcher *fsnotify.Watcher, root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		err = watcher.Add(path)
+		if err != nil {
+			log.Println(err)
+		}
+		return nil
+	})
+}
+
+// watchedContent reports whether filename, from an event, is part of the
+// content: under the galleries directory, or one of the site pages beside
+// it. Anything else in ContentRoot, such as the stats database, is not.
+func watchedContent(filename string) bool {
+	if filepath.Dir(filename) != filepath.Clean(conf.ContentRoot) {
+		return true
+	}
+
+	base := filepath.Base(filename)
+	if base == "galleries" || base == siteRedirectsFile {
+		return true
+	}
+	for _, page := range sitePages {
+		if base == page.filename {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forgetImage drops the resized, converted and stripped copies of the
+// picture at src, relative to the galleries directory, and what was read
+// from its header, so that a replacement is used from the next request on
+// even if it is no newer than the copies.
+func forgetImage(src string) {
+	var filenames []string
+	variants, err := os.ReadDir(conf.Images.CacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	for _, variant := range variants {
+		if !variant.IsDir() {
+			continue
+		}
+
+		derived := filepath.Join(conf.Images.CacheDir, variant.Name(), filepath.FromSlash(src))
+		filenames = append(filenames, derived, derived+"."+formatWebp, derived+"."+formatAvif)
+	}
+
+	for _, filename := range filenames {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+	}
+
+	metadataCacheLock.Lock()
+	delete(metadataCache, contentPath("galleries", filepath.FromSlash(src)))
+	metadataCacheLock.Unlock()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What to do with crawlers' hits.
+const (
+	crawlersSeparate = "separate"
+	crawlersExclude  = "exclude"
+)
+
+// botAgents are found in the user agents of crawlers and scripts, lower
+// cased.
+var botAgents = []string{"bot", "crawl", "spider", "slurp", "curl", "wget", "python-requests", "go-http-client", "headless", "facebookexternalhit"}
+
+// defaultCrawlerRanges are where Google's, Bing's and Baidu's crawlers come
+// from, as they publish them. They name themselves in their user agents
+// anyway; this catches their fetches that don't.
+var defaultCrawlerRanges = []string{
+	"66.249.64.0/19",
+	"157.55.39.0/24",
+	"207.46.13.0/24",
+	"40.77.167.0/24",
+	"180.76.15.0/24",
+	"220.181.108.0/24",
+}
+
+// isCrawler reports whether the request came from a crawler or a script,
+// going by its user agent or its address.
+func isCrawler(r *http.Request) bool {
+	if deviceClass(r.UserAgent()) == deviceBot {
+		return true
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	for _, word := range conf.Crawlers.UserAgents {
+		if word != "" && strings.Contains(ua, strings.ToLower(word)) {
+			return true
+		}
+	}
+
+	ip := net.ParseIP(remoteIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range conf.Crawlers.IPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"net/http"
+)
+
+// csrfField and csrfHeader are where forms and scripts put the token that
+// proves a change was requested from one of our own pages.
+const (
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+type contextKey string
+
+const sessionIDKey contextKey = "sessionID"
+
+// withSessionID records the signed-in session on the request, for
+// csrfToken.
+func withSessionID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionIDKey, id))
+}
+
+// csrfToken is the token admin pages embed in their forms. It is derived
+// from the session, so it changes with every sign-in and is worthless
+// without the session cookie it belongs to.
+func csrfToken(r *http.Request) string {
+	id, _ := r.Context().Value(sessionIDKey).(string)
+	if id == "" {
+		return ""
+	}
+
+	return sessions.sign("csrf:" + id)
+}
+
+// validCSRF reports whether the request carries its session's token, in
+// the form or in a header. The form must already have been parsed.
+func validCSRF(r *http.Request) bool {
+	expected := csrfToken(r)
+	if expected == "" {
+		return false
+	}
+
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfField)
+	}
+
+	return hmac.Equal([]byte(token), []byte(expected))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statsChartPath serves the data behind the charts on /stats, as JSON.
+const statsChartPath = "/stats/chart"
+
+// statsPeriods are the spans, in days, that /stats sums and can chart.
+var statsPeriods = []int{7, 30, 365}
+
+// statsSparklineDays is how far back each gallery's sparkline on /stats
+// goes.
+const statsSparklineDays = 30
+
+// statsPointViewModel is one day on a chart.
+type statsPointViewModel struct {
+	Day      string `json:"day"`
+	Visits   int    `json:"visits"`
+	Visitors int    `json:"visitors"`
+	Crawlers int    `json:"crawlers"`
+}
+
+// statsPeriodViewModel sums the last Days days. As elsewhere, Visitors is
+// the sum of each day's.
+type statsPeriodViewModel struct {
+	Days     int
+	Visits   int
+	Visitors int
+	Crawlers int
+}
+
+// gallerySparklineViewModel is a gallery's visits on each of the last
+// statsSparklineDays days, oldest first.
+type gallerySparklineViewModel struct {
+	Gallery string `json:"gallery"`
+	Title   string `json:"title"`
+	Details string `json:"-"`
+	Visits  int    `json:"visits"`
+	Daily   []int  `json:"daily"`
+}
+
+type statsChartViewModel struct {
+	Days      int                         `json:"days"`
+	Series    []statsPointViewModel       `json:"series"`
+	Galleries []gallerySparklineViewModel `json:"galleries"`
+}
+
+// Points draws the sparkline as the points of an SVG polyline in a box 100
+// wide and 20 high, scaled to the busiest day.
+func (s gallerySparklineViewModel) Points() string {
+	busiest := 1
+	for _, visits := range s.Daily {
+		if visits > busiest {
+			busiest = visits
+		}
+	}
+
+	points := make([]string, len(s.Daily))
+	for i, visits := range s.Daily {
+		x := 0.0
+		if len(s.Daily) > 1 {
+			x = float64(i) * 100 / float64(len(s.Daily)-1)
+		}
+		y := 20 - float64(visits)*20/float64(busiest)
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, y)
+	}
+
+	return strings.Join(points, " ")
+}
+
+// seriesDays lists the last days days, oldest first.
+func seriesDays(days int) []string {
+	start := statsNow().AddDate(0, 0, 1-days)
+	result := make([]string, days)
+	for i := range result {
+		result[i] = start.AddDate(0, 0, i).Format(statsDayFormat)
+	}
+
+	return result
+}
+
+// dailySeries returns the visits, visitors and crawler hits on each of the
+// last days days, oldest first, to page or to any page. Days without any
+// are there too, as zeros.
+func dailySeries(days int, page string) ([]statsPointViewModel, error) {
+	series := make([]statsPointViewModel, 0, days)
+	dayList := seriesDays(days)
+	since := dayList[0]
+
+	hits, err := dailyHitCounts("hits", since, page)
+	if err != nil {
+		return nil, err
+	}
+	crawlers, err := dailyHitCounts("crawler_hits", since, page)
+	if err != nil {
+		return nil, err
+	}
+	visitors, err := dailyVisitors(since, page)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, day := range dayList {
+		series = append(series, statsPointViewModel{Day: day, Visits: hits[day], Visitors: visitors[day], Crawlers: crawlers[day]})
+	}
+
+	return series, nil
+}
+
+// dailyHitCounts returns the hits in table, hits or crawler_hits, on each
+// day since since, to page or to any page.
+func dailyHitCounts(table, since, page string) (map[string]int, error) {
+	rows, err := statsDB.Query("SELECT day, SUM(count) FROM "+table+" WHERE day >= ? AND (? = '' OR page = ?) GROUP BY day", since, page, page)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var count int
+		err = rows.Scan(&day, &count)
+		if err != nil {
+			return nil, err
+		}
+		counts[day] = count
+	}
+
+	return counts, rows.Err()
+}
+
+// statsPeriodTotals sums the tail of series, which must cover the longest
+// of statsPeriods, for each period.
+func statsPeriodTotals(series []statsPointViewModel) []statsPeriodViewModel {
+	periods := make([]statsPeriodViewModel, 0, len(statsPeriods))
+	for _, days := range statsPeriods {
+		p := statsPeriodViewModel{Days: days}
+		for _, point := range series[len(series)-days:] {
+			p.Visits += point.Visits
+			p.Visitors += point.Visitors
+			p.Crawlers += point.Crawlers
+		}
+		periods = append(periods, p)
+	}
+
+	return periods
+}
+
+// gallerySparklines returns each of galleries' visits per day over the last
+// days days, busiest first.
+func gallerySparklines(galleries []gallery, days int) ([]gallerySparklineViewModel, error) {
+	dayList := seriesDays(days)
+	index := make(map[string]int, days)
+	for i, day := range dayList {
+		index[day] = i
+	}
+
+	rows, err := statsDB.Query("SELECT page, day, count FROM hits WHERE day >= ?", dayList[0])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	daily := make(map[string][]int)
+	for rows.Next() {
+		var page, day string
+		var count int
+		err = rows.Scan(&page, &day, &count)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[day]
+		if !ok {
+			continue
+		}
+		if daily[page] == nil {
+			daily[page] = make([]int, days)
+		}
+		daily[page][i] += count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sparklines := make([]gallerySparklineViewModel, 0, len(galleries))
+	for _, g := range galleries {
+		s := gallerySparklineViewModel{Gallery: g.Dir, Title: g.Title, Details: statsGalleryPath + g.Dir, Daily: daily[g.Dir]}
+		if s.Daily == nil {
+			s.Daily = make([]int, days)
+		}
+		for _, visits := range s.Daily {
+			s.Visits += visits
+		}
+		sparklines = append(sparklines, s)
+	}
+	sort.SliceStable(sparklines, func(i, j int) bool {
+		return sparklines[i].Visits > sparklines[j].Visits
+	})
+
+	return sparklines, nil
+}
+
+// getStatsChartViewModel returns the chart data for the last days days.
+func getStatsChartViewModel(days int) (statsChartViewModel, error) {
+	flushHits()
+
+	series, err := dailySeries(days, "")
+	if err != nil {
+		return statsChartViewModel{}, err
+	}
+	galleries, err := gallerySparklines(listGalleries(), statsSparklineDays)
+	if err != nil {
+		return statsChartViewModel{}, err
+	}
+
+	return statsChartViewModel{Days: days, Series: series, Galleries: galleries}, nil
+}
+
+// statsChartHandler serves the visits per day over one of statsPeriods,
+// ?days=, and each gallery's sparkline, for the charts on /stats.
+func statsChartHandler(w http.ResponseWriter, r *http.Request) {
+	days := statsPeriods[1]
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || !validStatsPeriod(n) {
+			writeJSON(w, http.StatusBadRequest, apiError{fmt.Sprintf("days must be one of %v", statsPeriods)})
+			return
+		}
+		days = n
+	}
+
+	vm, err := getStatsChartViewModel(days)
+	if err != nil {
+		logRequestError(r, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{"could not read the stats"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, vm)
+}
+
+func validStatsPeriod(days int) bool {
+	for _, p := range statsPeriods {
+		if p == days {
+			return true
+		}
+	}
+
+	return false
+}
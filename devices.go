@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// The kinds of device visitors are counted by.
+const (
+	deviceBot     = "bot"
+	deviceDesktop = "desktop"
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+)
+
+// deviceKey is a visitor on a kind of device on a day.
+type deviceKey struct {
+	day     string
+	class   string
+	visitor string
+}
+
+// deviceClass guesses the kind of device from its user agent. A missing
+// user agent is taken for a script.
+func deviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	if ua == "" {
+		return deviceBot
+	}
+
+	for _, b := range botAgents {
+		if strings.Contains(ua, b) {
+			return deviceBot
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"), strings.Contains(ua, "kindle"), strings.Contains(ua, "silk/"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return deviceTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"), strings.Contains(ua, "windows phone"):
+		return deviceMobile
+	}
+
+	return deviceDesktop
+}
+
+func writeDevices(tx *sql.Tx, devices map[deviceKey]int) error {
+	stmt, err := tx.Prepare("INSERT INTO devices (day, class, visitor, count) VALUES (?, ?, ?, ?) ON CONFLICT (day, class, visitor) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, count := range devices {
+		_, err = stmt.Exec(key.day, key.class, key.visitor, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deviceViewModel is the visits and visitors from one kind of device, and
+// its share of the visitors.
+type deviceViewModel struct {
+	Class    string
+	HitCount int
+	Visitors int
+	Percent  int
+}
+
+// queryDevices returns the visits and visitors from each kind of device
+// since since, most visitors first.
+func queryDevices(since string) ([]deviceViewModel, error) {
+	rows, err := statsDB.Query(`
+		SELECT class, SUM(count), COUNT(*) AS visitors
+		FROM devices
+		WHERE day >= ?
+		GROUP BY class
+		ORDER BY visitors DESC, class`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := make([]deviceViewModel, 0)
+	total := 0
+	for rows.Next() {
+		var d deviceViewModel
+		err = rows.Scan(&d.Class, &d.HitCount, &d.Visitors)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+		total += d.Visitors
+	}
+	for i := range devices {
+		devices[i].Percent = devices[i].Visitors * 100 / total
+	}
+
+	return devices, rows.Err()
+}
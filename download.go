@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	downloadSuffix       = "/download"
+	originalDownloadPath = "/download/"
+)
+
+// originalDownloadURL links to the original of the image. In a gallery
+// with signedURLs set, the link is signed like its pictures'.
+func originalDownloadURL(g gallery, name string) string {
+	target := originalDownloadPath + url.PathEscape(g.Slug) + "/" + url.PathEscape(name)
+	if g.SignedURLs {
+		return signImageURL(target)
+	}
+
+	return target
+}
+
+// galleryDownloadURL links to the gallery's zip, signed like
+// originalDownloadURL.
+func galleryDownloadURL(g gallery) string {
+	target := g.URL() + downloadSuffix
+	if g.SignedURLs {
+		return signImageURL(target)
+	}
+
+	return target
+}
+
+// originalDownloadHandler serves /download/<gallery>/<image>, the original
+// file as an attachment, for galleries that let visitors have originals. A
+// watermarked gallery's is a full-size copy with the watermark.
+func originalDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, originalDownloadPath), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	g, _, ok := findGallery(parts[0])
+	name := parts[1]
+	if !ok || g.hiddenFrom(r) || (!g.downloadsOriginals() && !isAdmin(r)) ||
+		name != path.Base(name) || !isJpeg(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	src := path.Join(g.Dir, name)
+	if signedURLRequired(r, g, src) {
+		httpError(w, r, "This gallery's pictures are only served through the links on its page.", http.StatusForbidden)
+		return
+	}
+
+	filename := contentPath("galleries", g.Dir, name)
+	_, watermarked := galleryWatermark(g.Dir)
+	var err error
+	switch {
+	case watermarked:
+		filename, err = getDerivedImage(r.Context(), fullSizeDownload(src))
+	case galleryStripsMetadata(g.Dir):
+		filename, err = getStrippedImage(src)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		logRequestError(r, err)
+		httpError(w, r, "could not prepare the download", http.StatusInternalServerError)
+		return
+	}
+
+	if g.unpublished() {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeFile(w, r, filename)
+}
+
+// galleryDownloadHandler streams a zip of the gallery's images, originals
+// or web-sized as configured, writing it straight to the response. A
+// gallery that keeps its originals back always gets web-sized copies.
+func galleryDownloadHandler(w http.ResponseWriter, r *http.Request, g gallery, canonical bool) {
+	if !g.offersZip() || g.hiddenFrom(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if g.SignedURLs && !signedRequest(r) && !isAdmin(r) {
+		httpError(w, r, "This gallery's pictures are only served through the links on its page.", http.StatusForbidden)
+		return
+	}
+
+	if !canonical {
+		http.Redirect(w, r, galleryDownloadURL(g), http.StatusMovedPermanently)
+		return
+	}
+
+	if g.unpublished() {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", g.Slug+".zip"))
+
+	archive := zip.NewWriter(w)
+	for _, image := range getImages(r.Context(), g) {
+		err := addToDownload(r.Context(), archive, g, image.Name)
+		if err != nil {
+			// The response is under way, so all that can be done is to cut
+			// the zip short.
+			logRequestError(r, err)
+			return
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+// fullSizeDownload is the full-size, watermarked copy of the original at
+// src that is downloaded in its place.
+func fullSizeDownload(src string) resizeRequest {
+	return resizeRequest{
+		Src:     src,
+		Quality: conf.Images.DefaultQuality,
+		Format:  formatJpeg,
+	}
+}
+
+// addToDownload writes one image into the zip, never an original without
+// its gallery's watermark. JPEGs are stored rather than
+// deflated, since they hardly shrink.
+func addToDownload(ctx context.Context, archive *zip.Writer, g gallery, name string) error {
+	src := path.Join(g.Dir, name)
+	filename := contentPath("galleries", g.Dir, name)
+	_, watermarked := galleryWatermark(g.Dir)
+
+	var err error
+	switch {
+	case conf.Downloads.WebResolution || !g.downloadsOriginals():
+		filename, err = getDerivedImage(ctx, resizeRequest{
+			Src:     src,
+			Width:   conf.Images.MaxWidth,
+			Quality: conf.Images.DefaultQuality,
+			Format:  formatJpeg,
+		})
+	case watermarked:
+		filename, err = getDerivedImage(ctx, fullSizeDownload(src))
+	case galleryStripsMetadata(g.Dir):
+		filename, err = getStrippedImage(src)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	}
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, f)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// errorPageHints say what a visitor can do about an error, under its
+// message.
+var errorPageHints = map[int]string{
+	http.StatusForbidden:           "You may need to sign in, or to open the link you were given again.",
+	http.StatusNotFound:            "It may have moved, or been taken down.",
+	http.StatusTooManyRequests:     "Please wait a moment before trying again.",
+	http.StatusInternalServerError: "Something went wrong on our side. Please try again later.",
+}
+
+type errorViewModel struct {
+	Meta      pageMetadata
+	Status    int
+	Title     string
+	Message   string
+	Hint      string
+	RequestID string
+}
+
+// wantsPage reports whether r comes from a browser showing a page, which
+// should get an error as one too, rather than, say, an image or a script
+// fetching JSON.
+func wantsPage(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveErrorPage answers with an error page in the site's chrome, saying
+// message. If that can't be rendered it falls back to plain text, as
+// http.Error would.
+func serveErrorPage(ctx context.Context, w http.ResponseWriter, message string, status int) {
+	vm := errorViewModel{
+		Meta:      newPageMetadata(http.StatusText(status), "", "", "/"),
+		Status:    status,
+		Title:     http.StatusText(status),
+		Message:   message,
+		Hint:      errorPageHints[status],
+		RequestID: requestID(ctx),
+	}
+
+	var page bytes.Buffer
+	t, err := templates.get("error")
+	if err == nil {
+		err = t.Execute(&page, vm)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, err.Error())
+		http.Error(w, withRequestIDNote(ctx, message), status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
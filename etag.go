@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etagWriter holds on to a page as it is rendered, so that it can be sent
+// with an ETag of its hash, or not sent at all if the client has it. Any
+// other response goes straight through.
+type etagWriter struct {
+	http.ResponseWriter
+	status    int
+	decided   bool
+	buffering bool
+	buf       []byte
+}
+
+func (e *etagWriter) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+}
+
+func (e *etagWriter) Write(b []byte) (int, error) {
+	if !e.decided {
+		e.decide(b)
+	}
+	if e.buffering {
+		e.buf = append(e.buf, b...)
+		return len(b), nil
+	}
+
+	return e.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection's own writer.
+func (e *etagWriter) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// decide holds on to the response if it is a page that can be cached:
+// a 200 with no ETag of its own and not marked no-store. Otherwise it
+// sends the status line.
+func (e *etagWriter) decide(body []byte) {
+	e.decided = true
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+
+	h := e.Header()
+	if h.Get("Content-Type") == "" && h.Get("Content-Encoding") == "" && len(body) > 0 {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+
+	e.buffering = e.status == http.StatusOK && h.Get("ETag") == "" &&
+		strings.HasPrefix(h.Get("Content-Type"), "text/html") &&
+		!strings.Contains(h.Get("Cache-Control"), "no-store")
+	if !e.buffering {
+		e.ResponseWriter.WriteHeader(e.status)
+	}
+}
+
+// finish sends the page held on to, or 304 if the client's copy matches.
+func (e *etagWriter) finish(r *http.Request) {
+	if !e.decided {
+		e.decide(nil)
+	}
+	if !e.buffering {
+		return
+	}
+
+	sum := sha256.Sum256(e.buf)
+	// Weak, since the page is the same whether or not it is compressed.
+	etag := `W/"` + base64.RawURLEncoding.EncodeToString(sum[:12]) + `"`
+	h := e.Header()
+	h.Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		e.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(e.buf)))
+	e.ResponseWriter.WriteHeader(e.status)
+	e.ResponseWriter.Write(e.buf)
+}
+
+// etagMatches compares an If-None-Match header with etag, weakly, as
+// If-None-Match does.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// conditionalPages sends rendered pages with an ETag of their contents,
+// and answers 304 Not Modified to a GET whose If-None-Match has it, so
+// that returning visitors don't download a page again when nothing on it
+// has changed.
+func conditionalPages(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		e := &etagWriter{ResponseWriter: w}
+		handler.ServeHTTP(e, r)
+		e.finish(r)
+	})
+}
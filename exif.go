@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rwcarlsen/goexif/exif"
+	"io"
+	"strings"
+)
+
+// hideExifFile is a marker: a gallery directory containing a file with this
+// name does not show shooting info under its images.
+const hideExifFile = "hide-exif"
+
+// exifViewModel is the shooting info shown under an image. Fields the camera
+// did not record are empty.
+type exifViewModel struct {
+	Camera   string
+	Lens     string
+	Aperture string
+	Shutter  string
+	ISO      string
+	Captured string
+}
+
+func galleryShowsExif(gallery string) bool {
+	return !fileExists(contentPath("galleries", gallery, hideExifFile))
+}
+
+// readExif extracts shooting info from a JPEG, returning nil if it has none.
+func readExif(r io.Reader) *exifViewModel {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil
+	}
+
+	result := &exifViewModel{
+		Camera: getCamera(x),
+		Lens:   getExifString(x, exif.LensModel),
+	}
+
+	tag, err := x.Get(exif.FNumber)
+	if err == nil {
+		f, err := tag.Rat(0)
+		if err == nil && f.Sign() > 0 {
+			aperture, _ := f.Float64()
+			result.Aperture = fmt.Sprintf("f/%.1f", aperture)
+		}
+	}
+
+	tag, err = x.Get(exif.ExposureTime)
+	if err == nil {
+		num, den, err := tag.Rat2(0)
+		if err == nil && num > 0 && den > 0 {
+			result.Shutter = formatShutter(num, den)
+		}
+	}
+
+	tag, err = x.Get(exif.ISOSpeedRatings)
+	if err == nil {
+		iso, err := tag.Int(0)
+		if err == nil {
+			result.ISO = fmt.Sprintf("ISO %v", iso)
+		}
+	}
+
+	captured, err := x.DateTime()
+	if err == nil {
+		result.Captured = captured.Format("2 January 2006")
+	}
+
+	if *result == (exifViewModel{}) {
+		return nil
+	}
+
+	return result
+}
+
+// getCamera joins make and model, skipping the make when the model already
+// starts with it (e.g. "Canon" / "Canon EOS 5D").
+func getCamera(x *exif.Exif) string {
+	maker := getExifString(x, exif.Make)
+	model := getExifString(x, exif.Model)
+
+	if maker == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		return model
+	}
+
+	return strings.TrimSpace(maker + " " + model)
+}
+
+func getExifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Trim(s, "\x00"))
+}
+
+// formatShutter writes exposures under a second as a fraction, e.g. 1/250s,
+// and longer ones in seconds, e.g. 2s.
+func formatShutter(num, den int64) string {
+	if num >= den {
+		return fmt.Sprintf("%gs", float64(num)/float64(den))
+	}
+
+	return fmt.Sprintf("1/%vs", (den+num/2)/num)
+}
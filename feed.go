@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const feedTitle = "Chez Watts Gallery"
+
+// jsonFeed is a JSON Feed 1.1 document, https://jsonfeed.org/version/1.1.
+type jsonFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url"`
+	FeedURL     string         `json:"feed_url"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	Image         string   `json:"image,omitempty"`
+	DatePublished string   `json:"date_published,omitempty"`
+	DateModified  string   `json:"date_modified,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+// feedGalleries returns the listed galleries, most recently changed first.
+func feedGalleries() []gallery {
+	galleries := listedGalleries()
+	sort.SliceStable(galleries, func(i, j int) bool {
+		return galleries[i].lastChanged().After(galleries[j].lastChanged())
+	})
+
+	return galleries
+}
+
+func jsonFeedHandler(w http.ResponseWriter, r *http.Request) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       feedTitle,
+		HomePageURL: absoluteURL("/"),
+		FeedURL:     absoluteURL("/feed.json"),
+		Items:       make([]jsonFeedItem, 0),
+	}
+
+	for _, g := range feedGalleries() {
+		item := jsonFeedItem{
+			ID:          absoluteURL(g.URL()),
+			URL:         g.canonicalURL(1),
+			Title:       g.Title,
+			ContentHTML: string(getGalleryBlurb(g.Dir)),
+			Summary:     g.Description,
+			Image:       absoluteURL(g.previewImage()),
+			Tags:        g.Tags,
+		}
+
+		if changed := g.lastChanged(); !changed.IsZero() {
+			item.DateModified = changed.UTC().Format(time.RFC3339)
+		}
+		if !g.publishAt.IsZero() {
+			item.DatePublished = g.publishAt.UTC().Format(time.RFC3339)
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+	err := json.NewEncoder(w).Encode(feed)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+// absoluteURL prefixes a site path with the public origin.
+func absoluteURL(path string) string {
+	return strings.TrimSuffix(conf.SiteURL, "/") + path
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const manifestFile = "gallery.yaml"
+
+// orderFile optionally lists gallery directory names or slugs, one per
+// line, to show first on the index in that order.
+const orderFile = "order.txt"
+
+// renamesFile lists old gallery names that now live elsewhere, one per line
+// as the old and new names separated by a tab. It is appended to when a
+// gallery is renamed.
+const renamesFile = "renames.txt"
+
+// oldRenamesFile is what renamesFile was called before redirects.txt in the
+// content root came to mean something else. It is still read.
+const oldRenamesFile = "redirects.txt"
+
+// maxRedirects bounds how many renames are followed, in case the file has
+// a loop.
+const maxRedirects = 10
+
+// Gallery visibilities. Unlisted galleries are left out of the index but can
+// still be opened by anyone with the link. Drafts are left out too, and are
+// only shown to the admin; to everyone else they don't exist.
+const (
+	visibilityPublic   = "public"
+	visibilityUnlisted = "unlisted"
+	visibilityDraft    = "draft"
+	visibilityProofing = "proofing"
+)
+
+// Who may fetch a gallery's original image files.
+const (
+	originalsPublic   = "public"
+	originalsDownload = "download"
+	originalsNone     = "none"
+)
+
+// What happens to a gallery when it expires.
+const (
+	expiryHide   = "hide"
+	expiryUnlist = "unlist"
+)
+
+// Gallery orders for the index, used for galleries that are neither in the
+// order file nor weighted.
+const (
+	orderByName   = "name"
+	orderByNewest = "newest"
+	orderByOldest = "oldest"
+)
+
+// Ways the index can group galleries.
+const (
+	groupByYear = "year"
+	groupByTag  = "tag"
+)
+
+// Image orders a gallery manifest can ask for.
+const (
+	sortByName     = "name"
+	sortByNameDesc = "name-desc"
+	sortByDate     = "date"
+	sortByDateDesc = "date-desc"
+)
+
+// galleryManifest is the optional gallery.yaml in a gallery directory. Every
+// field may be left out.
+type galleryManifest struct {
+	Title       string `yaml:"title"`
+	Slug        string `yaml:"slug"`
+	Description string `yaml:"description"`
+
+	// Cover is the image shown for the gallery on the index, relative to the
+	// gallery directory. Defaults to preview.jpg.
+	Cover string `yaml:"cover"`
+
+	// Sort orders the images: name (the default), name-desc, date or
+	// date-desc, where date is the file modification time.
+	Sort string `yaml:"sort"`
+
+	// Year is when the work was made, for grouping the index by year.
+	// Defaults to the year the directory was last modified.
+	Year int `yaml:"year"`
+
+	// Weight pins the gallery on the index: weighted galleries come before
+	// unweighted ones, lightest first.
+	Weight int `yaml:"weight"`
+
+	Visibility string   `yaml:"visibility"`
+	Tags       []string `yaml:"tags"`
+
+	// PublishAt keeps the gallery hidden, as if it were a draft, until then.
+	// It then goes live by itself, as though it had just been changed. See
+	// parseManifestTime for the formats understood.
+	PublishAt string `yaml:"publishAt"`
+
+	// ExpiresAt takes the gallery down at that time: it is hidden like a
+	// draft or, if OnExpiry is "unlist", just left off the index.
+	ExpiresAt string `yaml:"expiresAt"`
+	OnExpiry  string `yaml:"onExpiry"`
+
+	// Captions maps image file names to markdown captions. A sidecar file
+	// named after the image with .md appended takes precedence.
+	Captions map[string]string `yaml:"captions"`
+
+	// Exif and StripMetadata override the hide-exif, strip-metadata and
+	// keep-metadata marker files when set.
+	Exif          *bool `yaml:"exif"`
+	StripMetadata *bool `yaml:"stripMetadata"`
+
+	// Originals says who may fetch the full-size image files: anyone
+	// (public), only as a download from /download/ (download), or nobody
+	// but the admin, leaving visitors the resized copies (none).
+	Originals string `yaml:"originals"`
+
+	// SignedURLs serves the pictures, apart from the cover, only through
+	// signed links that expire after images.signedURLs.validMinutes.
+	SignedURLs bool `yaml:"signedURLs"`
+
+	// Watermark overrides images.watermark.enabled when set. WatermarkImage,
+	// a PNG in the gallery directory, or WatermarkText replaces the
+	// configured watermark, and turns it on unless Watermark is false.
+	Watermark      *bool  `yaml:"watermark"`
+	WatermarkImage string `yaml:"watermarkImage"`
+	WatermarkText  string `yaml:"watermarkText"`
+
+	// NoRightClick overrides images.noRightClick and the no-right-click and
+	// allow-right-click marker files when set.
+	NoRightClick *bool `yaml:"noRightClick"`
+
+	// Downloads overrides downloads.enabled for the gallery's zip.
+	Downloads *bool `yaml:"downloads"`
+}
+
+// gallery is a gallery directory together with its manifest, with defaults
+// filled in for anything the manifest leaves out.
+type gallery struct {
+	// Dir is the directory name under the galleries directory. It is also
+	// the key the gallery's hits are counted under.
+	Dir string
+
+	// ModTime is the directory's modification time, which changes whenever
+	// an image is added or removed.
+	ModTime time.Time
+
+	// publishAt and expiresAt are the manifest's PublishAt and ExpiresAt,
+	// or zero if it has none.
+	publishAt time.Time
+	expiresAt time.Time
+
+	galleryManifest
+}
+
+// loadGallery reads the manifest of the gallery in dir, if it has one.
+func loadGallery(dir string) gallery {
+	g := gallery{Dir: dir}
+
+	info, err := os.Stat(contentPath("galleries", dir))
+	if err == nil {
+		g.ModTime = info.ModTime()
+	}
+
+	data, err := ioutil.ReadFile(contentPath("galleries", dir, manifestFile))
+	if err == nil {
+		err = yaml.Unmarshal(data, &g.galleryManifest)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(dir, err)
+	}
+
+	if g.Title == "" {
+		g.Title = dir
+	}
+	if g.Slug == "" || strings.ContainsAny(g.Slug, "/?#") {
+		if g.Slug != "" {
+			log.Println(dir, "ignoring invalid slug", g.Slug)
+		}
+		g.Slug = dir
+	}
+	if g.Cover == "" {
+		g.Cover = "preview.jpg"
+	}
+	if g.Sort == "" {
+		g.Sort = sortByName
+	}
+	if g.Visibility == "" {
+		g.Visibility = visibilityPublic
+	}
+	if g.PublishAt != "" {
+		g.publishAt, err = parseManifestTime(g.PublishAt)
+		if err != nil {
+			// Better late than early.
+			log.Println(dir, "keeping the gallery a draft:", err)
+			g.Visibility = visibilityDraft
+		}
+	}
+	if g.ExpiresAt != "" {
+		g.expiresAt, err = parseManifestTime(g.ExpiresAt)
+		if err != nil {
+			// Better early than late.
+			log.Println(dir, "treating the gallery as expired:", err)
+			g.expiresAt = g.ModTime
+		}
+	}
+	if g.OnExpiry != expiryUnlist {
+		g.OnExpiry = expiryHide
+	}
+	switch g.Originals {
+	case "":
+		g.Originals = originalsPublic
+	case originalsPublic, originalsDownload, originalsNone:
+	default:
+		log.Println(dir, "not serving originals, since originals is not public, download or none:", g.Originals)
+		g.Originals = originalsNone
+	}
+
+	if len(g.Tags) == 0 {
+		g.Tags, err = readTagsFile(dir)
+		if err != nil {
+			log.Println(dir, err)
+		}
+	}
+	g.Tags = normalizeTags(g.Tags)
+
+	return g
+}
+
+// listGalleries loads every gallery directory, in index order.
+func listGalleries() []gallery {
+	result := make([]gallery, 0)
+	infos, err := ioutil.ReadDir(contentPath("galleries"))
+	if err != nil {
+		log.Println(err)
+		return result
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			result = append(result, loadGallery(info.Name()))
+		}
+	}
+
+	sortGalleries(result, readOrderFile())
+
+	return result
+}
+
+// readOrderFile returns the position of each name in the order file.
+func readOrderFile() map[string]int {
+	result := make(map[string]int)
+
+	data, err := ioutil.ReadFile(contentPath("galleries", orderFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+		}
+		return result
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		name := strings.TrimSpace(line)
+		if _, ok := result[name]; name != "" && !ok {
+			result[name] = len(result)
+		}
+	}
+
+	return result
+}
+
+// sortGalleries puts the galleries named in the order file first, then the
+// weighted ones, then the rest in the configured galleryOrder.
+func sortGalleries(galleries []gallery, order map[string]int) {
+	position := func(g gallery) (int, bool) {
+		if p, ok := order[g.Slug]; ok {
+			return p, true
+		}
+		p, ok := order[g.Dir]
+		return p, ok
+	}
+
+	sort.SliceStable(galleries, func(i, j int) bool {
+		a, b := galleries[i], galleries[j]
+
+		pa, aOrdered := position(a)
+		pb, bOrdered := position(b)
+		if aOrdered || bOrdered {
+			return aOrdered && (!bOrdered || pa < pb)
+		}
+
+		if a.Weight != 0 || b.Weight != 0 {
+			return a.Weight != 0 && (b.Weight == 0 || a.Weight < b.Weight)
+		}
+
+		switch conf.GalleryOrder {
+		case orderByNewest:
+			return a.lastChanged().After(b.lastChanged())
+		case orderByOldest:
+			return a.lastChanged().Before(b.lastChanged())
+		}
+
+		return a.Dir < b.Dir
+	})
+}
+
+// listedGalleries returns the galleries shown on the index, in order.
+func listedGalleries() []gallery {
+	result := make([]gallery, 0)
+	for _, g := range listGalleries() {
+		if g.listed() {
+			result = append(result, g)
+		}
+	}
+
+	return result
+}
+
+// findGallery returns the gallery whose slug is name or, failing that, whose
+// directory name is name, so that links made before the gallery was given a
+// slug keep working. Names of renamed galleries are followed through the
+// renames file. canonical is false unless name is the slug.
+func findGallery(name string) (g gallery, canonical bool, ok bool) {
+	galleries := listGalleries()
+	renames := readRenames()
+
+	for i := 0; i <= maxRedirects; i++ {
+		for _, g := range galleries {
+			if g.Slug == name {
+				return g, i == 0, true
+			}
+		}
+
+		for _, g := range galleries {
+			if g.Dir == name {
+				return g, i == 0 && g.Slug == g.Dir, true
+			}
+		}
+
+		next, found := renames[name]
+		if !found {
+			break
+		}
+		name = next
+	}
+
+	return gallery{}, false, false
+}
+
+// readRenames returns the renames file, after the old one, as a map from
+// old to new names. Later lines win, so a name can be reused after being
+// renamed.
+func readRenames() map[string]string {
+	result := make(map[string]string)
+
+	for _, name := range []string{oldRenamesFile, renamesFile} {
+		data, err := ioutil.ReadFile(contentPath("galleries", name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println(err)
+			}
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.SplitN(strings.TrimRight(line, "\r"), "\t", 2)
+			if len(fields) == 2 && fields[0] != "" && fields[1] != "" {
+				result[fields[0]] = fields[1]
+			}
+		}
+	}
+
+	return result
+}
+
+// addRename records that old now lives at new.
+func addRename(old, new string) error {
+	f, err := os.OpenFile(contentPath("galleries", renamesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "%v\t%v\n", old, new)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (g gallery) listed() bool {
+	return g.Visibility == visibilityPublic && !g.scheduled() && !g.expired()
+}
+
+func (g gallery) draft() bool {
+	return g.Visibility == visibilityDraft
+}
+
+// proofing reports whether the gallery is only for those sent one of its
+// access links.
+func (g gallery) proofing() bool {
+	return g.Visibility == visibilityProofing
+}
+
+// scheduled reports whether the gallery has a publishing time still to come.
+func (g gallery) scheduled() bool {
+	return time.Now().Before(g.publishAt)
+}
+
+// manifestTimeLayouts are the ways a time can be written in a manifest.
+// Times without a zone are in the server's local time.
+var manifestTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseManifestTime(s string) (time.Time, error) {
+	for _, layout := range manifestTimeLayouts {
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(s), time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("can't read the time %q; write it like 2006-01-02 15:04", s)
+}
+
+// expired reports whether the gallery's expiry time has passed.
+func (g gallery) expired() bool {
+	return !g.expiresAt.IsZero() && !time.Now().Before(g.expiresAt)
+}
+
+// withdrawn reports whether the gallery is not yet, or no longer, to be
+// seen by anyone but the admin.
+func (g gallery) withdrawn() bool {
+	return g.draft() || g.scheduled() || (g.expired() && g.OnExpiry == expiryHide)
+}
+
+// unpublished reports whether the gallery is kept from the public.
+func (g gallery) unpublished() bool {
+	return g.withdrawn() || g.proofing()
+}
+
+// hiddenFrom reports whether the gallery is unpublished and the request may
+// not see it: it is neither the admin's nor, for a proofing gallery, from
+// someone who followed one of its access links.
+func (g gallery) hiddenFrom(r *http.Request) bool {
+	if !g.unpublished() || isAdmin(r) {
+		return false
+	}
+	if g.withdrawn() {
+		return true
+	}
+
+	_, ok := accessLinkFor(r, g)
+	return !ok
+}
+
+// timingLabel says when the gallery goes live or comes down, for the admin,
+// or is empty if it has no times set.
+func (g gallery) timingLabel() string {
+	const layout = "2 Jan 2006 15:04 MST"
+	switch {
+	case g.scheduled():
+		return "Scheduled for " + g.publishAt.Format(layout)
+	case g.expired():
+		return "Expired " + g.expiresAt.Format(layout)
+	case !g.expiresAt.IsZero():
+		return "Expires " + g.expiresAt.Format(layout)
+	}
+
+	return ""
+}
+
+// lastChanged is when the gallery last changed as far as visitors are
+// concerned: when its directory was modified or, if later, when it was
+// published.
+func (g gallery) lastChanged() time.Time {
+	if g.publishAt.After(g.ModTime) && !g.scheduled() {
+		return g.publishAt
+	}
+
+	return g.ModTime
+}
+
+// timedGalleries counts the galleries waiting to be published or to
+// expire, so that the indexes can be rebuilt when one goes live or comes
+// down.
+func timedGalleries() int {
+	count := 0
+	for _, g := range listGalleries() {
+		if g.scheduled() || (!g.expiresAt.IsZero() && !g.expired()) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (g gallery) year() int {
+	if g.Year != 0 {
+		return g.Year
+	}
+
+	return g.ModTime.Year()
+}
+
+func (g gallery) URL() string {
+	return "/gallery/" + url.PathEscape(g.Slug)
+}
+
+func (g gallery) previewImage() string {
+	return g.imageURL(g.Cover)
+}
+
+// imageURL is where pages point at the image. In a gallery that keeps its
+// originals back, that is the largest resized copy. The preview is small
+// already.
+func (g gallery) imageURL(name string) string {
+	target := fmt.Sprintf("/img-resize?src=%v&w=%v", url.QueryEscape("/galleries/"+g.Dir+"/"+name), conf.Images.MaxWidth)
+	if g.servesOriginals() || name == "preview.jpg" {
+		target = "/galleries/" + url.PathEscape(g.Dir) + "/" + url.PathEscape(name)
+	}
+
+	if g.SignedURLs && name != g.Cover && name != "preview.jpg" {
+		return signImageURL(target)
+	}
+
+	return target
+}
+
+// offersZip reports whether the gallery can be downloaded as a zip.
+func (g gallery) offersZip() bool {
+	if g.Downloads != nil {
+		return *g.Downloads
+	}
+
+	return conf.Downloads.Enabled
+}
+
+// servesOriginals reports whether anyone may fetch the original files from
+// /galleries/.
+func (g gallery) servesOriginals() bool {
+	return g.Originals == originalsPublic
+}
+
+// downloadsOriginals reports whether visitors may download the original
+// files, from /download/ or in the gallery's zip.
+func (g gallery) downloadsOriginals() bool {
+	return g.Originals != originalsNone
+}
+
+func (g gallery) showsExif() bool {
+	if g.Exif != nil {
+		return *g.Exif
+	}
+
+	return galleryShowsExif(g.Dir)
+}
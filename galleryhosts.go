@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// subdomainDomain is the domain the galleries' subdomains are under:
+// subdomains.domain, or else siteURL's host.
+func subdomainDomain() string {
+	if conf.Subdomains.Domain != "" {
+		return strings.ToLower(conf.Subdomains.Domain)
+	}
+
+	u, err := url.Parse(conf.SiteURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// hostLabel reports whether s can be the first label of a host name:
+// letters, digits and hyphens, not at either end, up to 63 of them.
+func hostLabel(s string) bool {
+	if s == "" || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if c != '-' && (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// galleryDomains returns the domains of galleryDomains that are g's, in
+// alphabetical order.
+func (g gallery) galleryDomains() []string {
+	var domains []string
+	for domain, name := range conf.GalleryDomains {
+		if name == g.Slug || name == g.Dir {
+			domains = append(domains, strings.ToLower(domain))
+		}
+	}
+	sort.Strings(domains)
+
+	return domains
+}
+
+// galleryHost returns the host g is served at of its own: the first of its
+// galleryDomains, or else its subdomain, with subdomains enabled and a slug
+// that can be a host name. Unpublished galleries have none, since
+// certificates for them would give their names away in the public
+// certificate logs.
+func (g gallery) galleryHost() (string, bool) {
+	if g.unpublished() {
+		return "", false
+	}
+	if domains := g.galleryDomains(); len(domains) > 0 {
+		return domains[0], true
+	}
+	if !conf.Subdomains.Enabled || !hostLabel(g.Slug) {
+		return "", false
+	}
+
+	return strings.ToLower(g.Slug) + "." + subdomainDomain(), true
+}
+
+// canonicalURL is the absolute URL of page of g: at its galleryHost if it
+// has one, and at siteURL otherwise.
+func (g gallery) canonicalURL(page int) string {
+	host, ok := g.galleryHost()
+	if !ok {
+		return absoluteURL(pageURL(g.URL(), nil, page))
+	}
+
+	scheme := "https"
+	if u, err := url.Parse(conf.SiteURL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	return scheme + "://" + host + pageURL("/", nil, page)
+}
+
+// hostGallery returns the gallery host, without a port, is one of the
+// galleryDomains of, or the subdomain of. Names the site goes by itself,
+// such as www, are never a gallery's subdomain.
+func hostGallery(host string) (gallery, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for domain, name := range conf.GalleryDomains {
+		if strings.EqualFold(domain, host) {
+			g, _, ok := findGallery(name)
+			return g, ok && !g.unpublished()
+		}
+	}
+
+	label, ok := strings.CutSuffix(host, "."+subdomainDomain())
+	if !conf.Subdomains.Enabled || !ok || !hostLabel(label) {
+		return gallery{}, false
+	}
+	for _, h := range siteHosts() {
+		if strings.EqualFold(h, host) {
+			return gallery{}, false
+		}
+	}
+
+	for _, g := range listGalleries() {
+		if !g.unpublished() && hostLabel(g.Slug) && strings.EqualFold(g.Slug, label) {
+			return g, true
+		}
+	}
+
+	return gallery{}, false
+}
+
+// routeGalleryHosts serves a gallery's page at the root of its domain or
+// subdomain, as if it had been asked for at its path. Everything else
+// there, the styles, pictures and other pages, is served as on the site's
+// own host.
+func routeGalleryHosts(handler http.Handler) http.Handler {
+	if !conf.Subdomains.Enabled && len(conf.GalleryDomains) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if g, ok := hostGallery(host); ok {
+				r2 := r.Clone(r.Context())
+				r2.URL.Path = g.URL()
+				r2.URL.RawPath = ""
+				r = r2
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// galleryHostPolicy lets autocert get certificates for the galleries'
+// domains and subdomains as well as for policy's hosts. Let's Encrypt issues
+// wildcard certificates only through DNS, so each subdomain gets one of its
+// own.
+func galleryHostPolicy(policy autocert.HostPolicy) autocert.HostPolicy {
+	if !conf.Subdomains.Enabled && len(conf.GalleryDomains) == 0 {
+		return policy
+	}
+
+	return func(ctx context.Context, host string) error {
+		if _, ok := hostGallery(host); ok {
+			return nil
+		}
+		return policy(ctx, host)
+	}
+}
+
+// checkGalleryHostCertificate warns if the certificate from the config
+// doesn't cover the galleries' domains, or their subdomains, which need a
+// wildcard certificate for the domain they are under.
+func checkGalleryHostCertificate() {
+	if !conf.Subdomains.Enabled && len(conf.GalleryDomains) == 0 || conf.Autocert.Enabled || conf.HttpsCertificate == "" {
+		return
+	}
+
+	pair, err := tls.LoadX509KeyPair(conf.HttpsCertificate, conf.HttpsPrivateKey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if conf.Subdomains.Enabled {
+		domain := subdomainDomain()
+		err = cert.VerifyHostname("gallery." + domain)
+		if err != nil {
+			log.Printf("httpsCertificate is not for *.%v, so browsers will refuse the galleries' subdomains", domain)
+		}
+	}
+	for domain := range conf.GalleryDomains {
+		err = cert.VerifyHostname(domain)
+		if err != nil {
+			log.Printf("httpsCertificate is not for %v, so browsers will refuse it", domain)
+		}
+	}
+}
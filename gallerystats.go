@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Where gallery pages report the pictures they show, and where a gallery's
+// stats are shown.
+const (
+	statsViewPath    = "/stats/view"
+	statsGalleryPath = "/stats/gallery/"
+)
+
+// imageViewKey is a picture in a gallery and a day it was shown on.
+type imageViewKey struct {
+	gallery string
+	image   string
+	day     string
+}
+
+func writeImageViews(tx *sql.Tx, views map[imageViewKey]int) error {
+	stmt, err := tx.Prepare("INSERT INTO image_views (gallery, image, day, count) VALUES (?, ?, ?, ?) ON CONFLICT (gallery, image, day) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, count := range views {
+		_, err = stmt.Exec(key.gallery, key.image, key.day, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// statsViewHandler counts a picture as shown, as reported by the gallery
+// page's script when it comes up in the slideshow.
+func statsViewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok || g.unpublished() {
+		http.NotFound(w, r)
+		return
+	}
+
+	image := r.FormValue("image")
+	if image != path.Base(image) || !isJpeg(image) || !fileExists(contentPath("galleries", g.Dir, image)) {
+		httpError(w, r, "No such picture", http.StatusBadRequest)
+		return
+	}
+
+	if !isCrawler(r) && !conf.ReadOnly {
+		key := imageViewKey{g.Dir, image, statsNow().Format(statsDayFormat)}
+		hitsLock.Lock()
+		pending.imageViews[key]++
+		hitsLock.Unlock()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type imageStatsViewModel struct {
+	Name   string
+	URL    string
+	Srcset string
+	Shown  int
+}
+
+type statsGalleryViewModel struct {
+	Title     string
+	Dir       string
+	Days      int
+	Total     int
+	Visitors  int
+	Daily     []dayHitCountViewModel
+	Referrers []referrerViewModel
+	Images    []imageStatsViewModel
+}
+
+// getStatsGalleryViewModel returns the visits to g on each of the last days
+// days, where they came from, and how often each picture was shown.
+func getStatsGalleryViewModel(g gallery, days int) (statsGalleryViewModel, error) {
+	daily, err := getStatsLogViewModel(days, g.Dir)
+	if err != nil {
+		return statsGalleryViewModel{}, err
+	}
+	referrers, err := getStatsReferrersViewModel(days, g.Dir)
+	if err != nil {
+		return statsGalleryViewModel{}, err
+	}
+
+	vm := statsGalleryViewModel{
+		Title:     g.Title,
+		Dir:       g.Dir,
+		Days:      days,
+		Daily:     daily.Days,
+		Referrers: referrers.Referrers,
+		Images:    make([]imageStatsViewModel, 0),
+	}
+	for _, d := range daily.Days {
+		vm.Total += d.Total
+		vm.Visitors += d.Visitors
+	}
+
+	since := statsNow().AddDate(0, 0, 1-days).Format(statsDayFormat)
+	rows, err := statsDB.Query("SELECT image, SUM(count) AS shown FROM image_views WHERE gallery = ? AND day >= ? GROUP BY image ORDER BY shown DESC, image", g.Dir, since)
+	if err != nil {
+		return statsGalleryViewModel{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var image imageStatsViewModel
+		err = rows.Scan(&image.Name, &image.Shown)
+		if err != nil {
+			return statsGalleryViewModel{}, err
+		}
+		image.URL = g.imageURL(image.Name)
+		image.Srcset = g.srcset(fmt.Sprintf("/galleries/%v/%v", g.Dir, image.Name))
+		vm.Images = append(vm.Images, image)
+	}
+
+	return vm, rows.Err()
+}
+
+// statsGalleryHandler shows one gallery's visits per day, its referrers and
+// its most shown pictures, over the last statsLogDays days or ?days=.
+func statsGalleryHandler(w http.ResponseWriter, r *http.Request) {
+	g, _, ok := findGallery(strings.TrimPrefix(r.URL.Path, statsGalleryPath))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	days := statsLogDays
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			httpError(w, r, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	vm, err := getStatsGalleryViewModel(g, days)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not read the stats", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(r.Context(), "stats_gallery", vm, w)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	"net/http"
+)
+
+// graphqlSchema describes the content model served at /graphql. Nothing is
+// looked up or rendered unless a query asks for it, so the index can fetch
+// just titles and preview images without reading any images or blurbs.
+const graphqlSchema = `
+schema {
+	query: Query
+}
+
+type Query {
+	# The listed galleries in index order, optionally only those with a tag.
+	galleries(tag: String): [Gallery!]!
+
+	# A gallery by slug or directory name, listed or not.
+	gallery(name: String!): Gallery
+
+	tags: [Tag!]!
+	search(q: String!): [SearchResult!]!
+}
+
+type Gallery {
+	name: String!
+	title: String!
+	description: String!
+	url: String!
+	previewImage: String!
+	year: Int!
+	tags: [String!]!
+	blurbHtml: String!
+	images: [Image!]!
+}
+
+type Image {
+	url: String!
+	srcset: String!
+	width: Int!
+	height: Int!
+	captionHtml: String!
+}
+
+type Tag {
+	name: String!
+	url: String!
+	count: Int!
+	galleries: [Gallery!]!
+}
+
+type SearchResult {
+	name: String!
+	url: String!
+	previewImage: String!
+	snippet: String!
+}
+`
+
+// graphqlMaxDepth bounds how deeply a query may nest selections, and
+// graphqlMaxBody how large a request may be.
+const (
+	graphqlMaxDepth = 6
+	graphqlMaxBody  = 64 << 10
+)
+
+var graphqlHandler = &relay.Handler{
+	Schema: graphql.MustParseSchema(graphqlSchema, &graphqlQueryResolver{}, graphql.MaxDepth(graphqlMaxDepth)),
+}
+
+type graphqlQueryResolver struct{}
+
+func (*graphqlQueryResolver) Galleries(args struct{ Tag *string }) []*graphqlGalleryResolver {
+	result := make([]*graphqlGalleryResolver, 0)
+	for _, g := range listedGalleries() {
+		if args.Tag == nil || hasTag(g, *args.Tag) {
+			result = append(result, &graphqlGalleryResolver{g})
+		}
+	}
+
+	return result
+}
+
+func (*graphqlQueryResolver) Gallery(ctx context.Context, args struct{ Name string }) *graphqlGalleryResolver {
+	g, _, ok := findGallery(args.Name)
+	if !ok || (g.unpublished() && !graphqlAsAdmin(ctx)) {
+		return nil
+	}
+
+	return &graphqlGalleryResolver{g}
+}
+
+func (*graphqlQueryResolver) Tags() []*graphqlTagResolver {
+	result := make([]*graphqlTagResolver, 0)
+	for _, tag := range tags.counts() {
+		result = append(result, &graphqlTagResolver{tag})
+	}
+
+	return result
+}
+
+func (*graphqlQueryResolver) Search(args struct{ Q string }) []*graphqlSearchResultResolver {
+	result := make([]*graphqlSearchResultResolver, 0)
+	for _, r := range search.query(args.Q) {
+		result = append(result, &graphqlSearchResultResolver{r})
+	}
+
+	return result
+}
+
+func hasTag(g gallery, tag string) bool {
+	for _, t := range g.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+type graphqlGalleryResolver struct {
+	g gallery
+}
+
+func (r *graphqlGalleryResolver) Name() string         { return r.g.Slug }
+func (r *graphqlGalleryResolver) Title() string        { return r.g.Title }
+func (r *graphqlGalleryResolver) Description() string  { return r.g.Description }
+func (r *graphqlGalleryResolver) URL() string          { return r.g.URL() }
+func (r *graphqlGalleryResolver) PreviewImage() string { return r.g.previewImage() }
+func (r *graphqlGalleryResolver) Year() int32          { return int32(r.g.year()) }
+func (r *graphqlGalleryResolver) BlurbHTML() string    { return string(getGalleryBlurb(r.g.Dir)) }
+
+func (r *graphqlGalleryResolver) Tags() []string {
+	if r.g.Tags == nil {
+		return make([]string, 0)
+	}
+
+	return r.g.Tags
+}
+
+func (r *graphqlGalleryResolver) Images(ctx context.Context) []*graphqlImageResolver {
+	result := make([]*graphqlImageResolver, 0)
+	for _, image := range getImages(ctx, r.g) {
+		result = append(result, &graphqlImageResolver{image})
+	}
+
+	return result
+}
+
+type graphqlImageResolver struct {
+	image imageViewModel
+}
+
+func (r *graphqlImageResolver) URL() string         { return r.image.URL }
+func (r *graphqlImageResolver) Srcset() string      { return r.image.Srcset }
+func (r *graphqlImageResolver) Width() int32        { return int32(r.image.Width) }
+func (r *graphqlImageResolver) Height() int32       { return int32(r.image.Height) }
+func (r *graphqlImageResolver) CaptionHTML() string { return string(r.image.Caption) }
+
+type graphqlTagResolver struct {
+	tag tagLinkViewModel
+}
+
+func (r *graphqlTagResolver) Name() string { return r.tag.Name }
+func (r *graphqlTagResolver) URL() string  { return r.tag.URL }
+func (r *graphqlTagResolver) Count() int32 { return int32(r.tag.Count) }
+
+func (r *graphqlTagResolver) Galleries() []*graphqlGalleryResolver {
+	tag := r.tag.Name
+	return (&graphqlQueryResolver{}).Galleries(struct{ Tag *string }{&tag})
+}
+
+type graphqlSearchResultResolver struct {
+	result searchResultViewModel
+}
+
+func (r *graphqlSearchResultResolver) Name() string         { return r.result.Name }
+func (r *graphqlSearchResultResolver) URL() string          { return r.result.URL }
+func (r *graphqlSearchResultResolver) PreviewImage() string { return r.result.PreviewImage }
+func (r *graphqlSearchResultResolver) Snippet() string      { return r.result.Snippet }
+
+// graphqlEndpoint only accepts POSTed queries, which is what relay.Handler
+// reads.
+func graphqlEndpoint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		httpError(w, r, "POST a GraphQL query as JSON", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, graphqlMaxBody)
+	r = r.WithContext(context.WithValue(r.Context(), graphqlAdminKey, isAdmin(r)))
+	graphqlHandler.ServeHTTP(w, r)
+}
+
+const graphqlAdminKey contextKey = "graphqlAdmin"
+
+// graphqlAsAdmin reports whether the query came from the admin, who may see
+// drafts.
+func graphqlAsAdmin(ctx context.Context) bool {
+	admin, _ := ctx.Value(graphqlAdminKey).(bool)
+	return admin
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The probes for uptime monitors and orchestrators. healthzPath answers
+// while the process is up; readyzPath only while it can serve pages.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// readyTimeout bounds how long readyzPath waits on the stats database.
+const readyTimeout = 2 * time.Second
+
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// readyzHandler checks that the content root can be read, the stats
+// database written and the templates parsed, and answers 503 if any of them
+// can't. Why is logged rather than shown, to keep paths private.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	status := healthStatus{Status: "ok", Checks: make(map[string]string)}
+	for name, check := range map[string]func() error{
+		"content":   checkContentReadable,
+		"stats":     func() error { return checkStats(ctx) },
+		"templates": templates.check,
+	} {
+		err := check()
+		if err != nil {
+			logRequestError(r, "readyz:", name+":", err)
+			status.Status = "unavailable"
+			status.Checks[name] = "failed"
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+
+	code := http.StatusOK
+	if status.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, code, status)
+}
+
+func checkContentReadable() error {
+	_, err := os.ReadDir(contentPath("galleries"))
+	return err
+}
+
+// checkStats checks the stats database can be used as this server uses it.
+func checkStats(ctx context.Context) error {
+	if conf.ReadOnly {
+		return checkStatsReadable(ctx)
+	}
+
+	return checkStatsWritable(ctx)
+}
+
+// checkStatsWritable takes the stats database's write lock, which an
+// update does even when it changes nothing, and lets it go again.
+func checkStatsWritable(ctx context.Context) error {
+	tx, err := statsDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "UPDATE hits SET count = count WHERE 0")
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+)
+
+// iconMaxAge is how long browsers may keep an icon without asking again.
+// Icons change rarely, and a stale one for a while is harmless.
+const iconMaxAge = 30 * 24 * 60 * 60
+
+// iconFiles are the files served from the icons directory at the site root,
+// with their content types.
+var iconFiles = map[string]string{
+	"favicon.ico":          "image/x-icon",
+	"apple-touch-icon.png": "image/png",
+}
+
+// iconHandler serves /favicon.ico and /apple-touch-icon.png from the
+// configured icons directory.
+func iconHandler(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	contentType, ok := iconFiles[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	filename := filepath.Join(conf.IconsDir, name)
+	if !fileExists(filename) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", iconMaxAge))
+	http.ServeFile(w, r, filename)
+}
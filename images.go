@@ -0,0 +1,608 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/chai2010/webp"
+	"github.com/gen2brain/avif"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/image/draw"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resizeSlots bounds how many images are decoded and resized at once, since
+// each one holds a full-size bitmap in memory.
+var resizeSlots chan struct{}
+
+func initImagePipeline() {
+	workers := conf.Images.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	resizeSlots = make(chan struct{}, workers)
+}
+
+// Output formats for derived images.
+const (
+	formatJpeg = "jpeg"
+	formatWebp = "webp"
+	formatAvif = "avif"
+)
+
+// formatContentTypes lists the formats a client may ask for in its Accept
+// header, in order of preference. JPEG is always the fallback.
+var formatContentTypes = []struct {
+	format      string
+	contentType string
+}{
+	{formatAvif, "image/avif"},
+	{formatWebp, "image/webp"},
+}
+
+// resizeRequest identifies one derived image: a source JPEG under the
+// galleries directory scaled to a width and encoded in a format at a
+// quality.
+type resizeRequest struct {
+	// Src is the image path relative to the galleries directory, e.g.
+	// "Portraits/IMG_1234.jpg".
+	Src string
+
+	// Width is the target width in pixels, or zero to keep the original
+	// size.
+	Width   int
+	Quality int
+	Format  string
+}
+
+// parseResizeRequest reads src, w and q from the query string. src may be
+// given either as the public /galleries/ URL or relative to it.
+func parseResizeRequest(r *http.Request) (resizeRequest, error) {
+	q := r.URL.Query()
+
+	src := strings.TrimPrefix(q.Get("src"), "/galleries/")
+	src = path.Clean("/" + src)[1:]
+	if src == "" || !isJpeg(src) {
+		return resizeRequest{}, errors.New("src must be a gallery JPEG")
+	}
+
+	width, err := strconv.Atoi(q.Get("w"))
+	if err != nil || width < 1 || width > conf.Images.MaxWidth {
+		return resizeRequest{}, fmt.Errorf("w must be between 1 and %v", conf.Images.MaxWidth)
+	}
+
+	quality := conf.Images.DefaultQuality
+	if q.Get("q") != "" {
+		quality, err = strconv.Atoi(q.Get("q"))
+		if err != nil || quality < 1 || quality > 100 {
+			return resizeRequest{}, errors.New("q must be between 1 and 100")
+		}
+	}
+
+	return resizeRequest{
+		Src:     src,
+		Width:   width,
+		Quality: quality,
+		Format:  negotiateFormat(r),
+	}, nil
+}
+
+// negotiateFormat picks the best output format the client accepts.
+func negotiateFormat(r *http.Request) string {
+	for _, f := range formatContentTypes {
+		if f.format == formatAvif && !conf.Images.Avif.Enabled {
+			continue
+		}
+
+		if accepts(r, f.contentType) {
+			return f.format
+		}
+	}
+
+	return formatJpeg
+}
+
+// accepts reports whether the Accept header lists contentType without
+// refusing it with q=0.
+func accepts(r *http.Request, contentType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		fields := strings.Split(part, ";")
+		if strings.TrimSpace(fields[0]) != contentType {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func isJpeg(filename string) bool {
+	ext := strings.ToLower(path.Ext(filename))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+func (rr resizeRequest) sourcePath() string {
+	return contentPath("galleries", filepath.FromSlash(rr.Src))
+}
+
+// cachePath is where the derived image is kept. Non-JPEG formats get the
+// format appended as a second extension, e.g. IMG_1234.jpg.webp.
+func (rr resizeRequest) cachePath() string {
+	variant := fmt.Sprintf("w%v-q%v", rr.Width, rr.encoderQuality())
+	if rr.Format == formatAvif {
+		variant += fmt.Sprintf("-s%v", conf.Images.Avif.Speed)
+	}
+	if wc, ok := galleryWatermark(galleryOf(rr.Src)); ok {
+		variant += "-wm" + watermarkID(wc)
+	}
+
+	filename := filepath.Join(conf.Images.CacheDir, variant, filepath.FromSlash(rr.Src))
+	if rr.Format != formatJpeg {
+		filename += "." + rr.Format
+	}
+
+	return filename
+}
+
+// encoderQuality is the quality passed to the encoder. AVIF uses its own
+// configured quality when one is set, since its scale does not line up with
+// JPEG's.
+func (rr resizeRequest) encoderQuality() int {
+	if rr.Format == formatAvif && conf.Images.Avif.Quality > 0 {
+		return conf.Images.Avif.Quality
+	}
+
+	return rr.Quality
+}
+
+// imageResizeHandler serves /img-resize?src=...&w=...&q=..., generating the
+// derived image on first request and serving it from the cache afterwards.
+func imageResizeHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseHotlink(w, r) {
+		return
+	}
+
+	rr, err := parseResizeRequest(r)
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !serveFromGallery(w, r, rr.Src) {
+		return
+	}
+
+	filename, err := getDerivedImage(r.Context(), rr)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not resize image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Vary", "Accept")
+	http.ServeFile(w, r, filename)
+}
+
+// galleryImageHandler wraps the /galleries/ file server so that JPEGs are
+// served as AVIF or WebP (at their original size) to clients that accept
+// them. Anything else, or any failure to convert, falls through to the
+// original file, watermarked or with its EXIF stripped if the gallery asks
+// for that.
+func galleryImageHandler(fileServer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if refuseHotlink(w, r) {
+			return
+		}
+
+		if !serveFromGallery(w, r, path.Clean("/" + r.URL.Path)[1:]) {
+			return
+		}
+
+		if !isJpeg(r.URL.Path) {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+
+		src := path.Clean("/" + r.URL.Path)[1:]
+		if !originalServed(r, src) {
+			httpError(w, r, "Only resized copies of this gallery's pictures are served.", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Vary", "Accept")
+
+		format := negotiateFormat(r)
+		if format != formatJpeg {
+			rr := resizeRequest{
+				Src:     src,
+				Quality: conf.Images.DefaultQuality,
+				Format:  format,
+			}
+
+			filename, err := getDerivedImage(r.Context(), rr)
+			if err == nil {
+				http.ServeFile(w, r, filename)
+				return
+			}
+			if !os.IsNotExist(err) {
+				logRequestError(r, err)
+			}
+		}
+
+		if _, ok := galleryWatermark(galleryOf(src)); ok {
+			rr := resizeRequest{
+				Src:     src,
+				Quality: conf.Images.DefaultQuality,
+				Format:  formatJpeg,
+			}
+
+			filename, err := getDerivedImage(r.Context(), rr)
+			if err == nil {
+				http.ServeFile(w, r, filename)
+				return
+			}
+			if !os.IsNotExist(err) {
+				logRequestError(r, err)
+			}
+
+			// Never fall back to the original without its watermark.
+			http.NotFound(w, r)
+			return
+		}
+
+		if galleryStripsMetadata(galleryOf(src)) {
+			filename, err := getStrippedImage(src)
+			if err == nil {
+				http.ServeFile(w, r, filename)
+				return
+			}
+			if !os.IsNotExist(err) {
+				logRequestError(r, err)
+			}
+
+			// Never fall back to the original, which still carries the
+			// metadata we were asked to hide.
+			http.NotFound(w, r)
+			return
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// serveFromGallery reports whether the file at src, relative to the
+// galleries directory, may be served, answering 404 if it belongs to a
+// draft the request may not see. Drafts' files are kept out of shared
+// caches.
+func serveFromGallery(w http.ResponseWriter, r *http.Request, src string) bool {
+	g := loadGallery(galleryOf(src))
+	if g.hiddenFrom(r) {
+		http.NotFound(w, r)
+		return false
+	}
+
+	if signedURLRequired(r, g, src) {
+		httpError(w, r, "This gallery's pictures are only served through the links on its page.", http.StatusForbidden)
+		return false
+	}
+
+	if g.unpublished() {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+
+	return true
+}
+
+// refuseHotlink answers an image request from another site's page with the
+// placeholder, or a 403, and reports whether it did.
+func refuseHotlink(w http.ResponseWriter, r *http.Request) bool {
+	hc := conf.Images.Hotlink
+	if !hc.Enabled || signedRequest(r) || allowedReferer(r) {
+		return false
+	}
+
+	// Neither answer may be cached for the site's own pages.
+	w.Header().Set("Cache-Control", "no-store")
+	if hc.Placeholder != "" {
+		http.ServeFile(w, r, hc.Placeholder)
+	} else {
+		httpError(w, r, "Images may only be shown on "+conf.SiteURL, http.StatusForbidden)
+	}
+
+	return true
+}
+
+// allowedReferer reports whether the request comes from the site's own
+// pages, or those of an allowed host.
+func allowedReferer(r *http.Request) bool {
+	referer := r.Referer()
+	if referer == "" {
+		return conf.Images.Hotlink.AllowEmptyReferer
+	}
+
+	u, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+
+	allowed := []string{(&url.URL{Host: r.Host}).Hostname()}
+	if site, err := url.Parse(conf.SiteURL); err == nil {
+		allowed = append(allowed, site.Hostname())
+	}
+	allowed = append(allowed, conf.Images.Hotlink.AllowedReferers...)
+
+	host := strings.ToLower(u.Hostname())
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if host == a || (strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// originalServed reports whether the JPEG at src, relative to the galleries
+// directory, may be served at full size from /galleries/.
+func originalServed(r *http.Request, src string) bool {
+	g := loadGallery(galleryOf(src))
+	return g.servesOriginals() || path.Base(src) == "preview.jpg" || isAdmin(r)
+}
+
+// getSrcset lists a resized variant of imageURL for each configured srcset
+// width, in the format expected by the img srcset attribute. The variants
+// are generated lazily by imageResizeHandler when a browser first asks for
+// them.
+func getSrcset(imageURL string) string {
+	candidates := make([]string, 0, len(conf.Images.SrcsetWidths))
+	for _, width := range conf.Images.SrcsetWidths {
+		candidate := fmt.Sprintf("/img-resize?src=%v&w=%v %vw", url.QueryEscape(imageURL), width, width)
+		candidates = append(candidates, candidate)
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// srcset is getSrcset for the gallery, with every candidate signed if the
+// gallery asks for that.
+func (g gallery) srcset(imageURL string) string {
+	if !g.SignedURLs {
+		return getSrcset(imageURL)
+	}
+
+	candidates := make([]string, 0, len(conf.Images.SrcsetWidths))
+	for _, width := range conf.Images.SrcsetWidths {
+		target := fmt.Sprintf("/img-resize?src=%v&w=%v", url.QueryEscape(imageURL), width)
+		candidates = append(candidates, fmt.Sprintf("%v %vw", signImageURL(target), width))
+	}
+
+	return strings.Join(candidates, ", ")
+}
+
+// imageMetadata is what is read from an image's header, cached while the
+// file keeps the same modification time and size.
+type imageMetadata struct {
+	modTime time.Time
+	size    int64
+	width   int
+	height  int
+	exif    *exifViewModel
+}
+
+var metadataCache = make(map[string]imageMetadata)
+var metadataCacheLock = &sync.Mutex{}
+
+// getImageMetadata returns the pixel size and EXIF data of the JPEG at
+// filename, reading only its header and remembering the answer until the
+// file changes.
+func getImageMetadata(filename string, info os.FileInfo) (imageMetadata, error) {
+	metadataCacheLock.Lock()
+	cached, ok := metadataCache[filename]
+	metadataCacheLock.Unlock()
+
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return imageMetadata{}, err
+	}
+	defer f.Close()
+
+	c, err := jpeg.DecodeConfig(f)
+	if err != nil {
+		return imageMetadata{}, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	result := imageMetadata{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		width:   c.Width,
+		height:  c.Height,
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		result.exif = readExif(f)
+	}
+
+	metadataCacheLock.Lock()
+	metadataCache[filename] = result
+	metadataCacheLock.Unlock()
+
+	return result, nil
+}
+
+// getDerivedImage returns the path of the cached derived image, generating
+// it if it is missing or older than its source.
+func getDerivedImage(ctx context.Context, rr resizeRequest) (string, error) {
+	ctx, span := startSpan(ctx, "derive image",
+		attribute.String("image.src", rr.Src),
+		attribute.Int("image.width", rr.Width),
+		attribute.String("image.format", rr.Format))
+	defer span.End()
+
+	srcInfo, err := os.Stat(rr.sourcePath())
+	if err != nil {
+		spanError(span, err)
+		return "", err
+	}
+
+	dst := rr.cachePath()
+	if isFresh(dst, srcInfo) {
+		countImageCache(true)
+		span.SetAttributes(attribute.Bool("image.cached", true))
+		return dst, nil
+	}
+
+	resizeSlots <- struct{}{}
+	defer func() { <-resizeSlots }()
+
+	// Another request may have generated it while we waited for a slot.
+	if isFresh(dst, srcInfo) {
+		countImageCache(true)
+		span.SetAttributes(attribute.Bool("image.cached", true))
+		return dst, nil
+	}
+
+	countImageCache(false)
+	span.SetAttributes(attribute.Bool("image.cached", false))
+	_, resize := startSpan(ctx, "resize image")
+	err = deriveImage(rr.sourcePath(), dst, rr)
+	endSpan(resize, err)
+	if err != nil {
+		spanError(span, err)
+		return "", err
+	}
+
+	return dst, nil
+}
+
+func isFresh(filename string, srcInfo os.FileInfo) bool {
+	info, err := os.Stat(filename)
+	return err == nil && !info.ModTime().Before(srcInfo.ModTime())
+}
+
+// deriveImage scales src down to the requested width, keeping its aspect
+// ratio, and writes it to dst in the requested format. Images narrower than
+// the width are re-encoded at their own size.
+func deriveImage(src, dst string, rr resizeRequest) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", src, err)
+	}
+
+	img = scaleToWidth(img, rr.Width)
+	if wc, ok := galleryWatermark(galleryOf(rr.Src)); ok {
+		img, err = applyWatermark(img, wc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeImage(dst, img, rr.Format, rr.encoderQuality())
+}
+
+func scaleToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if width == 0 || width >= bounds.Dx() {
+		return img
+	}
+
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+
+	return scaled
+}
+
+// writeImage encodes img to dst without a concurrent reader ever seeing a
+// half-written image.
+func writeImage(dst string, img image.Image, format string, quality int) error {
+	return writeFileAtomic(dst, func(w io.Writer) error {
+		return encodeImage(w, img, format, quality)
+	})
+}
+
+// writeFileAtomic writes to a temporary file beside dst and renames it into
+// place once write has succeeded.
+func writeFileAtomic(dst string, write func(io.Writer) error) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	switch format {
+	case formatJpeg:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case formatWebp:
+		return webp.Encode(w, img, &webp.Options{Quality: float32(quality)})
+	case formatAvif:
+		return avif.Encode(w, img, avif.Options{Quality: quality, Speed: conf.Images.Avif.Speed})
+	}
+
+	return fmt.Errorf("unknown image format %v", format)
+}
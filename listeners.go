@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// What one of listeners serves.
+const (
+	serveSite     = "site"
+	serveRedirect = "redirect"
+	serveInternal = "internal"
+)
+
+// namedServer is a server and the name of its listener, which it goes by
+// over restarts and in socket activation.
+type namedServer struct {
+	name   string
+	server *http.Server
+
+	// tls serves https rather than plain http.
+	tls bool
+}
+
+// newServers returns the servers the config asks for: the site on
+// portHttps and its redirects on portHttp, or the site alone on
+// unixSocket, and then each of listeners. A virtual host's process only
+// serves its site, on the socket it was handed.
+func newServers(site, redirect http.Handler, m *autocert.Manager) []namedServer {
+	if virtualHostProcess {
+		return []namedServer{{"site", &http.Server{Handler: site}, false}}
+	}
+
+	var servers []namedServer
+	if conf.UnixSocket.Path != "" {
+		servers = append(servers, namedServer{"unix", &http.Server{Handler: site}, false})
+	} else {
+		servers = append(servers,
+			namedServer{"http", &http.Server{Addr: ":" + strconv.Itoa(conf.PortHttp), Handler: redirect}, false},
+			namedServer{"https", newHttpsServer(":"+strconv.Itoa(conf.PortHttps), site, m), true})
+	}
+
+	for _, c := range conf.Listeners {
+		handler := site
+		switch c.Serve {
+		case serveRedirect:
+			handler = redirect
+		case serveInternal:
+			handler = internalHandler()
+		}
+
+		s := &http.Server{Addr: c.Address, Handler: handler}
+		if c.TLS {
+			s = newHttpsServer(c.Address, handler, m)
+		}
+		servers = append(servers, namedServer{c.Name, s, c.TLS})
+	}
+
+	return servers
+}
+
+func (s namedServer) listen() (net.Listener, error) {
+	if s.name == "unix" {
+		return listenUnixSocket()
+	}
+
+	return listen(s.name, "tcp", s.server.Addr)
+}
+
+func (s namedServer) serve(l net.Listener) error {
+	if s.tls {
+		return serveHttps(s.server, l)
+	}
+
+	return s.server.Serve(l)
+}
+
+// internalAddress reports whether addr is on a loopback or private network,
+// where only the monitoring should reach an internal listener.
+func internalAddress(addr string) bool {
+	if loopbackAddress(addr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsPrivate()
+}
+
+// internalHandler serves the health checks, and the metrics and profiles if
+// they are enabled, with no sign-in, for a listener only monitoring can
+// reach.
+func internalHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, healthzHandler)
+	mux.HandleFunc(readyzPath, readyzHandler)
+	if conf.Metrics.Enabled {
+		mux.Handle(metricsPath, promhttp.Handler())
+	}
+	if conf.Pprof.Enabled {
+		mux.Handle(pprofPath, pprofMux())
+	}
+
+	return withRequestID(logAndDelegate(mux))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverLogFile is the server's log under log.dir.
+const serverLogFile = "server.log"
+
+// rotatedLogTimeFormat stamps the files a log is rotated into with when.
+const rotatedLogTimeFormat = "20060102T150405.000"
+
+// rotatingFile is a log file that is moved aside and started afresh once it
+// reaches log.maxSizeMB or is log.maxAgeHours old. Rotated files are then
+// gzipped, if log.compress is set, and deleted after log.keepDays.
+type rotatingFile struct {
+	lock   sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path}
+	return f, f.open()
+}
+
+// open opens the file to append to. A file carried on from before counts
+// as opened when it was last written.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	if info.Size() > 0 {
+		f.opened = info.ModTime()
+	}
+
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	maxSize := int64(conf.Log.MaxSizeMB) << 20
+	maxAge := time.Duration(conf.Log.MaxAgeHours) * time.Hour
+	if f.size > 0 && (f.size+int64(len(p)) > maxSize || time.Since(f.opened) > maxAge) {
+		// Not to the log, which is what is being written.
+		err := f.rotate()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if f.file == nil {
+		return 0, fmt.Errorf("%v is not open", f.path)
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside, next to it with the time in its name, and
+// starts a new one.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format(rotatedLogTimeFormat) + ext
+	renameErr := os.Rename(f.path, rotated)
+	err = f.open()
+	if renameErr != nil {
+		return renameErr
+	}
+	if err != nil {
+		return err
+	}
+
+	go tidyRotatedLogs(f.path, rotated)
+	return nil
+}
+
+// tidyRotatedLogs gzips rotated, a file just rotated out of path, and
+// deletes the files rotated out of path more than log.keepDays ago.
+func tidyRotatedLogs(path, rotated string) {
+	if conf.Log.Compress {
+		err := gzipFile(rotated)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if conf.Log.KeepDays == 0 {
+		return
+	}
+	ext := filepath.Ext(path)
+	old, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext + "*")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -conf.Log.KeepDays)
+	for _, name := range old {
+		info, err := os.Stat(name)
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		err = os.Remove(name)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// gzipFile replaces name with name.gz.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The formats the log can be written in.
+const (
+	logText = "text"
+	logJSON = "json"
+)
+
+// accessLogFile is the access log, when it is rotated along with the
+// server's log under log.dir.
+var accessLogFile *rotatingFile
+
+// accessSystemLog is where the access log goes in the system log, if
+// log.systemAccessLog is set.
+var accessSystemLog systemLog
+
+// initLogging writes the log in log.format, to standard error, to a
+// rotated file under log.dir or to the system log. Lines from the log
+// package go the same way, as messages at the info level. Lines logged
+// with a request's context carry its ID.
+func initLogging() error {
+	if conf.Log.System != "" {
+		system, err := openSystemLog(systemLogTag)
+		if err != nil {
+			return err
+		}
+		if conf.Log.SystemAccessLog {
+			accessSystemLog, err = openSystemLog(systemAccessLogTag)
+			if err != nil {
+				return err
+			}
+		}
+
+		slog.SetDefault(slog.New(requestIDHandler{newSystemLogHandler(system)}))
+		return nil
+	}
+
+	var out io.Writer = os.Stderr
+	if conf.Log.Dir != "" {
+		err := os.MkdirAll(conf.Log.Dir, 0750)
+		if err != nil {
+			return err
+		}
+		file, err := openRotatingFile(filepath.Join(conf.Log.Dir, serverLogFile))
+		if err != nil {
+			return err
+		}
+		out = file
+
+		if conf.Log.AccessLog != "" {
+			accessLogFile, err = openRotatingFile(conf.Log.AccessLog)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var handler slog.Handler
+	if conf.Log.Format == logJSON {
+		handler = slog.NewJSONHandler(out, nil)
+	} else {
+		handler = slog.NewTextHandler(out, nil)
+	}
+
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// statusRecorder remembers the status code a handler answered with and how
+// much of a body it wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection's own writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logAndDelegate logs each request once it has been answered, as an error
+// if the server failed it, and adds it to the access log if there is one.
+// The referer and user agent are left out for visitors who asked not to be
+// tracked.
+func logAndDelegate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		handler.ServeHTTP(rec, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("ip", loggedIP(r)),
+		}
+		if !doNotTrack(r) {
+			attrs = append(attrs, slog.String("referer", r.Referer()), slog.String("userAgent", r.UserAgent()))
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+		appendAccessLog(r, rec.status, rec.bytes, start)
+	})
+}
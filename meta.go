@@ -0,0 +1,61 @@
+package main
+
+import "strings"
+
+// siteDescription describes pages that have nothing more specific to say.
+const siteDescription = "The online gallery of artist Chez Watts"
+
+// pageMetadata describes a page to search engines and to sites that show a
+// preview when it is shared. Every view model rendered through page.html
+// carries one as Meta.
+type pageMetadata struct {
+	Title       string
+	Description string
+
+	// Canonical is the absolute URL the page is indexed under, whichever
+	// form of it was asked for. Image is absolute too, and empty when there
+	// is nothing to show.
+	Canonical string
+	Image     string
+
+	// Type is the og:type, "website" unless the page says otherwise.
+	Type string
+
+	// TwitterCard is summary_large_image when there is an image to show
+	// and summary otherwise. TwitterSite is the configured site handle.
+	TwitterCard string
+	TwitterSite string
+}
+
+// newPageMetadata fills in defaults for a page whose canonical site path is
+// canonical, and makes it and image absolute. canonical may be absolute
+// already, for a gallery at its subdomain.
+func newPageMetadata(title, description, image, canonical string) pageMetadata {
+	if title == "" {
+		title = feedTitle
+	}
+
+	if description == "" {
+		description = siteDescription
+	}
+
+	if !strings.Contains(canonical, "://") {
+		canonical = absoluteURL(canonical)
+	}
+
+	card := "summary"
+	if image != "" {
+		image = absoluteURL(image)
+		card = "summary_large_image"
+	}
+
+	return pageMetadata{
+		Title:       title,
+		Description: description,
+		Canonical:   canonical,
+		Image:       image,
+		Type:        "website",
+		TwitterCard: card,
+		TwitterSite: conf.TwitterSite,
+	}
+}
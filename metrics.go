@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// metricsPath serves the metrics in Prometheus' text format, along with the
+// Go runtime's and the process's own.
+const metricsPath = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chezwatts_http_requests_total",
+		Help: "HTTPS requests answered, by route and status code.",
+	}, []string{"route", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chezwatts_http_request_duration_seconds",
+		Help:    "How long HTTPS requests took to answer, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	pageViews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chezwatts_page_views_total",
+		Help: "Page views, as counted for the stats, by page and whether a crawler made them.",
+	}, []string{"page", "crawler"})
+
+	imageCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chezwatts_image_cache_requests_total",
+		Help: "Resized images asked for, by whether they were in the cache (hit) or had to be made (miss).",
+	}, []string{"result"})
+)
+
+// measureRequests counts the requests mux answers and times them, by the
+// pattern they were routed by, so that galleries and images don't each
+// get series of their own.
+func measureRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !conf.Metrics.Enabled {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// metricsHandler serves the metrics, to the admin or a script with an API
+// token unless metrics.public is set.
+func metricsHandler() http.HandlerFunc {
+	handler := promhttp.Handler().ServeHTTP
+	if conf.Metrics.Public {
+		return handler
+	}
+
+	return requireAdmin(handler)
+}
+
+func countPageView(page string, crawler bool) {
+	pageViews.WithLabelValues(page, strconv.FormatBool(crawler)).Inc()
+}
+
+func countImageCache(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	imageCacheRequests.WithLabelValues(result).Inc()
+}
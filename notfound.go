@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"path"
+)
+
+// notFoundSuggestions is how many galleries the not-found page suggests.
+const notFoundSuggestions = 5
+
+type notFoundViewModel struct {
+	Meta        pageMetadata
+	Path        string
+	Suggestions []searchResultViewModel
+}
+
+// notFoundHandler answers 404 with a page that suggests where to go
+// instead: whatever the search finds for the last part of the path, such
+// as a mistyped gallery's name, or else the first galleries on the index.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	suggestions := search.query(path.Base(r.URL.Path))
+	if len(suggestions) == 0 {
+		for _, g := range getGalleries() {
+			suggestions = append(suggestions, searchResultViewModel{Name: g.Name, URL: g.URL, PreviewImage: g.PreviewImage})
+		}
+	}
+	if len(suggestions) > notFoundSuggestions {
+		suggestions = suggestions[:notFoundSuggestions]
+	}
+
+	vm := notFoundViewModel{
+		Meta:        newPageMetadata("Not found", "", "", r.URL.Path),
+		Path:        r.URL.Path,
+		Suggestions: suggestions,
+	}
+
+	renderTemplateStatus(r.Context(), "not_found", vm, w, http.StatusNotFound)
+}
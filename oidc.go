@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcLoginPath    = "/admin/login/oidc"
+	oidcCallbackPath = "/admin/login/oidc/callback"
+
+	// oidcCookie carries the state of a sign-in that is away at the
+	// provider, which must come back within oidcLoginTimeout.
+	oidcCookie       = "oidc"
+	oidcLoginTimeout = 10 * time.Minute
+)
+
+// oidcClient is the provider's discovered configuration. It is fetched on
+// the first sign-in rather than at startup, so that the site still starts
+// when the provider is unreachable.
+type oidcClient struct {
+	lock     sync.Mutex
+	provider *oidc.Provider
+}
+
+var oidcClients = &oidcClient{}
+
+func (c *oidcClient) get(ctx context.Context) (*oidc.Provider, oauth2.Config, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	oc := conf.Admin.OIDC
+	if c.provider == nil {
+		provider, err := oidc.NewProvider(ctx, oc.Issuer)
+		if err != nil {
+			return nil, oauth2.Config{}, err
+		}
+		c.provider = provider
+	}
+
+	return c.provider, oauth2.Config{
+		ClientID:     oc.ClientID,
+		ClientSecret: oc.ClientSecret,
+		RedirectURL:  absoluteURL(oidcCallbackPath),
+		Endpoint:     c.provider.Endpoint(),
+		Scopes:       oc.Scopes,
+	}, nil
+}
+
+func oidcEnabled() bool {
+	return conf.Admin.OIDC.Issuer != ""
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// oidcLoginHandler sends the browser to the provider to sign in. The state,
+// nonce and PKCE verifier go in a signed cookie for the callback to check.
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	_, oc, err := oidcClients.get(r.Context())
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "the sign-in provider is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state, err := randomString()
+	var nonce string
+	if err == nil {
+		nonce, err = randomString()
+	}
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+	value := url.Values{
+		"state":    {state},
+		"nonce":    {nonce},
+		"verifier": {verifier},
+		"next":     {localRedirect(r.FormValue("next"))},
+	}.Encode()
+	value = base64.RawURLEncoding.EncodeToString([]byte(value))
+
+	// Lax, not Strict, since the provider sends the browser back here from
+	// another site.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value + "." + sessions.sign(value),
+		Path:     oidcCallbackPath,
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, oc.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), http.StatusFound)
+}
+
+// oidcLoginState reads back the cookie set by oidcLoginHandler.
+func oidcLoginState(r *http.Request) (url.Values, bool) {
+	c, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return nil, false
+	}
+
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(sessions.sign(parts[0]))) {
+		return nil, false
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+
+	state, err := url.ParseQuery(string(raw))
+	return state, err == nil
+}
+
+// oidcClaims are the ID token claims used to decide who may sign in.
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Groups        []string
+}
+
+// oidcCallbackHandler is where the provider sends the browser back. It
+// checks the ID token and, if its claims are allowed in, starts a session.
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	state, ok := oidcLoginState(r)
+	http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: oidcCallbackPath, MaxAge: -1, HttpOnly: true, Secure: true})
+	if !ok || r.FormValue("state") == "" || r.FormValue("state") != state.Get("state") {
+		oidcLoginError(w, r, http.StatusBadRequest, "The sign-in expired or was not started here. Try again.")
+		return
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		oidcLoginError(w, r, http.StatusUnauthorized, "The provider refused the sign-in: "+e)
+		return
+	}
+
+	claims, err := oidcExchange(r.Context(), r.FormValue("code"), state)
+	if err != nil {
+		logRequestError(r, err)
+		oidcLoginError(w, r, http.StatusUnauthorized, "Could not verify the sign-in.")
+		return
+	}
+
+	if !oidcAuthorized(claims) {
+		slog.WarnContext(r.Context(), fmt.Sprintf("OIDC sign-in refused for %q (%v)", claims.Email, claims.Subject))
+		oidcLoginError(w, r, http.StatusForbidden, "That account is not allowed to sign in here.")
+		return
+	}
+
+	actor := claims.Email
+	if actor == "" {
+		actor = claims.Subject
+	}
+
+	err = sessions.create(w, actor)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not sign in", http.StatusInternalServerError)
+		return
+	}
+
+	appendAudit(actor, "signed in", "", "OpenID Connect")
+
+	// The session cookie is SameSite=Strict, so it would not be sent on a
+	// redirect that began at the provider. Navigating from a page of our own
+	// makes the next request same-site.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = oidcContinueTemplate.Execute(w, state.Get("next"))
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+var oidcContinueTemplate = template.Must(template.New("continue").Parse(
+	`<!DOCTYPE html><meta http-equiv="refresh" content="0;url={{.}}"><a href="{{.}}">Continue</a>`))
+
+// oidcExchange swaps the authorization code for tokens and returns the
+// verified ID token's claims.
+func oidcExchange(ctx context.Context, code string, state url.Values) (oidcClaims, error) {
+	var claims oidcClaims
+
+	provider, oc, err := oidcClients.get(ctx)
+	if err != nil {
+		return claims, err
+	}
+
+	token, err := oc.Exchange(ctx, code, oauth2.VerifierOption(state.Get("verifier")))
+	if err != nil {
+		return claims, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, errors.New("no id_token in the token response")
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oc.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return claims, err
+	}
+
+	if idToken.Nonce != state.Get("nonce") {
+		return claims, errors.New("id_token nonce does not match")
+	}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return claims, err
+	}
+
+	var all map[string]interface{}
+	err = idToken.Claims(&all)
+	if err != nil {
+		return claims, err
+	}
+	claims.Groups = claimStrings(all[conf.Admin.OIDC.GroupsClaim])
+
+	return claims, nil
+}
+
+// claimStrings reads a claim that may be a single string or a list of them.
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// oidcAuthorized reports whether an account may sign in: one of the allowed
+// emails, if the provider says it has verified it, or a member of an
+// allowed group. A provider that doesn't say either way only counts with
+// unverifiedEmails.
+func oidcAuthorized(claims oidcClaims) bool {
+	oc := conf.Admin.OIDC
+
+	verified := claims.EmailVerified != nil && *claims.EmailVerified
+	if claims.EmailVerified == nil && oc.UnverifiedEmails {
+		verified = true
+	}
+	if claims.Email != "" && verified {
+		for _, email := range oc.AllowedEmails {
+			if strings.EqualFold(email, claims.Email) {
+				return true
+			}
+		}
+	}
+
+	for _, group := range claims.Groups {
+		for _, allowed := range oc.AllowedGroups {
+			if group == allowed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func oidcLoginError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	vm := newAdminLoginViewModel("")
+	vm.Error = message
+	vm.RequestID = requestID(r.Context())
+
+	w.WriteHeader(status)
+	renderTemplate(r.Context(), "admin_login", vm, w)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// pageCacheMaxEntries bounds how many pages are kept, since every ?group=
+// makes another.
+const pageCacheMaxEntries = 1000
+
+// cachedPage is a page as it was rendered.
+type cachedPage struct {
+	body    []byte
+	expires time.Time
+}
+
+// pageCache holds rendered index and gallery pages, so that they aren't
+// rendered again for every visitor. It is emptied with the indexes whenever
+// the content changes, and pages expire after pageCache.ttlSeconds in any
+// case, for the timings and anything else that changes by itself.
+type pageCache struct {
+	lock  sync.Mutex
+	pages map[string]cachedPage
+}
+
+var renderedPages = &pageCache{}
+
+// rebuild forgets every page.
+func (c *pageCache) rebuild() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pages = nil
+}
+
+// enabled reports whether r's page may come from the cache or go into it.
+// The admin is always shown the page as it is now, and may see more on it.
+func (c *pageCache) enabled(r *http.Request) bool {
+	return conf.PageCache.Enabled && !conf.DevMode && !isAdmin(r)
+}
+
+// key is what r's page is kept under: its path and the query parameters
+// that change it.
+func (c *pageCache) key(r *http.Request) string {
+	q := r.URL.Query()
+	return r.URL.Path + "?page=" + q.Get("page") + "&group=" + q.Get("group")
+}
+
+// serve answers r with its page from the cache, if it is there, and
+// reports whether it did.
+func (c *pageCache) serve(w http.ResponseWriter, r *http.Request) bool {
+	if !c.enabled(r) {
+		return false
+	}
+
+	c.lock.Lock()
+	page, ok := c.pages[c.key(r)]
+	c.lock.Unlock()
+	if !ok || time.Now().After(page.expires) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page.body)
+
+	return true
+}
+
+// render renders the template like renderTemplate, keeping the page for
+// serve if it rendered.
+func (c *pageCache) render(w http.ResponseWriter, r *http.Request, tmpl string, model interface{}) {
+	if !c.enabled(r) {
+		renderTemplate(r.Context(), tmpl, model, w)
+		return
+	}
+
+	rec := &pageRecorder{ResponseWriter: w}
+	renderTemplate(r.Context(), tmpl, model, rec)
+	if rec.status != 0 && rec.status != http.StatusOK {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pages == nil || len(c.pages) >= pageCacheMaxEntries {
+		c.pages = make(map[string]cachedPage)
+	}
+	c.pages[c.key(r)] = cachedPage{
+		body:    rec.body.Bytes(),
+		expires: time.Now().Add(time.Duration(conf.PageCache.TTLSeconds) * time.Second),
+	}
+}
+
+// pageRecorder sends a page on, keeping a copy.
+type pageRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (p *pageRecorder) WriteHeader(status int) {
+	if p.status == 0 {
+		p.status = status
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *pageRecorder) Write(b []byte) (int, error) {
+	p.body.Write(b)
+	return p.ResponseWriter.Write(b)
+}
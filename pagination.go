@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// paginationViewModel describes where a page sits in a paged listing. The
+// URLs are empty when there is no previous or next page, and are also meant
+// for rel=prev/next links in the page head.
+type paginationViewModel struct {
+	Page      int
+	PageCount int
+	PrevURL   string
+	NextURL   string
+}
+
+var errPageOutOfRange = errors.New("page out of range")
+
+// paginate works out which items [start, end) of total to show for the page
+// requested in query, pageSize at a time. A pageSize of zero or less shows
+// everything on one page. baseURL is the listing's URL without a page
+// parameter; other query parameters are kept in the prev/next links.
+func paginate(query url.Values, total, pageSize int, baseURL string) (start, end int, p paginationViewModel, err error) {
+	page := 1
+	if query.Get("page") != "" {
+		page, err = strconv.Atoi(query.Get("page"))
+		if err != nil {
+			return 0, 0, p, errPageOutOfRange
+		}
+	}
+
+	if pageSize <= 0 {
+		pageSize = total
+	}
+
+	pageCount := 1
+	if pageSize > 0 && total > pageSize {
+		pageCount = (total + pageSize - 1) / pageSize
+	}
+
+	if page < 1 || page > pageCount {
+		return 0, 0, p, errPageOutOfRange
+	}
+
+	start = (page - 1) * pageSize
+	end = start + pageSize
+	if end > total {
+		end = total
+	}
+
+	p = paginationViewModel{
+		Page:      page,
+		PageCount: pageCount,
+	}
+
+	if page > 1 {
+		p.PrevURL = pageURL(baseURL, query, page-1)
+	}
+	if page < pageCount {
+		p.NextURL = pageURL(baseURL, query, page+1)
+	}
+
+	return start, end, p, nil
+}
+
+func pageURL(baseURL string, query url.Values, page int) string {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+
+	if page == 1 {
+		q.Del("page")
+	} else {
+		q.Set("page", strconv.Itoa(page))
+	}
+
+	if len(q) == 0 {
+		return baseURL
+	}
+
+	return baseURL + "?" + q.Encode()
+}
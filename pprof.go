@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// pprofPath serves the Go runtime's profiles: CPU, heap, goroutines and so
+// on, for go tool pprof.
+const pprofPath = "/debug/pprof/"
+
+// pprofMux routes the profiles under pprofPath, as net/http/pprof would on
+// the default mux.
+func pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofPath, pprof.Index)
+	mux.HandleFunc(pprofPath+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofPath+"profile", pprof.Profile)
+	mux.HandleFunc(pprofPath+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofPath+"trace", pprof.Trace)
+
+	return mux
+}
+
+// pprofHandler serves the profiles on the site, to the admin or a script
+// with an API token.
+func pprofHandler() http.HandlerFunc {
+	return requireAdmin(pprofMux().ServeHTTP)
+}
+
+// startPprofServer serves the profiles, with no sign-in, on pprof.listen if
+// it is set. It returns a function that stops the server, for shutdown.
+func startPprofServer() func() {
+	if !conf.Pprof.Enabled || conf.Pprof.Listen == "" || virtualHostProcess {
+		return func() {}
+	}
+
+	l, err := listen("pprof", "tcp", conf.Pprof.Listen)
+	if err != nil {
+		log.Println(err)
+		return func() {}
+	}
+
+	s := &http.Server{Handler: pprofMux()}
+	go func() {
+		err := s.Serve(l)
+		if err != nil && err != http.ErrServerClosed {
+			log.Println(err)
+		}
+	}()
+
+	return func() {
+		err := s.Close()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// loopbackAddress reports whether addr, a host and port, can only be
+// reached from this machine.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Marker files that override images.stripMetadata for a single gallery.
+const (
+	stripMetadataFile = "strip-metadata"
+	keepMetadataFile  = "keep-metadata"
+)
+
+// Marker files that override images.noRightClick for a single gallery.
+const (
+	noRightClickFile    = "no-right-click"
+	allowRightClickFile = "allow-right-click"
+)
+
+// blocksRightClick reports whether the gallery page discourages saving its
+// pictures, by turning off their context menu and dragging. It is no real
+// protection, since the pictures are still sent to the browser.
+func (g gallery) blocksRightClick() bool {
+	if g.NoRightClick != nil {
+		return *g.NoRightClick
+	}
+
+	if fileExists(contentPath("galleries", g.Dir, noRightClickFile)) {
+		return true
+	}
+
+	if fileExists(contentPath("galleries", g.Dir, allowRightClickFile)) {
+		return false
+	}
+
+	return conf.Images.NoRightClick
+}
+
+// galleryStripsMetadata reports whether originals in gallery are served with
+// their EXIF (including GPS) removed. Derived images are always re-encoded
+// without metadata, so this only matters for the original JPEGs.
+func galleryStripsMetadata(gallery string) bool {
+	g := loadGallery(gallery)
+	if g.StripMetadata != nil {
+		return *g.StripMetadata
+	}
+
+	if fileExists(contentPath("galleries", gallery, stripMetadataFile)) {
+		return true
+	}
+
+	if fileExists(contentPath("galleries", gallery, keepMetadataFile)) {
+		return false
+	}
+
+	return conf.Images.StripMetadata
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// galleryOf returns the gallery an image path, relative to the galleries
+// directory, belongs to.
+func galleryOf(src string) string {
+	return strings.SplitN(src, "/", 2)[0]
+}
+
+// getStrippedImage returns the path of a cached copy of the original JPEG at
+// src with its metadata segments removed, creating it if it is missing or
+// older than the original.
+func getStrippedImage(src string) (string, error) {
+	original := contentPath("galleries", filepath.FromSlash(src))
+	srcInfo, err := os.Stat(original)
+	if err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(conf.Images.CacheDir, "stripped", filepath.FromSlash(src))
+	if isFresh(dst, srcInfo) {
+		return dst, nil
+	}
+
+	data, err := ioutil.ReadFile(original)
+	if err != nil {
+		return "", err
+	}
+
+	stripped, err := stripJpegMetadata(data)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := w.Write(stripped)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
+// stripJpegMetadata drops the APP1 (EXIF, XMP) and APP13 (IPTC) segments
+// from a JPEG without re-encoding it. Everything else, including the APP2
+// colour profile, is kept.
+func stripJpegMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG")
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:2])
+
+	pos := 2
+	for pos+1 < len(data) {
+		if data[pos] != 0xFF {
+			return nil, errors.New("corrupt JPEG: expected marker")
+		}
+
+		marker := data[pos+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker.
+			pos++
+			continue
+		case marker == 0xDA:
+			// Start of scan: the rest is entropy-coded image data.
+			out.Write(data[pos:])
+			return out.Bytes(), nil
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD9:
+			// Markers without a length.
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, errors.New("corrupt JPEG: truncated segment")
+		}
+
+		end := pos + 2 + int(data[pos+2])<<8 + int(data[pos+3])
+		if end > len(data) {
+			return nil, errors.New("corrupt JPEG: truncated segment")
+		}
+
+		if marker != 0xE1 && marker != 0xED {
+			out.Write(data[pos:end])
+		}
+
+		pos = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// remoteIP returns the address the request came from, without its port.
+// Behind one of trustedProxies, or the proxy on the unix socket, it is the
+// address the proxies say they forwarded the request for.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if trustedProxy(host) || viaUnixSocket(r) {
+		return forwardedIP(r, host)
+	}
+	return host
+}
+
+// loggedIP returns the address the request came from as it may be logged or
+// counted. In privacy mode the last octet of an IPv4 address is zeroed, and
+// all but the first 48 bits of an IPv6 one, which no longer tells one
+// household from its neighbours.
+func loggedIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !conf.PrivacyMode {
+		return ip
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// doNotTrack reports whether, in privacy mode, the visitor has asked not to
+// be tracked, with Do Not Track or Global Privacy Control. Their views are
+// still counted, but not as a visitor, nor where they came from or what
+// they are on.
+func doNotTrack(r *http.Request) bool {
+	return conf.PrivacyMode && (r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1")
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxy reports whether ip is one of trustedProxies, whose word on
+// where a request came from is taken.
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range conf.TrustedProxies {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err == nil && ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedIP returns the client a request from a trusted proxy, peer, was
+// forwarded for. Going back along X-Forwarded-For from the nearest hop, it
+// is the first address that isn't another trusted proxy, since anything
+// before that could have been made up by the client. Without the header it
+// is X-Real-IP, and without either it is peer itself.
+func forwardedIP(r *http.Request, peer string) string {
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	if len(hops) == 0 {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+			return realIP
+		}
+		return peer
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+		if !trustedProxy(client) {
+			break
+		}
+	}
+
+	return client
+}
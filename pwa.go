@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// webManifest is the W3C web app manifest that lets the gallery be installed,
+// https://www.w3.org/TR/appmanifest/.
+type webManifest struct {
+	Name            string            `json:"name"`
+	ShortName       string            `json:"short_name"`
+	StartURL        string            `json:"start_url"`
+	Scope           string            `json:"scope"`
+	Display         string            `json:"display"`
+	BackgroundColor string            `json:"background_color"`
+	ThemeColor      string            `json:"theme_color"`
+	Icons           []webManifestIcon `json:"icons,omitempty"`
+}
+
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+func webManifestHandler(w http.ResponseWriter, r *http.Request) {
+	manifest := webManifest{
+		Name:            feedTitle,
+		ShortName:       siteAuthor,
+		StartURL:        "/",
+		Scope:           "/",
+		Display:         "standalone",
+		BackgroundColor: "#ffffff",
+		ThemeColor:      "#222222",
+	}
+
+	if fileExists(filepath.Join(conf.IconsDir, "apple-touch-icon.png")) {
+		manifest.Icons = append(manifest.Icons, webManifestIcon{
+			Src:   "/apple-touch-icon.png",
+			Sizes: "180x180",
+			Type:  "image/png",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/manifest+json")
+	err := json.NewEncoder(w).Encode(manifest)
+	if err != nil {
+		logRequestError(r, err)
+	}
+}
+
+// serviceWorkerHandler serves /sw.js: serviceWorkerScript preceded by the
+// cache version and the list of URLs to precache, both worked out from what
+// is on disk now. A change to any of them changes the version, so browsers
+// install the new worker and drop the old caches.
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	precache, version := serviceWorkerPrecache()
+
+	list, err := json.Marshal(precache)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The worker must always be revalidated, or browsers would keep running
+	// a stale one for up to a day.
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	fmt.Fprintf(w, "const CACHE_VERSION = %q;\nconst PRECACHE_URLS = %s;\n\n", fmt.Sprintf("v%x", version), list)
+	fmt.Fprint(w, serviceWorkerScript)
+}
+
+// serviceWorkerPrecache lists the index, the stylesheets and scripts by
+// their fingerprinted URLs, and every listed gallery's preview image, along
+// with a fingerprint of them and of the content.
+func serviceWorkerPrecache() ([]string, int64) {
+	urls := []string{"/"}
+	version := contentFingerprint()
+
+	for _, dir := range []string{"css", "js"} {
+		entries, err := fs.ReadDir(siteFiles(), dir)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || (ext != ".css" && ext != ".js") {
+				continue
+			}
+
+			// The fingerprinted URL changes with the file, even one built
+			// into the binary, which has no modification time.
+			u := assetURL("/" + dir + "/" + entry.Name())
+			version += int64(crc32.ChecksumIEEE([]byte(u)))
+			urls = append(urls, u)
+		}
+	}
+
+	// A single missing URL would fail the whole precache, so only covers
+	// that exist are listed.
+	for _, g := range listedGalleries() {
+		if fileExists(contentPath("galleries", g.Dir, g.Cover)) {
+			urls = append(urls, g.previewImage())
+		}
+	}
+
+	return urls, version
+}
+
+// serviceWorkerScript precaches the site shell and serves pages network
+// first, so that the latest content is shown when online and recently viewed
+// galleries still open offline. Pictures are served from the cache while it
+// fetches them again for next time. Pages and pictures fetched at runtime are
+// kept across versions, up to RUNTIME_LIMIT, unless they are private. The
+// API and resized pictures are always fetched, and the admin area, stats and
+// links that grant access are left to the network alone.
+const serviceWorkerScript = `const PRECACHE = "precache-" + CACHE_VERSION;
+const RUNTIME = "runtime";
+const RUNTIME_LIMIT = 200;
+
+// PRIVATE_PATHS never go through the caches at all.
+const PRIVATE_PATHS = ["/stats", "/admin", "/proof/", "/signed-image", "/download/", "/s/"];
+
+// FRESH_PATHS can answer differently at the same URL, so they are only
+// taken from the precache when offline.
+const FRESH_PATHS = ["/api/", "/graphql", "/img-resize"];
+
+function under(url, paths) {
+  return paths.some(path => url.pathname.startsWith(path));
+}
+
+self.addEventListener("install", event => {
+  event.waitUntil(
+    caches.open(PRECACHE)
+      .then(cache => cache.addAll(PRECACHE_URLS))
+      .then(() => self.skipWaiting())
+  );
+});
+
+self.addEventListener("activate", event => {
+  event.waitUntil(
+    caches.keys()
+      .then(names => Promise.all(names
+        .filter(name => name !== PRECACHE && name !== RUNTIME)
+        .map(name => caches.delete(name))))
+      .then(() => self.clients.claim())
+  );
+});
+
+function remember(request, response) {
+  const cacheControl = response.headers.get("Cache-Control") || "";
+  if (!response.ok || /no-store|private/.test(cacheControl)) {
+    return;
+  }
+
+  const copy = response.clone();
+  caches.open(RUNTIME).then(cache =>
+    cache.put(request, copy)
+      .then(() => cache.keys())
+      .then(keys => Promise.all(keys
+        .slice(0, Math.max(0, keys.length - RUNTIME_LIMIT))
+        .map(key => cache.delete(key)))));
+}
+
+self.addEventListener("fetch", event => {
+  const request = event.request;
+  const url = new URL(request.url);
+  if (request.method !== "GET" || url.origin !== self.location.origin || under(url, PRIVATE_PATHS)) {
+    return;
+  }
+
+  if (under(url, FRESH_PATHS)) {
+    event.respondWith(
+      fetch(request).catch(() => caches.open(PRECACHE)
+        .then(cache => cache.match(request))
+        .then(cached => cached || Response.error()))
+    );
+    return;
+  }
+
+  if (request.mode === "navigate") {
+    event.respondWith(
+      fetch(request)
+        .then(response => {
+          remember(request, response);
+          return response;
+        })
+        .catch(() => caches.match(request)
+          .then(cached => cached || caches.match("/")))
+    );
+    return;
+  }
+
+  const fetched = fetch(request).then(response => {
+    remember(request, response);
+    return response;
+  });
+  event.respondWith(caches.match(request).then(cached => cached || fetched));
+  event.waitUntil(fetched.catch(() => {}));
+});
+`
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiterIdle is how long a visitor's buckets are kept after their last
+// request. One that comes back later starts with full buckets.
+const rateLimiterIdle = 10 * time.Minute
+
+// The kinds of request that have rate limits of their own.
+const (
+	rateDefault  = "default"
+	rateStats    = "stats"
+	rateDownload = "download"
+	rateImages   = "images"
+)
+
+type rateLimiterKey struct {
+	ip   string
+	kind string
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiters holds a token bucket per visitor per kind of request.
+var rateLimiters = struct {
+	lock    sync.Mutex
+	entries map[rateLimiterKey]*rateLimiterEntry
+}{entries: make(map[rateLimiterKey]*rateLimiterEntry)}
+
+// rateKind picks which of rateLimit's limits r falls under.
+func rateKind(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case p == statsViewPath:
+		// Counting a view is cheap, and galleries send one per picture.
+		return rateDefault
+	case p == "/stats" || strings.HasPrefix(p, "/stats/") || p == "/stats-log" || p == apiStatsPath:
+		return rateStats
+	case downloadPath(p):
+		return rateDownload
+	case p == signedImagePath:
+		// Signed URLs stand for the pictures and downloads of protected
+		// galleries, and are limited as what they stand for.
+		if u, err := url.Parse(r.URL.Query().Get("u")); err == nil && downloadPath(u.Path) {
+			return rateDownload
+		}
+		return rateImages
+	case p == "/img-resize":
+		return rateImages
+	}
+
+	return rateDefault
+}
+
+// downloadPath reports whether p is a gallery's zip or an original's
+// download.
+func downloadPath(p string) bool {
+	return strings.HasPrefix(p, "/gallery/") && strings.HasSuffix(p, downloadSuffix) || strings.HasPrefix(p, originalDownloadPath)
+}
+
+func rateLimitFor(kind string) rateConfig {
+	switch kind {
+	case rateStats:
+		return conf.RateLimit.Stats
+	case rateDownload:
+		return conf.RateLimit.Download
+	case rateImages:
+		return conf.RateLimit.Images
+	}
+
+	return conf.RateLimit.Default
+}
+
+// rateLimiter returns ip's bucket for kind, filling a new one if ip hasn't
+// been seen lately.
+func rateLimiter(ip, kind string) *rate.Limiter {
+	rateLimiters.lock.Lock()
+	defer rateLimiters.lock.Unlock()
+
+	key := rateLimiterKey{ip, kind}
+	e, ok := rateLimiters.entries[key]
+	if !ok {
+		limit := rateLimitFor(kind)
+		e = &rateLimiterEntry{limiter: rate.NewLimiter(rate.Limit(limit.RPS), limit.Burst)}
+		rateLimiters.entries[key] = e
+	}
+	e.lastSeen = time.Now()
+
+	return e.limiter
+}
+
+// forgetIdleRateLimiters drops the buckets of visitors who have stopped
+// visiting, every rateLimiterIdle.
+func forgetIdleRateLimiters() {
+	for range time.Tick(rateLimiterIdle) {
+		cutoff := time.Now().Add(-rateLimiterIdle)
+
+		rateLimiters.lock.Lock()
+		for key, e := range rateLimiters.entries {
+			if e.lastSeen.Before(cutoff) {
+				delete(rateLimiters.entries, key)
+			}
+		}
+		rateLimiters.lock.Unlock()
+	}
+}
+
+// limitRates answers 429, with a Retry-After of when the next request would
+// be let through, to visitors who make requests faster than rateLimit
+// allows. Each visitor address has a bucket per kind of request, so
+// that crawling the stats or pulling zips doesn't use up their allowance
+// for pages.
+func limitRates(handler http.Handler) http.Handler {
+	if !conf.RateLimit.Enabled {
+		return handler
+	}
+
+	go forgetIdleRateLimiters()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := rateLimiter(remoteIP(r), rateKind(r)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			httpError(w, r, "Too many requests. Please wait a moment and try again.", http.StatusTooManyRequests)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
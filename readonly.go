@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+)
+
+// refuseWrite answers a request that would change something with 405 in
+// read-only mode, and reports whether it did. Reads go through.
+func refuseWrite(w http.ResponseWriter, r *http.Request) bool {
+	if !conf.ReadOnly || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	httpError(w, r, "This server is read-only. Make changes on the main one.", http.StatusMethodNotAllowed)
+	return true
+}
+
+// openStatsReadOnly opens the stats database that another server writes,
+// only to read it. It must already exist.
+func openStatsReadOnly(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+filename+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStatsDatabase(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	return db, nil
+}
+
+// checkStatsReadable reads from the stats database, in place of
+// checkStatsWritable in read-only mode.
+func checkStatsReadable(ctx context.Context) error {
+	var rows int
+	return statsDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM hits WHERE 0").Scan(&rows)
+}
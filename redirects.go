@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// siteRedirectsFile, in the content root, lists paths that now live
+// elsewhere, such as those of an earlier site, one per line: the old path,
+// the new path or URL, and the status, 301 unless given. An old path ending
+// in * stands for everything under it, which a new one ending in * keeps.
+// Lines starting with # are comments.
+const siteRedirectsFile = "redirects.txt"
+
+// siteRedirect is one line of the redirects file.
+type siteRedirect struct {
+	from   string
+	to     string
+	status int
+
+	// prefix is set for a from ending in *, without it.
+	prefix bool
+}
+
+// siteRedirectTable holds the redirects file, read again with the indexes
+// whenever the content changes.
+type siteRedirectTable struct {
+	lock  sync.RWMutex
+	exact map[string]siteRedirect
+
+	// prefixes are longest first, so that the most specific wins.
+	prefixes []siteRedirect
+}
+
+var siteRedirects = &siteRedirectTable{}
+
+func (t *siteRedirectTable) rebuild() {
+	exact := make(map[string]siteRedirect)
+	var prefixes []siteRedirect
+
+	data, err := ioutil.ReadFile(contentPath(siteRedirectsFile))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		redirect, ok := parseSiteRedirect(line)
+		if !ok {
+			log.Printf("%v line %d is not an old path, a new path or URL, and maybe a status: %q", siteRedirectsFile, i+1, line)
+			continue
+		}
+		if redirect.loops() {
+			log.Printf("%v line %d redirects to a path under its own, which would never end: %q", siteRedirectsFile, i+1, line)
+			continue
+		}
+		if redirect.prefix {
+			prefixes = append(prefixes, redirect)
+		} else {
+			exact[redirect.from] = redirect
+		}
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		return len(prefixes[i].from) > len(prefixes[j].from)
+	})
+
+	t.lock.Lock()
+	t.exact, t.prefixes = exact, prefixes
+	t.lock.Unlock()
+}
+
+// parseSiteRedirect reads a line of the redirects file. A new path of - is
+// for a status of 410 Gone.
+func parseSiteRedirect(line string) (siteRedirect, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || !strings.HasPrefix(fields[0], "/") {
+		return siteRedirect{}, false
+	}
+
+	r := siteRedirect{from: fields[0], to: fields[1], status: http.StatusMovedPermanently}
+	if len(fields) == 3 {
+		status, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return siteRedirect{}, false
+		}
+		r.status = status
+	}
+
+	switch r.status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		if !strings.HasPrefix(r.to, "/") && !strings.HasPrefix(r.to, "https://") && !strings.HasPrefix(r.to, "http://") {
+			return siteRedirect{}, false
+		}
+	case http.StatusGone:
+		if r.to != "-" {
+			return siteRedirect{}, false
+		}
+	default:
+		return siteRedirect{}, false
+	}
+
+	if strings.HasSuffix(r.from, "*") {
+		r.from = strings.TrimSuffix(r.from, "*")
+		r.prefix = true
+	} else {
+		r.from = trimTrailingSlash(r.from)
+	}
+
+	return r, r.from != r.to
+}
+
+// loops reports whether a prefix redirect's new path is under its old one,
+// so that following it would only come back to it.
+func (r siteRedirect) loops() bool {
+	return r.prefix && strings.HasPrefix(strings.TrimSuffix(r.to, "*"), r.from)
+}
+
+func trimTrailingSlash(p string) string {
+	if p != "/" {
+		p = strings.TrimSuffix(p, "/")
+	}
+
+	return p
+}
+
+// find returns the redirect for p, if any, and where it goes.
+func (t *siteRedirectTable) find(p string) (siteRedirect, string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if r, ok := t.exact[trimTrailingSlash(p)]; ok {
+		return r, r.to, true
+	}
+
+	for _, r := range t.prefixes {
+		if rest, ok := strings.CutPrefix(p, r.from); ok {
+			if to, ok := strings.CutSuffix(r.to, "*"); ok {
+				return r, to + rest, true
+			}
+			return r, r.to, true
+		}
+	}
+
+	return siteRedirect{}, "", false
+}
+
+// redirectPaths sends requests for the paths in the redirects file on to
+// where they live now, keeping the query unless the new address has one of
+// its own.
+func redirectPaths(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirect, to, ok := siteRedirects.find(r.URL.Path)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		if redirect.status == http.StatusGone {
+			httpError(w, r, "This page has been taken down.", http.StatusGone)
+			return
+		}
+
+		if r.URL.RawQuery != "" && !strings.Contains(to, "?") {
+			to += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, to, redirect.status)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// referrerKey is a site that linked to a page on a day.
+type referrerKey struct {
+	page   string
+	day    string
+	domain string
+}
+
+// referrerDomain returns the host of the page the request came from, less
+// any www., or "" if there was none or it was one of ours.
+func referrerDomain(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Hostname() == "" {
+		return ""
+	}
+
+	domain := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	ours := []string{(&url.URL{Host: r.Host}).Hostname()}
+	if site, err := url.Parse(conf.SiteURL); err == nil {
+		ours = append(ours, site.Hostname())
+	}
+	for _, o := range ours {
+		if domain == strings.TrimPrefix(strings.ToLower(o), "www.") {
+			return ""
+		}
+	}
+
+	return domain
+}
+
+func writeReferrers(tx *sql.Tx, referrers map[referrerKey]int) error {
+	stmt, err := tx.Prepare("INSERT INTO referrers (page, day, domain, count) VALUES (?, ?, ?, ?) ON CONFLICT (page, day, domain) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, count := range referrers {
+		_, err = stmt.Exec(key.page, key.day, key.domain, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type referrerViewModel struct {
+	Domain   string
+	HitCount int
+	Pages    int
+}
+
+type statsReferrersViewModel struct {
+	Page      string
+	Days      int
+	Referrers []referrerViewModel
+}
+
+// getStatsReferrersViewModel returns the sites that sent visitors over the
+// last days days, or ever if days is 0, busiest first, optionally to one
+// page only.
+func getStatsReferrersViewModel(days int, page string) (statsReferrersViewModel, error) {
+	flushHits()
+
+	since := undatedDay
+	if days > 0 {
+		since = statsNow().AddDate(0, 0, 1-days).Format(statsDayFormat)
+	}
+
+	rows, err := statsDB.Query(`
+		SELECT domain, SUM(count) AS hits, COUNT(DISTINCT page)
+		FROM referrers
+		WHERE day >= ? AND (? = '' OR page = ?)
+		GROUP BY domain
+		ORDER BY hits DESC, domain`, since, page, page)
+	if err != nil {
+		return statsReferrersViewModel{}, err
+	}
+	defer rows.Close()
+
+	vm := statsReferrersViewModel{Page: page, Days: days, Referrers: make([]referrerViewModel, 0)}
+	for rows.Next() {
+		var ref referrerViewModel
+		err = rows.Scan(&ref.Domain, &ref.HitCount, &ref.Pages)
+		if err != nil {
+			return statsReferrersViewModel{}, err
+		}
+		vm.Referrers = append(vm.Referrers, ref)
+	}
+
+	return vm, rows.Err()
+}
+
+// statsReferrersHandler shows where visitors came from, for ever or the
+// last ?days=, and to one page with ?page=.
+func statsReferrersHandler(w http.ResponseWriter, r *http.Request) {
+	days := 0
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			httpError(w, r, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	vm, err := getStatsReferrersViewModel(days, r.FormValue("page"))
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not read the stats", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(r.Context(), "stats_referrers", vm, w)
+}
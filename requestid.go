@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// requestIDHeader carries a request's ID, from a proxy in front if it set
+// one, and back to the client.
+const requestIDHeader = "X-Request-ID"
+
+const requestIDKey contextKey = "requestID"
+
+// validRequestID is what an ID from the client must look like to be kept,
+// so that it can't forge log lines.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID gives each request an ID, the one it came with if it is
+// valid, and sends it back in requestIDHeader. The log, error pages and
+// the admin area's errors show it, so that a visitor's report of a problem
+// can be matched to the log.
+func withRequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func newRequestID() string {
+	raw := make([]byte, 12)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(raw)
+}
+
+// requestID returns the ID of the request ctx belongs to, or "" outside of
+// one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestIDHandler adds the request's ID to records logged with its
+// context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("requestID", id))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logRequestError logs what went wrong while answering r, as log.Println
+// would, with r's ID.
+func logRequestError(r *http.Request, v ...interface{}) {
+	slog.ErrorContext(r.Context(), strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// httpError answers r with an error, as http.Error does, along with r's
+// ID to quote when reporting it. A browser asking for a page gets an
+// error page instead.
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if wantsPage(r) {
+		serveErrorPage(r.Context(), w, message, status)
+		return
+	}
+
+	http.Error(w, withRequestIDNote(r.Context(), message), status)
+}
+
+// withRequestIDNote adds the ID of the request ctx belongs to to an error
+// message.
+func withRequestIDNote(ctx context.Context, message string) string {
+	if id := requestID(ctx); id != "" {
+		message += "\n\nRequest ID: " + id
+	}
+
+	return message
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// robotsGroup is one User-agent section of robots.txt.
+type robotsGroup struct {
+	UserAgent string   `yaml:"userAgent"`
+	Allow     []string `yaml:"allow"`
+	Disallow  []string `yaml:"disallow"`
+}
+
+// statsPaths are disallowed for every crawler when robots.disallowStats is
+// set.
+var statsPaths = []string{"/stats"}
+
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, renderRobots())
+}
+
+func renderRobots() string {
+	groups := conf.Robots.Groups
+	if len(groups) == 0 {
+		groups = []robotsGroup{{UserAgent: "*"}}
+	}
+
+	var b strings.Builder
+	for i, g := range groups {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+
+		fmt.Fprintf(&b, "User-agent: %v\n", g.UserAgent)
+		for _, p := range g.Allow {
+			fmt.Fprintf(&b, "Allow: %v\n", p)
+		}
+
+		disallow := g.Disallow
+		if conf.Robots.DisallowStats {
+			disallow = append(disallow[:len(disallow):len(disallow)], statsPaths...)
+		}
+		for _, p := range disallow {
+			fmt.Fprintf(&b, "Disallow: %v\n", p)
+		}
+
+		if len(g.Allow) == 0 && len(disallow) == 0 {
+			// An empty Disallow allows everything.
+			b.WriteString("Disallow:\n")
+		}
+	}
+
+	if conf.Robots.Sitemap {
+		fmt.Fprintf(&b, "\nSitemap: %v\n", absoluteURL("/sitemap.xml"))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Weights for where a search term appears in a gallery.
+const (
+	searchWeightTitle       = 5
+	searchWeightTag         = 3
+	searchWeightDescription = 2
+	searchWeightText        = 1
+)
+
+// snippetLength is roughly how much of a document's text is shown under a
+// search result.
+const snippetLength = 160
+
+// sitePages are the markdown files outside the galleries that are searched
+// too, with the page each is shown on.
+var sitePages = []struct {
+	name     string
+	filename string
+	url      string
+}{
+	{"About", "about.markdown", "/"},
+}
+
+// searchIndex is an inverted index from lower-cased words to the documents
+// (listed galleries and site pages) they appear in, with a score per
+// document.
+type searchIndex struct {
+	lock      sync.RWMutex
+	terms     map[string]map[string]int
+	documents map[string]searchResultViewModel
+}
+
+var search = &searchIndex{}
+
+type searchResultViewModel struct {
+	Name         string
+	URL          string
+	PreviewImage string
+	Snippet      string
+}
+
+func (s *searchIndex) rebuild() {
+	terms := make(map[string]map[string]int)
+	documents := make(map[string]searchResultViewModel)
+	add := func(id, text string, weight int) {
+		for _, term := range tokenize(text) {
+			if terms[term] == nil {
+				terms[term] = make(map[string]int)
+			}
+			terms[term][id] += weight
+		}
+	}
+
+	for _, g := range listGalleries() {
+		if !g.listed() {
+			continue
+		}
+
+		id := "gallery/" + g.Dir
+		text := readGalleryText(g)
+
+		add(id, g.Title, searchWeightTitle)
+		add(id, g.Dir, searchWeightTitle)
+		add(id, strings.Join(g.Tags, " "), searchWeightTag)
+		add(id, g.Description, searchWeightDescription)
+		add(id, text, searchWeightText)
+
+		snippet := g.Description
+		if snippet == "" {
+			snippet = text
+		}
+
+		documents[id] = searchResultViewModel{
+			Name:         g.Title,
+			URL:          g.URL(),
+			PreviewImage: g.previewImage(),
+			Snippet:      truncate(snippet, snippetLength),
+		}
+	}
+
+	for _, page := range sitePages {
+		markdown, err := ioutil.ReadFile(contentPath(page.filename))
+		if err != nil {
+			continue
+		}
+
+		id := "page/" + page.filename
+		text := markdownToText(markdown)
+
+		add(id, page.name, searchWeightTitle)
+		add(id, text, searchWeightText)
+
+		documents[id] = searchResultViewModel{
+			Name:    page.name,
+			URL:     page.url,
+			Snippet: truncate(text, snippetLength),
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.terms = terms
+	s.documents = documents
+}
+
+// readGalleryText returns the text of a gallery's blurb and captions, as
+// rendered, so that markdown syntax and link targets are not indexed.
+func readGalleryText(g gallery) string {
+	var text []string
+
+	blurb, err := ioutil.ReadFile(contentPath("galleries", g.Dir, "blurb.markdown"))
+	if err == nil {
+		text = append(text, markdownToText(blurb))
+	}
+
+	for _, caption := range g.Captions {
+		text = append(text, markdownToText([]byte(caption)))
+	}
+
+	infos, err := ioutil.ReadDir(contentPath("galleries", g.Dir))
+	if err == nil {
+		for _, info := range infos {
+			if !strings.HasSuffix(info.Name(), ".md") {
+				continue
+			}
+
+			caption, err := ioutil.ReadFile(contentPath("galleries", g.Dir, info.Name()))
+			if err == nil {
+				text = append(text, markdownToText(caption))
+			}
+		}
+	}
+
+	return strings.Join(text, "\n")
+}
+
+// markdownToText renders markdown the same way the pages do and returns just
+// the visible text.
+func markdownToText(markdown []byte) string {
+	return htmlToText(string(renderMarkdown(markdown)))
+}
+
+// htmlToText drops the tags from rendered HTML and collapses the whitespace
+// left between them.
+func htmlToText(rendered string) string {
+	var text strings.Builder
+	inTag := false
+	for _, r := range rendered {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			text.WriteRune(' ')
+		case !inTag:
+			text.WriteRune(r)
+		}
+	}
+
+	return strings.Join(strings.Fields(html.UnescapeString(text.String())), " ")
+}
+
+// truncate shortens text to about n characters, breaking at a space.
+func truncate(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > n/2 {
+		cut = cut[:i]
+	}
+
+	return cut + "…"
+}
+
+// tokenize splits text into lower-cased words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// query returns the documents matching every word of q, best match first.
+// A word also matches longer words it is a prefix of, at a lower score, so
+// "portrait" finds "portraits".
+func (s *searchIndex) query(q string) []searchResultViewModel {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var scores map[string]int
+	for _, word := range tokenize(q) {
+		matches := make(map[string]int)
+		for term, dirs := range s.terms {
+			if term != word && (len(word) < 3 || !strings.HasPrefix(term, word)) {
+				continue
+			}
+
+			for dir, score := range dirs {
+				if term != word {
+					score = (score + 1) / 2
+				}
+				matches[dir] += score
+			}
+		}
+
+		if scores == nil {
+			scores = matches
+			continue
+		}
+
+		for dir := range scores {
+			if _, ok := matches[dir]; !ok {
+				delete(scores, dir)
+				continue
+			}
+			scores[dir] += matches[dir]
+		}
+	}
+
+	ids := make([]string, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	result := make([]searchResultViewModel, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, s.documents[id])
+	}
+
+	return result
+}
+
+type searchViewModel struct {
+	Meta    pageMetadata
+	Query   string
+	Results []searchResultViewModel
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	incrementHitCount(r, "search")
+
+	canonical := "/search"
+	if q != "" {
+		canonical += "?" + url.Values{"q": {q}}.Encode()
+	}
+
+	vm := searchViewModel{
+		Meta:    newPageMetadata("Search", "", "", canonical),
+		Query:   q,
+		Results: search.query(q),
+	}
+
+	renderTemplate(r.Context(), "search", vm, w)
+}
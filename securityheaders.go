@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// defaultContentSecurityPolicy lets pages use the site's own scripts,
+// styles and pictures, the inline scripts and styles the templates have,
+// and the jQuery and IE shims page.html loads from their CDNs.
+const defaultContentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self' 'unsafe-inline' https://ajax.googleapis.com https://oss.maxcdn.com; " +
+	"style-src 'self' 'unsafe-inline'; img-src 'self' data:; font-src 'self' data:; " +
+	"connect-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'none'"
+
+// securityHeadersWriter holds back the status line until the first write,
+// so that it can tell from the Content-Type, or failing that the body,
+// whether the response is a page.
+type securityHeadersWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *securityHeadersWriter) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+func (s *securityHeadersWriter) Write(b []byte) (int, error) {
+	s.writeHeader(b)
+	return s.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection's own writer.
+func (s *securityHeadersWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// writeHeader adds the headers, if the response is a page, and sends the
+// status line.
+func (s *securityHeadersWriter) writeHeader(body []byte) {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+
+	h := s.Header()
+	if h.Get("Content-Type") == "" && body != nil && h.Get("Content-Encoding") == "" {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+	if strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+		headers := conf.SecurityHeaders
+		for name, value := range map[string]string{
+			"Content-Security-Policy": headers.ContentSecurityPolicy,
+			"Referrer-Policy":         headers.ReferrerPolicy,
+			"X-Frame-Options":         headers.FrameOptions,
+			"Permissions-Policy":      headers.PermissionsPolicy,
+		} {
+			// A handler's own choice wins.
+			if value != "" && h.Get(name) == "" {
+				h.Set(name, value)
+			}
+		}
+	}
+
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	s.ResponseWriter.WriteHeader(s.status)
+}
+
+// addSecurityHeaders sends X-Content-Type-Options: nosniff with every
+// response, and securityHeaders' policies with every page.
+func addSecurityHeaders(handler http.Handler) http.Handler {
+	if !conf.SecurityHeaders.Enabled {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		sw := &securityHeadersWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r)
+		sw.writeHeader(nil)
+	})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selectsPath is where a client following an access link marks the
+// pictures they want, or unmarks them.
+const selectsPath = "/selects"
+
+// pictureSelect is one picture a client picked from a proofing gallery.
+type pictureSelect struct {
+	Link  string
+	Image string
+	Time  time.Time
+}
+
+// selectsLock serialises changes to the selects file.
+var selectsLock sync.Mutex
+
+// readSelects reads the selects file, one tab-separated access link hash,
+// image name and time per line. A missing file means no selects.
+func readSelects() ([]pictureSelect, error) {
+	data, err := ioutil.ReadFile(conf.Admin.SelectsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var selects []pictureSelect
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimRight(line, "\r"), "\t", 3)
+		if len(fields) != 3 || fields[0] == "" {
+			continue
+		}
+
+		t, _ := time.Parse(time.RFC3339, fields[2])
+		selects = append(selects, pictureSelect{Link: fields[0], Image: fields[1], Time: t})
+	}
+
+	return selects, nil
+}
+
+func writeSelects(selects []pictureSelect) error {
+	return writeFileAtomic(conf.Admin.SelectsFile, func(w io.Writer) error {
+		for _, s := range selects {
+			_, err := fmt.Fprintf(w, "%v\t%v\t%v\n", s.Link, s.Image, s.Time.Format(time.RFC3339))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// updateSelects applies change to the stored selects and writes them back.
+func updateSelects(change func([]pictureSelect) []pictureSelect) error {
+	selectsLock.Lock()
+	defer selectsLock.Unlock()
+
+	selects, err := readSelects()
+	if err != nil {
+		return err
+	}
+
+	return writeSelects(change(selects))
+}
+
+// setSelect marks or unmarks image as picked through the link with the
+// given hash.
+func setSelect(link, image string, selected bool) error {
+	return updateSelects(func(selects []pictureSelect) []pictureSelect {
+		kept := make([]pictureSelect, 0, len(selects)+1)
+		for _, s := range selects {
+			if s.Link != link || s.Image != image {
+				kept = append(kept, s)
+			}
+		}
+		if selected {
+			kept = append(kept, pictureSelect{Link: link, Image: image, Time: time.Now()})
+		}
+
+		return kept
+	})
+}
+
+// dropSelects forgets the picks made through a revoked link.
+func dropSelects(link string) {
+	err := updateSelects(func(selects []pictureSelect) []pictureSelect {
+		kept := make([]pictureSelect, 0, len(selects))
+		for _, s := range selects {
+			if s.Link != link {
+				kept = append(kept, s)
+			}
+		}
+
+		return kept
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// selectsFor returns the picks made through the link with the given hash,
+// in the order they were made.
+func selectsFor(link string) []pictureSelect {
+	selects, err := readSelects()
+	if err != nil {
+		log.Println(err)
+	}
+
+	result := make([]pictureSelect, 0)
+	for _, s := range selects {
+		if s.Link == link {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// selectCounts returns how many pictures have been picked through each
+// link, by hash.
+func selectCounts() map[string]int {
+	selects, err := readSelects()
+	if err != nil {
+		log.Println(err)
+	}
+
+	counts := make(map[string]int)
+	for _, s := range selects {
+		counts[s.Link]++
+	}
+
+	return counts
+}
+
+// selectsHandler marks or unmarks a picture for a client who followed one
+// of its gallery's access links. The page's script asks for JSON; a plain
+// form post is sent back to the gallery.
+func selectsHandler(w http.ResponseWriter, r *http.Request) {
+	if refuseWrite(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		httpError(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	link, ok := accessLinkFor(r, g)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	image := r.FormValue("image")
+	if image != path.Base(image) || !isJpeg(image) || !fileExists(contentPath("galleries", g.Dir, image)) {
+		httpError(w, r, "No such picture", http.StatusBadRequest)
+		return
+	}
+
+	selected := r.FormValue("selected") != ""
+	err := setSelect(link.Hash, image, selected)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not save the pick", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, struct {
+			Image    string `json:"image"`
+			Selected bool   `json:"selected"`
+		}{image, selected})
+		return
+	}
+
+	target := g.URL()
+	if page := r.FormValue("page"); page != "" {
+		target += "?page=" + page
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+type adminSelectsViewModel struct {
+	Meta    pageMetadata
+	Link    accessLink
+	Gallery string
+	Selects []selectViewModel
+}
+
+type selectViewModel struct {
+	Image  string
+	Time   time.Time
+	URL    string
+	Srcset string
+}
+
+// adminSelectsHandler lists the pictures a client picked through one
+// access link, as a page, as CSV with ?format=csv, or as JSON for a
+// token.
+func adminSelectsHandler(w http.ResponseWriter, r *http.Request) {
+	links, err := readAccessLinks()
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	var link accessLink
+	ok := false
+	for _, l := range links {
+		if l.Hash == r.FormValue("link") {
+			link, ok = l, true
+		}
+	}
+	if !ok {
+		adminError(w, r, http.StatusNotFound, "No such link.")
+		return
+	}
+
+	selects := selectsFor(link.Hash)
+
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", selectsFileName(link)))
+		out := csv.NewWriter(w)
+		out.Write([]string{"gallery", "for", "image", "selected"})
+		for _, s := range selects {
+			out.Write([]string{link.Gallery, link.Label, s.Image, s.Time.Format(time.RFC3339)})
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			logRequestError(r, err)
+		}
+		return
+	}
+
+	if isTokenRequest(r) {
+		images := make([]string, 0, len(selects))
+		for _, s := range selects {
+			images = append(images, s.Image)
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Gallery string   `json:"gallery"`
+			For     string   `json:"for"`
+			Images  []string `json:"images"`
+		}{link.Gallery, link.Label, images})
+		return
+	}
+
+	vm := adminSelectsViewModel{
+		Meta:    newPageMetadata("Selects", "", "", "/admin/access-links/selects"),
+		Link:    link,
+		Gallery: link.Gallery,
+		Selects: make([]selectViewModel, 0, len(selects)),
+	}
+	if g, ok := galleryByDir(link.Gallery); ok {
+		vm.Gallery = g.Title
+	}
+	for _, s := range selects {
+		imageURL := fmt.Sprintf("/galleries/%v/%v", link.Gallery, s.Image)
+		vm.Selects = append(vm.Selects, selectViewModel{Image: s.Image, Time: s.Time, URL: imageURL, Srcset: getSrcset(imageURL)})
+	}
+
+	renderTemplate(r.Context(), "admin_selects", vm, w)
+}
+
+// selectsFileName names the CSV download after the gallery and the client,
+// keeping only characters that are safe in a file name.
+func selectsFileName(link accessLink) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '-'
+	}, link.Gallery+"-"+link.Label)
+
+	return name + "-selects.csv"
+}
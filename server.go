@@ -1,145 +1,343 @@
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"github.com/russross/blackfriday"
+	"go.opentelemetry.io/otel/attribute"
 	"html/template"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
 )
 
-const portHttp = 8081
-const portHttps = 8443
+const shutdownTimeout = 30 * time.Second
 
-const httpsRedirectRoot = "https://chezwatts.gallery:443"
+func main() {
 
-const fileSystemRoot = "/var/www/chezwatts.gallery/"
+	configFile := flag.String("config", "", "path to a YAML config file")
+	flag.Parse()
 
-const httpsCertificate = "/etc/letsencrypt/live/chezwatts.gallery/fullchain.pem"
-const httpsPrivateKey = "/etc/letsencrypt/live/chezwatts.gallery/privkey.pem"
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf = c
+	err = initLogging()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-var templates = make(map[string]*template.Template)
-var hitCountByPage = make(map[string]int)
-var hitCountModifyLock = &sync.Mutex{}
+	templates.reload = conf.DevMode
+	err = templates.load()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func main() {
+	err = openStats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	go flushHitsPeriodically()
+	go backupStatsPeriodically()
 
-	defer saveStats()
+	initImagePipeline()
 
-	restoreStats()
+	rebuildIndexes()
+	go refreshIndexes()
+	go watchContent()
 
 	httpsMux := http.NewServeMux()
 
-	httpsMux.HandleFunc("/favicon.ico", faviconHandler)
+	httpsMux.HandleFunc("/favicon.ico", iconHandler)
+	httpsMux.HandleFunc("/apple-touch-icon.png", iconHandler)
+	httpsMux.HandleFunc("/site.webmanifest", webManifestHandler)
+	httpsMux.HandleFunc("/sw.js", serviceWorkerHandler)
 	httpsMux.HandleFunc("/", indexHandler)
 	httpsMux.HandleFunc("/gallery/", galleryHandler)
-	httpsMux.HandleFunc("/stats", statsHandler)
-	httpsMux.Handle("/galleries/", http.StripPrefix("/galleries/", http.FileServer(http.Dir(fileSystemRoot+"galleries"))))
-	httpsMux.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir(fileSystemRoot+"js"))))
-	httpsMux.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir(fileSystemRoot+"css"))))
+	httpsMux.HandleFunc("/robots.txt", robotsHandler)
+	httpsMux.HandleFunc(healthzPath, healthzHandler)
+	httpsMux.HandleFunc(readyzPath, readyzHandler)
+	httpsMux.HandleFunc("/feed.json", jsonFeedHandler)
+	httpsMux.HandleFunc("/sitemap.xml", sitemapHandler)
+	httpsMux.HandleFunc("/search", searchHandler)
+	httpsMux.HandleFunc("/tags", tagsHandler)
+	httpsMux.HandleFunc("/tag/", tagHandler)
+	httpsMux.HandleFunc("/stats", protectStats(statsHandler))
+	httpsMux.HandleFunc(statsChartPath, protectStats(statsChartHandler))
+	httpsMux.HandleFunc("/stats-log", protectStats(statsLogHandler))
+	httpsMux.HandleFunc("/stats/referrers", protectStats(statsReferrersHandler))
+	httpsMux.HandleFunc(statsGalleryPath, protectStats(statsGalleryHandler))
+	httpsMux.HandleFunc(statsViewPath, statsViewHandler)
+	httpsMux.Handle("/img-resize", cacheFor(conf.Cache.ImagesMaxAge, http.HandlerFunc(imageResizeHandler)))
+	httpsMux.HandleFunc(apiGalleriesPath, apiGalleriesHandler)
+	httpsMux.HandleFunc(apiGalleriesPath+"/", apiGalleryHandler)
+	httpsMux.HandleFunc(apiStatsPath, protectStats(apiStatsHandler))
+	httpsMux.HandleFunc("/graphql", graphqlEndpoint)
+	httpsMux.HandleFunc("/admin/login", adminLoginHandler)
+	httpsMux.HandleFunc("/admin/logout", adminLogoutHandler)
+	httpsMux.HandleFunc(oidcLoginPath, oidcLoginHandler)
+	httpsMux.HandleFunc(oidcCallbackPath, oidcCallbackHandler)
+	httpsMux.HandleFunc(accessLinkPath, accessLinkHandler)
+	httpsMux.HandleFunc(shortLinkPath, shortLinkHandler)
+	httpsMux.HandleFunc(selectsPath, selectsHandler)
+	httpsMux.HandleFunc(originalDownloadPath, originalDownloadHandler)
+	if conf.Admin.Enabled {
+		httpsMux.HandleFunc("/admin", requireAdmin(adminHandler))
+		httpsMux.HandleFunc("/admin/upload", requireAdmin(adminUploadHandler))
+		httpsMux.HandleFunc("/admin/upload-zip", requireAdmin(adminUploadZipHandler))
+		httpsMux.HandleFunc("/admin/create", requireAdmin(adminCreateHandler))
+		httpsMux.HandleFunc("/admin/rename", requireAdmin(adminRenameHandler))
+		httpsMux.HandleFunc("/admin/delete", requireAdmin(adminDeleteHandler))
+		httpsMux.HandleFunc("/admin/markdown/", requireAdmin(adminMarkdownHandler))
+		httpsMux.HandleFunc("/admin/markdown-preview", requireAdmin(adminMarkdownPreviewHandler))
+		httpsMux.HandleFunc("/admin/edit/", requireAdmin(adminEditHandler))
+		httpsMux.HandleFunc("/admin/tokens", requireAdmin(adminTokensHandler))
+		httpsMux.HandleFunc("/admin/tokens/revoke", requireAdmin(adminRevokeTokenHandler))
+		httpsMux.HandleFunc("/admin/totp", requireAdmin(adminTOTPHandler))
+		httpsMux.HandleFunc("/admin/totp/confirm", requireAdmin(adminTOTPConfirmHandler))
+		httpsMux.HandleFunc("/admin/totp/disable", requireAdmin(adminTOTPDisableHandler))
+		httpsMux.HandleFunc("/admin/audit", requireAdmin(adminAuditHandler))
+		httpsMux.HandleFunc("/admin/access-links", requireAdmin(adminAccessLinksHandler))
+		httpsMux.HandleFunc("/admin/access-links/revoke", requireAdmin(adminRevokeAccessLinkHandler))
+		httpsMux.HandleFunc("/admin/access-links/selects", requireAdmin(adminSelectsHandler))
+		httpsMux.HandleFunc("/admin/short-links", requireAdmin(adminShortLinksHandler))
+		httpsMux.HandleFunc("/admin/short-links/delete", requireAdmin(adminDeleteShortLinkHandler))
+	}
+	galleryFiles := cacheFor(conf.Cache.ImagesMaxAge, http.StripPrefix("/galleries/", galleryImageHandler(http.FileServer(http.Dir(contentPath("galleries"))))))
+	httpsMux.Handle("/galleries/", galleryFiles)
+	httpsMux.Handle(signedImagePath, signedImageHandler(galleryFiles))
+	httpsMux.Handle("/js/", http.StripPrefix("/js/", cacheFor(conf.Cache.StaticMaxAge, fingerprintedAssets("js", staticFileServer(siteDir("js"))))))
+	httpsMux.Handle("/css/", http.StripPrefix("/css/", cacheFor(conf.Cache.StaticMaxAge, fingerprintedAssets("css", staticFileServer(siteDir("css"))))))
+	if conf.Metrics.Enabled {
+		httpsMux.HandleFunc(metricsPath, metricsHandler())
+	}
+	if conf.Pprof.Enabled {
+		httpsMux.HandleFunc(pprofPath, pprofHandler())
+	}
 
 	httpMux := http.NewServeMux()
 
-	httpMux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(fileSystemRoot+".well-known/acme-challenge"))))
-	httpMux.Handle("/img/", http.StripPrefix("/img/", http.FileServer(http.Dir(fileSystemRoot+"img"))))
+	httpMux.Handle("/.well-known/acme-challenge/", http.StripPrefix("/.well-known/acme-challenge/", http.FileServer(http.Dir(sitePath(".well-known", "acme-challenge")))))
+	httpMux.Handle("/img/", http.StripPrefix("/img/", cacheFor(conf.Cache.StaticMaxAge, staticFileServer(siteDir("img")))))
+	httpMux.HandleFunc(healthzPath, healthzHandler)
+	httpMux.HandleFunc(readyzPath, readyzHandler)
 	httpMux.HandleFunc("/", redirectToHttpsHandler)
 
-	go http.ListenAndServe(":"+strconv.Itoa(portHttp), logAndDelegate(httpMux))
-	log.Fatal(http.ListenAndServeTLS(":"+strconv.Itoa(portHttps), httpsCertificate, httpsPrivateKey, logAndDelegate(httpsMux)))
+	err = inheritListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = startVirtualHosts()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shutdownTracing := initTracing()
+	stopPprof := startPprofServer()
+
+	certManager := newCertManager()
+	checkGalleryHostCertificate()
+	site := withRequestID(logAndDelegate(routeVirtualHosts(addHSTS(addSecurityHeaders(compressResponses(conditionalPages(limitRates(redirectPaths(routeGalleryHosts(traceRequests(httpsMux, canonicalizePaths(measureRequests(httpsMux)))))))))))))
+	redirect := withRequestID(logAndDelegate(acmeChallengeOrRedirect(httpMux, certManager)))
+
+	err = serveUntilSignal(newServers(site, redirect, certManager))
+	stopVirtualHosts()
+	stopPprof()
+	shutdownTracing()
+	closeStats()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func init() {
-	for _, tmpl := range []string{"index", "gallery", "stats"} {
-		filename := fileSystemRoot + tmpl + ".html"
-		t, err := template.ParseFiles(filename)
+// serveUntilSignal runs the servers until one fails or the process
+// receives SIGINT or SIGTERM, then stops accepting connections and waits up
+// to shutdownTimeout for in-flight requests to finish. On SIGUSR2 it starts
+// the executable again first, and hands the connections over to it.
+func serveUntilSignal(servers []namedServer) error {
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		l, err := s.listen()
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		templates[tmpl] = t
+		go func(s namedServer) { errs <- s.serve(l) }(s)
 	}
+	serving()
 
-	t, err := template.ParseFiles(fileSystemRoot + "stats.csv.tmpl")
-	if err != nil {
-		panic(err)
-	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
 
-	templates["stats_csv"] = t
-}
+	result := waitForStop(errs, stop)
 
-func logAndDelegate(handler http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r.Method, r.URL.Path, r.RemoteAddr, r.Referer(), r.UserAgent())
-		handler.ServeHTTP(w, r)
-	})
-}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	for _, s := range servers {
+		err := s.server.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
 
-func redirectToHttpsHandler(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, httpsRedirectRoot+r.RequestURI, http.StatusMovedPermanently)
+	return result
 }
 
-func saveStats() {
-	f, err := os.Create(fileSystemRoot + "stats.csv")
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
+// waitForStop waits for a server to fail, returning its error, or for a
+// signal to stop. A SIGUSR2 only stops the process once a new one has
+// taken over.
+func waitForStop(errs <-chan error, stop <-chan os.Signal) error {
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case sig := <-stop:
+			if sig == syscall.SIGUSR2 {
+				err := upgrade()
+				if err != nil {
+					log.Println("upgrade failed:", err)
+					continue
+				}
+			} else {
+				notifySystemd("STOPPING=1")
+			}
 
-	vm := getStatsPageViewModel()
-	err = templates["stats_csv"].Execute(f, vm)
-	if err != nil {
-		panic(err)
+			log.Println("received", sig, "shutting down")
+			return nil
+		}
 	}
 }
 
-func restoreStats() {
-	f, err := os.Open(fileSystemRoot + "stats.csv")
-	if err != nil {
-		panic(err)
-	}
-	r := csv.NewReader(f)
+// canonicalPathPrefixes are the page routes that canonicalizePaths applies
+// to. Static files are left to their file servers.
+var canonicalPathPrefixes = []string{"/gallery/", "/tag/", "/tags", "/search", "/stats", "/api/", "/admin"}
 
-	records, err := r.ReadAll()
-	if err != nil {
-		panic(err)
-	}
+// canonicalizePaths permanently redirects page requests to the single form
+// each page is linked as, so that /gallery/foo/ and /gallery/foo%2F end up at
+// /gallery/foo and are only counted there.
+func canonicalizePaths(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		canonical := canonicalPath(r.URL.Path)
+		if canonical == r.URL.Path {
+			handler.ServeHTTP(w, r)
+			return
+		}
 
-	for _, row := range records {
-		page := row[0]
-		count, err := strconv.Atoi(row[1])
-		if err != nil {
-			panic(err)
+		target := (&url.URL{Path: canonical}).EscapedPath()
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// canonicalPath cleans a page path and drops any trailing slash. Other paths
+// are returned unchanged.
+func canonicalPath(p string) string {
+	for _, prefix := range canonicalPathPrefixes {
+		if strings.HasPrefix(p, prefix) && p != prefix {
+			return path.Clean(p)
 		}
-		hitCountByPage[page] = count
 	}
+
+	return p
 }
 
 type galleryViewModel struct {
-	Galleries []galleryLinkViewModel
-	Images    []string
-	Blurb     template.HTML
+	Meta        pageMetadata
+	Galleries   []galleryLinkViewModel
+	Title       string
+	Description string
+	Tags        []tagLinkViewModel
+	Images      []imageViewModel
+	ImageSizes  string
+	Blurb       template.HTML
+	Pagination  paginationViewModel
+	Draft       bool
+	Unpublished bool
+	Timing      string
+
+	// Download links to a zip of the gallery, when downloads are on.
+	Download string
+
+	NoRightClick bool
+
+	// Dir is the gallery's directory.
+	Dir string
+
+	// Selecting is set for a client who followed an access link, so that
+	// they can pick pictures from the gallery.
+	Selecting bool
+
+	// CountViews has the page report which pictures were shown, for the
+	// gallery's stats page.
+	CountViews bool
+
+	// StructuredData is the schema.org ImageGallery for the page, as
+	// JSON-LD.
+	StructuredData template.JS
+}
+
+type imageViewModel struct {
+	Name   string
+	URL    string
+	Srcset string
+	Width  int
+	Height int
+
+	Caption template.HTML
+
+	// Exif is nil when the image has no shooting info or the gallery hides
+	// it.
+	Exif *exifViewModel
+
+	// Download links to the original file, in galleries that only offer
+	// originals as downloads.
+	Download string
+
+	// Selected is whether the client viewing a proofing gallery has picked
+	// the image.
+	Selected bool
 }
 
 type indexViewModel struct {
+	Meta       pageMetadata
+	Galleries  []galleryLinkViewModel
+	About      template.HTML
+	Pagination paginationViewModel
+
+	// Groups is the same galleries split under headings, or empty when the
+	// index is not grouped.
+	Groups []galleryGroupViewModel
+}
+
+type galleryGroupViewModel struct {
+	Name      string
 	Galleries []galleryLinkViewModel
-	About     template.HTML
 }
 
 type galleryLinkViewModel struct {
+	Dir          string
 	Name         string
+	URL          string
+	Description  string
 	PreviewImage string
-}
-
-func faviconHandler(w http.ResponseWriter, r *http.Request) {
-	http.NotFound(w, r)
+	Draft        bool
+	Proofing     bool
+	Timing       string
 }
 
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
@@ -148,28 +346,112 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 
 func galleryHandler(w http.ResponseWriter, r *http.Request) {
 
-	gallery, err := url.QueryUnescape(r.RequestURI[9:])
+	name := strings.TrimPrefix(r.URL.Path, "/gallery/")
+	download := strings.HasSuffix(name, downloadSuffix)
+	name = strings.TrimSuffix(name, downloadSuffix)
+
+	gallery, canonical, ok := findGallery(name)
+	if !ok {
+		notFoundHandler(w, r)
+		return
+	}
+
+	if download {
+		galleryDownloadHandler(w, r, gallery, canonical)
+		return
+	}
 
+	if gallery.hiddenFrom(r) {
+		notFoundHandler(w, r)
+		return
+	}
+
+	if !canonical {
+		target := gallery.URL()
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+
+	// Drafts and signed links make a page for one visitor only.
+	cacheable := !gallery.unpublished() && !gallery.SignedURLs
+	if cacheable && renderedPages.serve(w, r) {
+		incrementHitCount(r, gallery.Dir)
+		return
+	}
+
+	images := getImages(r.Context(), gallery)
+	start, end, pagination, err := paginate(r.URL.Query(), len(images), conf.GalleryPageSize, gallery.URL())
 	if err != nil {
-		log.Println(err)
-		http.Redirect(w, r, "/", 302)
+		http.Redirect(w, r, gallery.URL(), http.StatusFound)
 		return
 	}
 
-	incrementHitCount(gallery)
+	// The admin previewing an unpublished gallery is not a visitor, and the
+	// page must not be kept by shared caches. A client's views are counted
+	// against their link.
+	var link accessLink
+	viaLink := false
+	if gallery.unpublished() {
+		w.Header().Set("Cache-Control", "private, no-store")
+		if !isAdmin(r) {
+			link, viaLink = accessLinkFor(r, gallery)
+		}
+		if viaLink {
+			recordAccessLinkView(link.Hash)
+		}
+	} else {
+		incrementHitCount(r, gallery.Dir)
+	}
+	if gallery.SignedURLs && !gallery.unpublished() {
+		// The page must be fetched again before its links expire.
+		w.Header().Set("Cache-Control", "no-cache")
+	}
 
 	g := galleryViewModel{
-		Galleries: getGalleries(),
-		Images:    getImages(gallery),
-		Blurb:     getGalleryBlurb(gallery),
+		Meta:        newPageMetadata(gallery.Title, gallery.Description, gallery.previewImage(), gallery.canonicalURL(pagination.Page)),
+		Galleries:   getGalleries(),
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		Tags:        getTagLinks(gallery.Tags),
+		Images:      images[start:end],
+		ImageSizes:  conf.Images.Sizes,
+		Blurb:       getGalleryBlurb(gallery.Dir),
+		Pagination:  pagination,
+		Draft:       gallery.draft(),
+		Unpublished: gallery.unpublished(),
+		Timing:      gallery.timingLabel(),
+		Dir:         gallery.Dir,
+		CountViews:  !gallery.unpublished(),
+	}
+	g.NoRightClick = gallery.blocksRightClick()
+	if gallery.offersZip() {
+		g.Download = galleryDownloadURL(gallery)
 	}
+	g.StructuredData = galleryStructuredData(g)
 
-	renderTemplate("gallery", g, w)
+	if viaLink {
+		g.Selecting = true
+		selected := make(map[string]bool)
+		for _, s := range selectsFor(link.Hash) {
+			selected[s.Image] = true
+		}
+		for i := range g.Images {
+			g.Images[i].Selected = selected[g.Images[i].Name]
+		}
+	}
+
+	if cacheable {
+		renderedPages.render(w, r, "gallery", g)
+		return
+	}
+	renderTemplate(r.Context(), "gallery", g, w)
 }
 
 func getGalleryBlurb(gallery string) template.HTML {
-	filename := fmt.Sprintf(fileSystemRoot+"galleries/%v/blurb.markdown", gallery)
-	return getBlurb(filename)
+	return getBlurb(contentPath("galleries", gallery, "blurb.markdown"))
 }
 
 func getBlurb(filename string) template.HTML {
@@ -179,120 +461,248 @@ func getBlurb(filename string) template.HTML {
 		return ""
 	}
 
+	return renderMarkdown(markdown)
+}
+
+func renderMarkdown(markdown []byte) template.HTML {
 	html := template.HTML(blackfriday.MarkdownCommon(markdown))
 	return html
 }
 
+// getCaption renders the caption for an image from its sidecar file, e.g.
+// IMG_1234.jpg.md, or else from the captions in the gallery manifest.
+func getCaption(gallery gallery, image string) template.HTML {
+	markdown, err := ioutil.ReadFile(contentPath("galleries", gallery.Dir, image+".md"))
+	if err == nil {
+		return renderMarkdown(markdown)
+	}
+	if !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	caption, ok := gallery.Captions[image]
+	if !ok {
+		return ""
+	}
+
+	return renderMarkdown([]byte(caption))
+}
+
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 
-	incrementHitCount("index")
+	// The index is the pattern for everything no other route takes.
+	if r.URL.Path != "/" {
+		notFoundHandler(w, r)
+		return
+	}
+
+	if renderedPages.serve(w, r) {
+		incrementHitCount(r, "index")
+		return
+	}
+
+	galleries := listedGalleries()
+	start, end, pagination, err := paginate(r.URL.Query(), len(galleries), conf.IndexPageSize, "/")
+	if err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	galleries = galleries[start:end]
+
+	groupBy := conf.IndexGroupBy
+	if r.URL.Query().Get("group") != "" {
+		groupBy = r.URL.Query().Get("group")
+	}
+
+	incrementHitCount(r, "index")
+
+	var image string
+	if len(galleries) > 0 {
+		image = galleries[0].previewImage()
+	}
 
 	vm := indexViewModel{
-		Galleries: getGalleries(),
-		About:     getBlurb(fileSystemRoot + "about.markdown"),
+		Meta:       newPageMetadata("", "", image, pageURL("/", nil, pagination.Page)),
+		Galleries:  getGalleryLinks(galleries),
+		About:      getBlurb(contentPath("about.markdown")),
+		Pagination: pagination,
+		Groups:     groupGalleries(galleries, groupBy),
 	}
 
-	renderTemplate("index", vm, w)
+	renderedPages.render(w, r, "index", vm)
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	vm := getStatsPageViewModel()
-	renderTemplate("stats", vm, w)
+func getGalleries() []galleryLinkViewModel {
+	return getGalleryLinks(listedGalleries())
 }
 
-func getGalleries() []galleryLinkViewModel {
+func getGalleryLinks(galleries []gallery) []galleryLinkViewModel {
 	result := make([]galleryLinkViewModel, 0)
-	infos, err := ioutil.ReadDir(fileSystemRoot + "galleries")
-	if err != nil {
-		log.Println(err)
-		return result
+
+	for _, g := range galleries {
+
+		galleryLinkViewModel := galleryLinkViewModel{
+			Dir:          g.Dir,
+			Name:         g.Title,
+			URL:          g.URL(),
+			Description:  g.Description,
+			PreviewImage: g.previewImage(),
+			Draft:        g.draft(),
+			Proofing:     g.proofing(),
+			Timing:       g.timingLabel(),
+		}
+
+		result = append(result, galleryLinkViewModel)
 	}
 
-	for _, info := range infos {
-		if info.IsDir() {
+	return result
+}
 
-			galleryLinkViewModel := galleryLinkViewModel{
-				Name:         info.Name(),
-				PreviewImage: "/galleries/" + info.Name() + "/preview.jpg",
-			}
+// groupGalleries splits galleries under headings by year (newest first) or
+// by tag (alphabetically, with untagged galleries last). A gallery with
+// several tags appears under each. Any other groupBy means no grouping.
+func groupGalleries(galleries []gallery, groupBy string) []galleryGroupViewModel {
+	var keys []string
+	members := make(map[string][]gallery)
+	add := func(key string, g gallery) {
+		if _, ok := members[key]; !ok {
+			keys = append(keys, key)
+		}
+		members[key] = append(members[key], g)
+	}
 
-			result = append(result, galleryLinkViewModel)
+	switch groupBy {
+	case groupByYear:
+		for _, g := range galleries {
+			add(strconv.Itoa(g.year()), g)
 		}
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	case groupByTag:
+		var untagged []gallery
+		for _, g := range galleries {
+			for _, tag := range g.Tags {
+				add(tag, g)
+			}
+			if len(g.Tags) == 0 {
+				untagged = append(untagged, g)
+			}
+		}
+		sort.Strings(keys)
+		if len(untagged) > 0 {
+			keys = append(keys, "other")
+			members["other"] = append(members["other"], untagged...)
+		}
+	default:
+		return nil
+	}
+
+	result := make([]galleryGroupViewModel, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, galleryGroupViewModel{
+			Name:      key,
+			Galleries: getGalleryLinks(members[key]),
+		})
 	}
 
 	return result
 }
 
-func getImages(gallery string) []string {
+func getImages(ctx context.Context, gallery gallery) []imageViewModel {
+	_, span := startSpan(ctx, "read images", attribute.String("gallery", gallery.Dir))
+	defer span.End()
 
-	result := make([]string, 0)
-	dir := path.Join(fileSystemRoot+"galleries", gallery)
+	result := make([]imageViewModel, 0)
+	dir := contentPath("galleries", gallery.Dir)
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
 		log.Println(err)
+		spanError(span, err)
 		return result
 	}
 
+	sortImages(infos, gallery.Sort)
+	showExif := gallery.showsExif()
+
 	for _, info := range infos {
-		if path.Base(info.Name()) != "preview.jpg" && path.Ext(info.Name()) == ".jpg" || path.Ext(info.Name()) == ".JPG" {
-			result = append(result, fmt.Sprintf("/galleries/%v/%v", gallery, info.Name()))
-		}
-	}
+		if info.Name() != "preview.jpg" && info.Name() != gallery.Cover && isJpeg(info.Name()) {
+			imageURL := fmt.Sprintf("/galleries/%v/%v", gallery.Dir, info.Name())
+			image := imageViewModel{
+				Name:    info.Name(),
+				URL:     gallery.imageURL(info.Name()),
+				Srcset:  gallery.srcset(imageURL),
+				Caption: getCaption(gallery, info.Name()),
+			}
 
-	return result
-}
+			metadata, err := getImageMetadata(path.Join(dir, info.Name()), info)
+			if err != nil {
+				log.Println(err)
+			}
 
-func renderTemplate(tmpl string, model interface{}, w http.ResponseWriter) {
+			image.Width = metadata.width
+			image.Height = metadata.height
+			if showExif {
+				image.Exif = metadata.exif
+			}
+			if gallery.Originals == originalsDownload {
+				image.Download = originalDownloadURL(gallery, info.Name())
+			}
 
-	err := templates[tmpl].Execute(w, model)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+			result = append(result, image)
+		}
 	}
-}
 
-type pageHitCountViewModel struct {
-	Page     string
-	HitCount int
+	return result
 }
 
-type statsPageViewModel struct {
-	PageHitCounts []pageHitCountViewModel
+func renderTemplate(ctx context.Context, tmpl string, model interface{}, w http.ResponseWriter) {
+	renderTemplateStatus(ctx, tmpl, model, w, http.StatusOK)
 }
 
-func incrementHitCount(page string) {
-	hitCountModifyLock.Lock()
-	defer saveStats()
-	defer hitCountModifyLock.Unlock()
+// renderTemplateStatus renders the template and sends it with status. The
+// page is only sent once it has rendered in full, so that a failure gets
+// the error page rather than the top half of a page.
+func renderTemplateStatus(ctx context.Context, tmpl string, model interface{}, w http.ResponseWriter, status int) {
+	_, span := startSpan(ctx, "render "+tmpl)
 
-	hitCount := hitCountByPage[page]
-	hitCountByPage[page] = hitCount + 1
+	var page bytes.Buffer
+	t, err := templates.get(tmpl)
+	if err == nil {
+		err = t.Execute(&page, model)
+	}
+	endSpan(span, err)
+	if err != nil {
+		slog.ErrorContext(ctx, err.Error())
+		serveErrorPage(ctx, w, "This page could not be shown.", http.StatusInternalServerError)
+		return
+	}
 
-	totalHitCount := hitCountByPage["total"]
-	hitCountByPage["total"] = totalHitCount + 1
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	w.Write(page.Bytes())
 }
 
-func getStatsPageViewModel() statsPageViewModel {
-	hitCountModifyLock.Lock()
-	defer hitCountModifyLock.Unlock()
-
-	result := make([]pageHitCountViewModel, 0)
-	for page, hitCount := range hitCountByPage {
-		pageHitCount := pageHitCountViewModel{
-			Page:     page,
-			HitCount: hitCount,
-		}
-		result = append(result, pageHitCount)
+// sortImages orders a gallery directory listing, which ReadDir returns by
+// name, as the gallery manifest asks.
+func sortImages(infos []os.FileInfo, order string) {
+	switch order {
+	case sortByNameDesc:
+		sort.Sort(sort.Reverse(byName(infos)))
+	case sortByDate:
+		sort.Stable(byModTime(infos))
+	case sortByDateDesc:
+		sort.Stable(sort.Reverse(byModTime(infos)))
 	}
+}
 
-	sort.Sort(ByHits(result))
+type byName []os.FileInfo
 
-	return statsPageViewModel{
-		PageHitCounts: result,
-	}
-}
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name() < a[j].Name() }
 
-type ByHits []pageHitCountViewModel
+type byModTime []os.FileInfo
 
-func (a ByHits) Len() int           { return len(a) }
-func (a ByHits) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByHits) Less(i, j int) bool { return a[i].HitCount > a[j].HitCount }
+func (a byModTime) Len() int           { return len(a) }
+func (a byModTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byModTime) Less(i, j int) bool { return a[i].ModTime().Before(a[j].ModTime()) }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "session"
+
+// sessionMaxAge is how long a session lasts however active it is.
+const sessionMaxAge = 12 * time.Hour
+
+// session is a signed-in admin, known by username or, when signed in with
+// OpenID Connect, by email, for the audit log. It is only valid while the
+// configured password hash is the one it was created under, so changing the
+// password signs everyone out.
+type session struct {
+	actor        string
+	created      time.Time
+	lastSeen     time.Time
+	passwordHash string
+}
+
+// sessionStore keeps sessions in memory, keyed by a random ID. Cookies carry
+// the ID signed with a key chosen at startup, so a restart signs everyone
+// out.
+type sessionStore struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+	key      []byte
+}
+
+var sessions = newSessionStore()
+
+func newSessionStore() *sessionStore {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		key:      key,
+	}
+}
+
+// create starts a session for actor and sets its cookie.
+func (s *sessionStore) create(w http.ResponseWriter, actor string) error {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	id := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now()
+
+	s.lock.Lock()
+	s.expire(now)
+	s.sessions[id] = &session{
+		actor:        actor,
+		created:      now,
+		lastSeen:     now,
+		passwordHash: conf.Admin.PasswordHash,
+	}
+	s.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id + "." + s.sign(id),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// get returns the ID of the request's session, if it has a valid one, and
+// counts the request as activity.
+func (s *sessionStore) get(r *http.Request) (string, bool) {
+	id, ok := s.verify(r)
+	if !ok {
+		return "", false
+	}
+
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return "", false
+	}
+
+	if !session.valid(now) {
+		delete(s.sessions, id)
+		return "", false
+	}
+
+	session.lastSeen = now
+	return id, true
+}
+
+// actor returns who signed in to the session with the given ID.
+func (s *sessionStore) actor(id string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		return session.actor
+	}
+
+	return ""
+}
+
+// destroy ends the request's session, if any, and clears its cookie.
+func (s *sessionStore) destroy(w http.ResponseWriter, r *http.Request) {
+	if id, ok := s.verify(r); ok {
+		s.lock.Lock()
+		delete(s.sessions, id)
+		s.lock.Unlock()
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// verify returns the session ID from the request's cookie if its signature
+// is ours.
+func (s *sessionStore) verify(r *http.Request) (string, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.SplitN(c.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+func (s *sessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// expire drops sessions that are no longer valid. The lock must be held.
+func (s *sessionStore) expire(now time.Time) {
+	for id, session := range s.sessions {
+		if !session.valid(now) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+func (s *session) valid(now time.Time) bool {
+	idle := time.Duration(conf.Admin.SessionIdleMinutes) * time.Minute
+	return now.Sub(s.lastSeen) < idle &&
+		now.Sub(s.created) < sessionMaxAge &&
+		s.passwordHash == conf.Admin.PasswordHash
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const shortLinkPath = "/s/"
+
+// shortCodeAlphabet leaves out letters and digits easily mistaken for one
+// another when typed in from a printed card, such as 0 and o or 1 and l.
+const shortCodeAlphabet = "23456789abcdefghijkmnpqrstuvwxyz"
+
+const shortCodeLength = 5
+
+// shortCodePattern is what a code chosen by hand may look like.
+var shortCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// shortLink is a short URL, kept in the stats database, that sends whoever
+// follows it on to a gallery or one of its pictures, counting how often it
+// is.
+type shortLink struct {
+	Code        string
+	Gallery     string
+	Image       string
+	Label       string
+	Created     time.Time
+	Clicks      int
+	LastClicked time.Time
+}
+
+// URL is the full short URL, for printing.
+func (l shortLink) URL() string {
+	return absoluteURL(shortLinkPath + l.Code)
+}
+
+// target is where the link sends its visitors, if its gallery and picture
+// are still there.
+func (l shortLink) target() (string, bool) {
+	g, ok := galleryByDir(l.Gallery)
+	if !ok {
+		return "", false
+	}
+	if l.Image == "" {
+		return g.canonicalURL(1), true
+	}
+	if !fileExists(contentPath("galleries", g.Dir, l.Image)) {
+		return "", false
+	}
+
+	return g.imageURL(l.Image), true
+}
+
+// readShortLinks returns all the short links, newest first.
+func readShortLinks() ([]shortLink, error) {
+	rows, err := statsDB.Query("SELECT code, gallery, image, label, created, clicks, last_clicked FROM short_links ORDER BY created DESC, code")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []shortLink
+	for rows.Next() {
+		var l shortLink
+		var created, lastClicked string
+		err = rows.Scan(&l.Code, &l.Gallery, &l.Image, &l.Label, &created, &l.Clicks, &lastClicked)
+		if err != nil {
+			return nil, err
+		}
+		l.Created, _ = time.Parse(time.RFC3339, created)
+		l.LastClicked, _ = time.Parse(time.RFC3339, lastClicked)
+		links = append(links, l)
+	}
+
+	return links, rows.Err()
+}
+
+func findShortLink(code string) (shortLink, bool, error) {
+	l := shortLink{Code: code}
+	var created, lastClicked string
+	err := statsDB.QueryRow("SELECT gallery, image, label, created, clicks, last_clicked FROM short_links WHERE code = ?", code).
+		Scan(&l.Gallery, &l.Image, &l.Label, &created, &l.Clicks, &lastClicked)
+	if err == sql.ErrNoRows {
+		return shortLink{}, false, nil
+	}
+	if err != nil {
+		return shortLink{}, false, err
+	}
+	l.Created, _ = time.Parse(time.RFC3339, created)
+	l.LastClicked, _ = time.Parse(time.RFC3339, lastClicked)
+
+	return l, true, nil
+}
+
+// newShortCode returns a random code from shortCodeAlphabet.
+func newShortCode() (string, error) {
+	code := make([]byte, shortCodeLength)
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// createShortLink stores a link to the picture image in the gallery in
+// directory dir, or to the gallery itself if image is empty, under code, or
+// under a new random code if that is empty. It reports false if the code
+// chosen is taken.
+func createShortLink(code, dir, image, label string) (shortLink, bool, error) {
+	l := shortLink{Code: code, Gallery: dir, Image: image, Label: label, Created: time.Now()}
+
+	// A random code can clash with one already out there; another is
+	// tried rather than failing.
+	tries := 1
+	if code == "" {
+		tries = 5
+	}
+	for i := 0; i < tries; i++ {
+		if code == "" {
+			var err error
+			l.Code, err = newShortCode()
+			if err != nil {
+				return shortLink{}, false, err
+			}
+		}
+
+		result, err := statsDB.Exec("INSERT INTO short_links (code, gallery, image, label, created) VALUES (?, ?, ?, ?, ?) ON CONFLICT (code) DO NOTHING",
+			l.Code, l.Gallery, l.Image, l.Label, l.Created.Format(time.RFC3339))
+		if err != nil {
+			return shortLink{}, false, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return l, true, nil
+		}
+	}
+	if code == "" {
+		return shortLink{}, false, fmt.Errorf("no free short code after %d tries", tries)
+	}
+
+	return shortLink{}, false, nil
+}
+
+// deleteShortLink removes the link with the given code and returns it, if
+// there was one.
+func deleteShortLink(code string) (shortLink, bool, error) {
+	l, ok, err := findShortLink(code)
+	if err != nil || !ok {
+		return l, ok, err
+	}
+
+	_, err = statsDB.Exec("DELETE FROM short_links WHERE code = ?", code)
+
+	return l, err == nil, err
+}
+
+// shortLinkClicks is how often a short link was followed between two
+// flushes, and when last.
+type shortLinkClicks struct {
+	count int
+	last  time.Time
+}
+
+func (c shortLinkClicks) add(other shortLinkClicks) shortLinkClicks {
+	c.count += other.count
+	if other.last.After(c.last) {
+		c.last = other.last
+	}
+
+	return c
+}
+
+// recordShortLinkClick counts the click in pending, like a page view, to be
+// written with the next flush.
+func recordShortLinkClick(r *http.Request, code string) {
+	if isCrawler(r) || conf.ReadOnly {
+		return
+	}
+
+	hitsLock.Lock()
+	pending.shortLinkClicks[code] = pending.shortLinkClicks[code].add(shortLinkClicks{1, time.Now()})
+	hitsLock.Unlock()
+}
+
+// writeShortLinkClicks adds clicks to the links' counts. Clicks on a link
+// deleted since are dropped.
+func writeShortLinkClicks(tx *sql.Tx, clicks map[string]shortLinkClicks) error {
+	stmt, err := tx.Prepare("UPDATE short_links SET clicks = clicks + ?, last_clicked = MAX(last_clicked, ?) WHERE code = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for code, c := range clicks {
+		_, err = stmt.Exec(c.count, c.last.UTC().Format(time.RFC3339), code)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// shortLinkHandler counts the click and sends the visitor on. It is never
+// cached, so that every click is counted and the link can be deleted.
+func shortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.ToLower(strings.TrimPrefix(r.URL.Path, shortLinkPath))
+	l, ok, err := findShortLink(code)
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not look up the link.", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		notFoundHandler(w, r)
+		return
+	}
+
+	target, ok := l.target()
+	if !ok {
+		httpError(w, r, "What this link was for has been taken down.", http.StatusGone)
+		return
+	}
+
+	recordShortLinkClick(r, l.Code)
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+func adminShortLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	g, ok := galleryByDir(r.FormValue("gallery"))
+	if !ok {
+		adminError(w, r, http.StatusBadRequest, "No such gallery.")
+		return
+	}
+
+	image := strings.TrimSpace(r.FormValue("image"))
+	if image != "" && (image != path.Base(image) || !isJpeg(image) || !fileExists(contentPath("galleries", g.Dir, image))) {
+		adminError(w, r, http.StatusBadRequest, fmt.Sprintf("%v has no picture called %v.", g.Title, image))
+		return
+	}
+
+	label := strings.TrimSpace(r.FormValue("label"))
+	if strings.ContainsAny(label, "\r\n") {
+		adminError(w, r, http.StatusBadRequest, "Keep the label on one line.")
+		return
+	}
+
+	code := strings.ToLower(strings.TrimSpace(r.FormValue("code")))
+	if code != "" && !shortCodePattern.MatchString(code) {
+		adminError(w, r, http.StatusBadRequest, "A code is up to 32 letters, digits and dashes.")
+		return
+	}
+
+	l, created, err := createShortLink(code, g.Dir, image, label)
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not create the short link.")
+		return
+	}
+	if !created {
+		adminError(w, r, http.StatusConflict, fmt.Sprintf("The code %v is taken.", code))
+		return
+	}
+	audit(r, "created short link", contentPath("galleries", g.Dir, image), l.Code)
+
+	if isTokenRequest(r) {
+		writeJSON(w, http.StatusOK, struct {
+			adminResult
+			URL string `json:"url"`
+		}{adminResult{"created-short-link", g.Title}, l.URL()})
+		return
+	}
+
+	adminDone(w, r, "created-short-link", l.URL())
+}
+
+func adminDeleteShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) {
+		return
+	}
+
+	l, deleted, err := deleteShortLink(r.FormValue("code"))
+	if err != nil {
+		logRequestError(r, err)
+		adminError(w, r, http.StatusInternalServerError, "Could not delete the short link.")
+		return
+	}
+	if !deleted {
+		adminError(w, r, http.StatusBadRequest, "No such short link.")
+		return
+	}
+	audit(r, "deleted short link", contentPath("galleries", l.Gallery, l.Image), l.Code)
+
+	adminDone(w, r, "deleted-short-link", l.Code)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signedImagePath serves the images and downloads of galleries with
+// signedURLs set. Its links carry the URL they stand for, when they stop
+// working, and an HMAC of both.
+const signedImagePath = "/signed-image"
+
+const signedImageKey contextKey = "signedImage"
+
+var (
+	urlSigningKey     []byte
+	urlSigningKeyOnce sync.Once
+)
+
+// signingKey returns the key image links are signed with, creating the key
+// file on first use. The key outlives restarts, so that links handed out
+// keep working until they expire.
+func signingKey() []byte {
+	urlSigningKeyOnce.Do(func() {
+		data, err := ioutil.ReadFile(conf.Images.SignedURLs.KeyFile)
+		if err == nil && len(strings.TrimSpace(string(data))) > 0 {
+			urlSigningKey = []byte(strings.TrimSpace(string(data)))
+			return
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+		}
+
+		key, err := newToken()
+		if err != nil {
+			panic(err)
+		}
+		err = writeFileAtomic(conf.Images.SignedURLs.KeyFile, func(w io.Writer) error {
+			_, err := io.WriteString(w, key+"\n")
+			return err
+		})
+		if err != nil {
+			// Links will only last until the next restart.
+			log.Println(err)
+		}
+		urlSigningKey = []byte(key)
+	})
+
+	return urlSigningKey
+}
+
+func imageSignature(target string, expires int64) string {
+	mac := hmac.New(sha256.New, signingKey())
+	fmt.Fprintf(mac, "%v\n%v", target, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signImageURL returns a signed link to target, an image or download URL on
+// this site, that works for images.signedURLs.validMinutes. The expiry is rounded up
+// to the minute so that pages rendered close together share the links,
+// and browsers can cache them.
+func signImageURL(target string) string {
+	valid := time.Duration(conf.Images.SignedURLs.ValidMinutes) * time.Minute
+	expires := time.Now().Add(valid).Truncate(time.Minute).Add(time.Minute).Unix()
+
+	q := url.Values{
+		"u":   {target},
+		"exp": {strconv.FormatInt(expires, 10)},
+		"sig": {imageSignature(target, expires)},
+	}
+
+	return signedImagePath + "?" + q.Encode()
+}
+
+// signedImageHandler checks a signed link and, if it holds, serves the
+// image it stands for through the files handler or the resizer, or the
+// download.
+func signedImageHandler(files http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("u")
+		expires, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+		if err != nil || !hmac.Equal([]byte(q.Get("sig")), []byte(imageSignature(target, expires))) {
+			httpError(w, r, "This link is not valid.", http.StatusForbidden)
+			return
+		}
+
+		remaining := time.Until(time.Unix(expires, 0))
+		if remaining <= 0 {
+			httpError(w, r, "This link has expired.", http.StatusGone)
+			return
+		}
+
+		u, err := url.Parse(target)
+		if err != nil {
+			httpError(w, r, "This link is not valid.", http.StatusBadRequest)
+			return
+		}
+
+		signed := r.Clone(context.WithValue(r.Context(), signedImageKey, true))
+		signed.URL = u
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%v", int(remaining/time.Second)))
+
+		switch {
+		case strings.HasPrefix(u.Path, "/galleries/"):
+			files.ServeHTTP(w, signed)
+		case u.Path == "/img-resize":
+			imageResizeHandler(w, signed)
+		case strings.HasPrefix(u.Path, originalDownloadPath):
+			originalDownloadHandler(w, signed)
+		case strings.HasPrefix(u.Path, "/gallery/") && strings.HasSuffix(u.Path, downloadSuffix):
+			galleryHandler(w, signed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// signedRequest reports whether the request came through a valid signed
+// link.
+func signedRequest(r *http.Request) bool {
+	signed, _ := r.Context().Value(signedImageKey).(bool)
+	return signed
+}
+
+// signedURLRequired reports whether the file at src, relative to the
+// galleries directory, may only be fetched through a signed link by this
+// request. The cover is left out, since the index is rendered ahead of
+// time.
+func signedURLRequired(r *http.Request, g gallery, src string) bool {
+	name := path.Base(src)
+	return g.SignedURLs && name != g.Cover && name != "preview.jpg" && !signedRequest(r) && !isAdmin(r)
+}
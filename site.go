@@ -0,0 +1,42 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// embeddedSite is the templates and the static css, js and img directories
+// as they were when the binary was built, so that deploying it needs
+// nothing else beside the content.
+//
+//go:embed *.html css js img
+var embeddedSite embed.FS
+
+// siteFromDisk reports whether the templates and static files are read
+// from FileSystemRoot, so that they can be edited without a rebuild,
+// rather than taken from the binary.
+func siteFromDisk() bool {
+	return conf.SiteFromDisk || conf.DevMode
+}
+
+// siteFiles returns the templates and the static files, from wherever they
+// are read from.
+func siteFiles() fs.FS {
+	if siteFromDisk() {
+		return os.DirFS(conf.FileSystemRoot)
+	}
+
+	return embeddedSite
+}
+
+// siteDir returns the static directory dir, such as css.
+func siteDir(dir string) fs.FS {
+	if siteFromDisk() {
+		return os.DirFS(sitePath(dir))
+	}
+
+	// dir is one of the embedded directories, so this can't fail.
+	sub, _ := fs.Sub(embeddedSite, dir)
+	return sub
+}
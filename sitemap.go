@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// sitemapURLSet is a sitemaps.org urlset document.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapCache holds the rendered sitemap.xml. It is regenerated with the other
+// indexes whenever the content changes.
+type sitemapCache struct {
+	lock sync.RWMutex
+	xml  []byte
+}
+
+var sitemap = &sitemapCache{}
+
+func (s *sitemapCache) rebuild() {
+	galleries := listedGalleries()
+
+	// The index changes whenever the about text or any gallery does.
+	var indexModTime time.Time
+	info, err := os.Stat(contentPath("about.markdown"))
+	if err == nil {
+		indexModTime = info.ModTime()
+	}
+	for _, g := range galleries {
+		if g.lastChanged().After(indexModTime) {
+			indexModTime = g.lastChanged()
+		}
+	}
+
+	urls := []sitemapURL{
+		{Loc: absoluteURL("/"), LastMod: formatLastMod(indexModTime)},
+	}
+	for _, g := range galleries {
+		urls = append(urls, sitemapURL{
+			Loc:     g.canonicalURL(1),
+			LastMod: formatLastMod(g.lastChanged()),
+		})
+	}
+
+	data, err := xml.MarshalIndent(sitemapURLSet{URLs: urls}, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.xml = append([]byte(xml.Header), data...)
+}
+
+func formatLastMod(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format("2006-01-02")
+}
+
+func sitemapHandler(w http.ResponseWriter, r *http.Request) {
+	sitemap.lock.RLock()
+	defer sitemap.lock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(sitemap.xml)
+}
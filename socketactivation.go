@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor systemd passes sockets on.
+const listenFdsStart = 3
+
+// systemdSockets names the inherited listeners systemd made, whose socket
+// files are its to look after.
+var systemdSockets = make(map[string]bool)
+
+// inheritSystemdSockets picks up the sockets systemd passes when a .socket
+// unit starts the server, as listeners for listen to take. Each is known by
+// its FileDescriptorName=, http, https, unix, pprof or the name of one of
+// listeners; unnamed ones stand for the listeners the config uses in turn,
+// http then https, or unix.
+func inheritSystemdSockets() error {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return fmt.Errorf("LISTEN_FDS: %v", err)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(key)
+	}
+
+	unnamed := []string{"http", "https"}
+	if conf.UnixSocket.Path != "" {
+		unnamed = []string{"unix"}
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if !listenerName(name) {
+			if len(unnamed) == 0 {
+				return fmt.Errorf("systemd passed more sockets than there are listeners for; name them http, https, unix, pprof or after one of listeners with FileDescriptorName=")
+			}
+			name, unnamed = unnamed[0], unnamed[1:]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("systemd socket %v: %v", name, err)
+		}
+		inheritedListeners[name] = l
+		systemdSockets[name] = true
+		unnamed = without(unnamed, name)
+	}
+
+	return nil
+}
+
+// listenerName reports whether name is one a listener goes by.
+func listenerName(name string) bool {
+	switch name {
+	case "http", "https", "unix", "pprof":
+		return true
+	}
+	for _, l := range conf.Listeners {
+		if l.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// without returns names without name.
+func without(names []string, name string) []string {
+	result := make([]string, 0, len(names))
+	for _, n := range names {
+		if n != name {
+			result = append(result, n)
+		}
+	}
+
+	return result
+}
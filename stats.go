@@ -0,0 +1,793 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	_ "modernc.org/sqlite"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsDayFormat is how days are stored in the stats database, in
+// statsTimeZone.
+const statsDayFormat = "2006-01-02"
+
+// undatedDay holds the counts imported from a stats.csv, which only kept a
+// total per page.
+const undatedDay = ""
+
+// statsLogDays is how many days /stats-log shows unless ?days= says
+// otherwise.
+const statsLogDays = 30
+
+// statsFlushInterval is how often counted hits are written to the stats
+// database. Hits counted since the last flush are lost if the server dies
+// without shutting down.
+const statsFlushInterval = 10 * time.Second
+
+var statsDB *sql.DB
+
+// hitKey is a page and the day it was viewed on.
+type hitKey struct {
+	page string
+	day  string
+}
+
+// statsBatch is what has been counted between two flushes.
+type statsBatch struct {
+	hits        map[hitKey]int
+	crawlerHits map[hitKey]int
+	visitors    map[visitKey]bool
+	referrers   map[referrerKey]int
+	devices     map[deviceKey]int
+	imageViews  map[imageViewKey]int
+
+	// hourlyHits are keyed by hour, in statsHourFormat, rather than day.
+	hourlyHits map[hitKey]int
+
+	// shortLinkClicks are keyed by code, which stays the same when the
+	// gallery a link is for is renamed.
+	shortLinkClicks map[string]shortLinkClicks
+}
+
+func newStatsBatch() *statsBatch {
+	return &statsBatch{
+		hits:        make(map[hitKey]int),
+		crawlerHits: make(map[hitKey]int),
+		visitors:    make(map[visitKey]bool),
+		referrers:   make(map[referrerKey]int),
+		devices:     make(map[deviceKey]int),
+		imageViews:  make(map[imageViewKey]int),
+		hourlyHits:  make(map[hitKey]int),
+
+		shortLinkClicks: make(map[string]shortLinkClicks),
+	}
+}
+
+// pending is what has been counted since the last flush. Page views only
+// take hitsLock long enough to add to it; flushLock keeps flushes from
+// overlapping.
+var (
+	pending   = newStatsBatch()
+	hitsLock  sync.Mutex
+	flushLock sync.Mutex
+)
+
+func (b *statsBatch) empty() bool {
+	return len(b.hits) == 0 && len(b.crawlerHits) == 0 && len(b.imageViews) == 0 && len(b.shortLinkClicks) == 0
+}
+
+// add adds the counts in other to b.
+func (b *statsBatch) add(other *statsBatch) {
+	for key, count := range other.hits {
+		b.hits[key] += count
+	}
+	for key, count := range other.crawlerHits {
+		b.crawlerHits[key] += count
+	}
+	for key := range other.visitors {
+		b.visitors[key] = true
+	}
+	for key, count := range other.referrers {
+		b.referrers[key] += count
+	}
+	for key, count := range other.devices {
+		b.devices[key] += count
+	}
+	for key, count := range other.imageViews {
+		b.imageViews[key] += count
+	}
+	for key, count := range other.hourlyHits {
+		b.hourlyHits[key] += count
+	}
+	for code, clicks := range other.shortLinkClicks {
+		b.shortLinkClicks[code] = b.shortLinkClicks[code].add(clicks)
+	}
+}
+
+// addHit counts a view of page at t, by the day and, for an hourly stats
+// log, by the hour.
+func (b *statsBatch) addHit(page string, t time.Time) {
+	b.hits[hitKey{page, t.Format(statsDayFormat)}]++
+	if conf.StatsLogGranularity == statsHourly {
+		b.hourlyHits[hitKey{page, t.Format(statsHourFormat)}]++
+	}
+}
+
+// rename moves what b has counted for page old, or for the gallery in
+// directory old, onto new.
+func (b *statsBatch) rename(old, new string) {
+	for _, hits := range []map[hitKey]int{b.hits, b.crawlerHits, b.hourlyHits} {
+		for key, count := range hits {
+			if key.page == old {
+				delete(hits, key)
+				hits[hitKey{new, key.day}] += count
+			}
+		}
+	}
+	for key := range b.visitors {
+		if key.page == old {
+			delete(b.visitors, key)
+			b.visitors[visitKey{new, key.day, key.visitor}] = true
+		}
+	}
+	for key, count := range b.referrers {
+		if key.page == old {
+			delete(b.referrers, key)
+			b.referrers[referrerKey{new, key.day, key.domain}] += count
+		}
+	}
+	for key, count := range b.imageViews {
+		if key.gallery == old {
+			delete(b.imageViews, key)
+			b.imageViews[imageViewKey{new, key.image, key.day}] += count
+		}
+	}
+}
+
+const statsSchema = `
+CREATE TABLE IF NOT EXISTS hits (
+	page  TEXT    NOT NULL,
+	day   TEXT    NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (page, day)
+);
+CREATE TABLE IF NOT EXISTS crawler_hits (
+	page  TEXT    NOT NULL,
+	day   TEXT    NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (page, day)
+);
+CREATE TABLE IF NOT EXISTS visitors (
+	page    TEXT NOT NULL,
+	day     TEXT NOT NULL,
+	visitor TEXT NOT NULL,
+	PRIMARY KEY (page, day, visitor)
+);
+CREATE TABLE IF NOT EXISTS referrers (
+	page   TEXT    NOT NULL,
+	day    TEXT    NOT NULL,
+	domain TEXT    NOT NULL,
+	count  INTEGER NOT NULL,
+	PRIMARY KEY (page, day, domain)
+);
+CREATE TABLE IF NOT EXISTS devices (
+	day     TEXT    NOT NULL,
+	class   TEXT    NOT NULL,
+	visitor TEXT    NOT NULL,
+	count   INTEGER NOT NULL,
+	PRIMARY KEY (day, class, visitor)
+);
+CREATE TABLE IF NOT EXISTS image_views (
+	gallery TEXT    NOT NULL,
+	image   TEXT    NOT NULL,
+	day     TEXT    NOT NULL,
+	count   INTEGER NOT NULL,
+	PRIMARY KEY (gallery, image, day)
+);
+CREATE TABLE IF NOT EXISTS hourly_hits (
+	page  TEXT    NOT NULL,
+	hour  TEXT    NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (page, hour)
+);
+CREATE TABLE IF NOT EXISTS short_links (
+	code         TEXT    PRIMARY KEY,
+	gallery      TEXT    NOT NULL,
+	image        TEXT    NOT NULL,
+	label        TEXT    NOT NULL,
+	created      TEXT    NOT NULL,
+	clicks       INTEGER NOT NULL DEFAULT 0,
+	last_clicked TEXT    NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS salts (
+	day  TEXT PRIMARY KEY,
+	salt TEXT NOT NULL
+)`
+
+// openStats opens the stats database, creating it if need be. A database
+// that fails its integrity check is replaced by the newest good backup. A new
+// database starts from the totals in statsFile, if there is one.
+func openStats() error {
+	if conf.ReadOnly {
+		db, err := openStatsReadOnly(conf.StatsDatabase)
+		if err != nil {
+			return err
+		}
+
+		statsDB = db
+		return nil
+	}
+
+	db, err := openStatsDatabase(conf.StatsDatabase)
+	if err != nil && fileExists(conf.StatsDatabase) {
+		log.Println(err)
+		db, err = recoverStats()
+	}
+	if err != nil {
+		return err
+	}
+
+	var rows int
+	err = db.QueryRow("SELECT COUNT(*) FROM hits").Scan(&rows)
+	if err == nil && rows == 0 && conf.StatsFile != "" {
+		err = importStatsCSV(db, conf.StatsFile)
+	}
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	statsDB = db
+	return nil
+}
+
+// openStatsDatabase opens the database in filename and checks that it is
+// sound.
+func openStatsDatabase(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", "file:"+filename+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time anyway; one connection saves
+	// retrying on SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(statsSchema)
+	if err == nil {
+		err = checkStatsDatabase(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	return db, nil
+}
+
+// closeStats writes out the hits counted since the last flush, backs the
+// database up and closes it.
+func closeStats() {
+	flushHits()
+	backupStats()
+	err := statsDB.Close()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// importStatsCSV copies the per-page totals from a stats.csv into db. The
+// old "total" row is left out, since the total is now summed. A missing file
+// is nothing to import.
+func importStatsCSV(db *sql.DB, filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	imported := 0
+	for _, row := range records {
+		if len(row) != 2 || row[0] == "total" {
+			continue
+		}
+		count, err := strconv.Atoi(row[1])
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+
+		_, err = tx.Exec("INSERT INTO hits (page, day, count) VALUES (?, ?, ?) ON CONFLICT (page, day) DO UPDATE SET count = count + excluded.count", row[0], undatedDay, count)
+		if err != nil {
+			return err
+		}
+		imported++
+	}
+
+	log.Printf("imported %v pages of hit counts from %v", imported, filename)
+	return tx.Commit()
+}
+
+// incrementHitCount counts a view of page by the request's visitor, the
+// site that sent them and the kind of device they are on. A crawler's view
+// is counted apart, or not at all, as crawlers.count says. It is written to
+// the database with the next flush. In read-only mode nothing is counted
+// but the metrics.
+func incrementHitCount(r *http.Request, page string) {
+	now := statsNow()
+	day := now.Format(statsDayFormat)
+	crawler := isCrawler(r)
+	if conf.Metrics.Enabled {
+		countPageView(page, crawler)
+	}
+	if conf.ReadOnly {
+		return
+	}
+	if crawler {
+		if conf.Crawlers.Count == crawlersSeparate {
+			hitsLock.Lock()
+			pending.crawlerHits[hitKey{page, day}]++
+			hitsLock.Unlock()
+		}
+		return
+	}
+
+	if doNotTrack(r) {
+		hitsLock.Lock()
+		pending.addHit(page, now)
+		hitsLock.Unlock()
+		return
+	}
+
+	visitor, err := visitorHash(r, day)
+	if err != nil {
+		logRequestError(r, err)
+	}
+
+	hitsLock.Lock()
+	defer hitsLock.Unlock()
+	pending.addHit(page, now)
+	if visitor != "" {
+		pending.visitors[visitKey{page, day, visitor}] = true
+	}
+	if domain := referrerDomain(r); domain != "" {
+		pending.referrers[referrerKey{page, day, domain}]++
+	}
+	pending.devices[deviceKey{day, deviceClass(r.UserAgent()), visitor}]++
+}
+
+// flushHitsPeriodically writes the counted hits to the database every
+// statsFlushInterval.
+func flushHitsPeriodically() {
+	for range time.Tick(statsFlushInterval) {
+		flushHits()
+	}
+}
+
+// flushHits writes the hits counted since the last flush to the database in
+// one transaction. If that fails they are kept for the next one.
+func flushHits() {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	hitsLock.Lock()
+	batch := pending
+	pending = newStatsBatch()
+	hitsLock.Unlock()
+
+	if batch.empty() {
+		return
+	}
+
+	err := writeStatsBatch(batch)
+	if err != nil {
+		log.Println(err)
+
+		hitsLock.Lock()
+		pending.add(batch)
+		hitsLock.Unlock()
+	}
+}
+
+func writeStatsBatch(b *statsBatch) error {
+	tx, err := statsDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = writeHitCounts(tx, "hits", b.hits)
+	if err != nil {
+		return err
+	}
+	err = writeHitCounts(tx, "crawler_hits", b.crawlerHits)
+	if err != nil {
+		return err
+	}
+	err = writeVisitors(tx, b.visitors)
+	if err != nil {
+		return err
+	}
+	err = writeReferrers(tx, b.referrers)
+	if err != nil {
+		return err
+	}
+	err = writeDevices(tx, b.devices)
+	if err != nil {
+		return err
+	}
+	err = writeImageViews(tx, b.imageViews)
+	if err != nil {
+		return err
+	}
+	err = writeHourlyHits(tx, b.hourlyHits)
+	if err != nil {
+		return err
+	}
+	err = writeShortLinkClicks(tx, b.shortLinkClicks)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// writeHitCounts adds hits to the counts in table, hits or crawler_hits.
+func writeHitCounts(tx *sql.Tx, table string, hits map[hitKey]int) error {
+	stmt, err := tx.Prepare("INSERT INTO " + table + " (page, day, count) VALUES (?, ?, ?) ON CONFLICT (page, day) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, count := range hits {
+		_, err = stmt.Exec(key.page, key.day, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renameHitCounts moves everything counted for one page onto another,
+// adding it to any it already has. A gallery's pictures move with it.
+func renameHitCounts(old, new string) {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+
+	hitsLock.Lock()
+	pending.rename(old, new)
+	hitsLock.Unlock()
+
+	err := renameHits(old, new)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func renameHits(old, new string) error {
+	tx, err := statsDB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"hits", "crawler_hits"} {
+		_, err = tx.Exec("INSERT INTO "+table+" (page, day, count) SELECT ?, day, count FROM "+table+" WHERE page = ? ON CONFLICT (page, day) DO UPDATE SET count = count + excluded.count", new, old)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE page = ?", old)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO visitors (page, day, visitor) SELECT ?, day, visitor FROM visitors WHERE page = ?", new, old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM visitors WHERE page = ?", old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO referrers (page, day, domain, count) SELECT ?, day, domain, count FROM referrers WHERE page = ? ON CONFLICT (page, day, domain) DO UPDATE SET count = count + excluded.count", new, old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM referrers WHERE page = ?", old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO image_views (gallery, image, day, count) SELECT ?, image, day, count FROM image_views WHERE gallery = ? ON CONFLICT (gallery, image, day) DO UPDATE SET count = count + excluded.count", new, old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM image_views WHERE gallery = ?", old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO hourly_hits (page, hour, count) SELECT ?, hour, count FROM hourly_hits WHERE page = ? ON CONFLICT (page, hour) DO UPDATE SET count = count + excluded.count", new, old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM hourly_hits WHERE page = ?", old)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE short_links SET gallery = ? WHERE gallery = ?", new, old)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// pageHitCountViewModel is a page's hits and unique visitors. Over more than
+// a day, Visitors is the sum of each day's, since visitors can't be told
+// apart from one day to the next.
+type pageHitCountViewModel struct {
+	Page     string
+	HitCount int
+	Visitors int
+	Crawlers int
+
+	// RunningTotal is the page's hits up to and including the day, in the
+	// stats log, counting those imported from a stats.csv.
+	RunningTotal int
+
+	// Details links to the page's own stats, for a gallery.
+	Details string
+}
+
+// statsPageViewModel is the dashboard at /stats: totals for ever and over
+// each of statsPeriods, each gallery's recent visits, and every page's. The
+// charts fetch their series from statsChartPath.
+type statsPageViewModel struct {
+	Total         int
+	Visitors      int
+	Crawlers      int
+	Periods       []statsPeriodViewModel
+	Galleries     []gallerySparklineViewModel
+	PageHitCounts []pageHitCountViewModel
+	Devices       []deviceViewModel
+}
+
+type dayHitCountViewModel struct {
+	Day           string
+	Total         int
+	RunningTotal  int
+	Visitors      int
+	PageHitCounts []pageHitCountViewModel
+}
+
+// statsLogViewModel is the visits per period, newest first. Despite the
+// name, Days holds hours or weeks when the log is hourly or weekly.
+type statsLogViewModel struct {
+	Period           string
+	HasVisitors      bool
+	HasRunningTotals bool
+	Days             []dayHitCountViewModel
+}
+
+// queryPageHitCounts runs a query for page, hit count, visitor count and
+// crawler hit count rows.
+func queryPageHitCounts(query string, args ...interface{}) ([]pageHitCountViewModel, error) {
+	rows, err := statsDB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]pageHitCountViewModel, 0)
+	for rows.Next() {
+		var p pageHitCountViewModel
+		err = rows.Scan(&p.Page, &p.HitCount, &p.Visitors, &p.Crawlers)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+
+	return result, rows.Err()
+}
+
+func getStatsPageViewModel() (statsPageViewModel, error) {
+	flushHits()
+
+	pages, err := queryPageHitCounts(`
+		SELECT p.page, COALESCE(h.hits, 0) AS hits, COALESCE(v.visitors, 0), COALESCE(c.hits, 0)
+		FROM (SELECT page FROM hits UNION SELECT page FROM crawler_hits) p
+		LEFT JOIN (SELECT page, SUM(count) AS hits FROM hits GROUP BY page) h ON h.page = p.page
+		LEFT JOIN (SELECT page, COUNT(*) AS visitors FROM visitors GROUP BY page) v ON v.page = p.page
+		LEFT JOIN (SELECT page, SUM(count) AS hits FROM crawler_hits GROUP BY page) c ON c.page = p.page
+		ORDER BY hits DESC, p.page`)
+	if err != nil {
+		return statsPageViewModel{}, err
+	}
+
+	galleries := listGalleries()
+	dirs := make(map[string]bool)
+	for _, g := range galleries {
+		dirs[g.Dir] = true
+	}
+
+	vm := statsPageViewModel{PageHitCounts: pages}
+	for i, p := range pages {
+		vm.Total += p.HitCount
+		vm.Crawlers += p.Crawlers
+		if dirs[p.Page] {
+			pages[i].Details = statsGalleryPath + p.Page
+		}
+	}
+
+	series, err := dailySeries(statsPeriods[len(statsPeriods)-1], "")
+	if err != nil {
+		return statsPageViewModel{}, err
+	}
+	vm.Periods = statsPeriodTotals(series)
+
+	vm.Galleries, err = gallerySparklines(galleries, statsSparklineDays)
+	if err != nil {
+		return statsPageViewModel{}, err
+	}
+
+	err = statsDB.QueryRow("SELECT COUNT(*) FROM (SELECT DISTINCT day, visitor FROM visitors)").Scan(&vm.Visitors)
+	if err != nil {
+		return statsPageViewModel{}, err
+	}
+
+	vm.Devices, err = queryDevices(undatedDay)
+	if err != nil {
+		return statsPageViewModel{}, err
+	}
+
+	return vm, nil
+}
+
+// getStatsLogViewModel returns the hits on each of the last days days,
+// newest first, optionally for one page only, with the running totals up to
+// each.
+func getStatsLogViewModel(days int, page string) (statsLogViewModel, error) {
+	flushHits()
+
+	since := statsNow().AddDate(0, 0, 1-days).Format(statsDayFormat)
+
+	rows, err := statsDB.Query(`
+		SELECT h.day, h.page, h.count, h.total, COUNT(v.visitor)
+		FROM (SELECT page, day, count, SUM(count) OVER (PARTITION BY page ORDER BY day) AS total FROM hits) h
+		LEFT JOIN visitors v ON v.page = h.page AND v.day = h.day
+		WHERE h.day >= ? AND (? = '' OR h.page = ?)
+		GROUP BY h.day, h.page
+		ORDER BY h.day DESC, h.count DESC, h.page`, since, page, page)
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+	defer rows.Close()
+
+	vm := statsLogViewModel{Period: "Day", HasVisitors: true, HasRunningTotals: true, Days: make([]dayHitCountViewModel, 0)}
+	for rows.Next() {
+		var day string
+		var p pageHitCountViewModel
+		err = rows.Scan(&day, &p.Page, &p.HitCount, &p.RunningTotal, &p.Visitors)
+		if err != nil {
+			return statsLogViewModel{}, err
+		}
+
+		if len(vm.Days) == 0 || vm.Days[len(vm.Days)-1].Day != day {
+			vm.Days = append(vm.Days, dayHitCountViewModel{Day: day})
+		}
+		d := &vm.Days[len(vm.Days)-1]
+		d.Total += p.HitCount
+		d.PageHitCounts = append(d.PageHitCounts, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+
+	visitors, err := dailyVisitors(since, page)
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+	for i := range vm.Days {
+		vm.Days[i].Visitors = visitors[vm.Days[i].Day]
+	}
+
+	var running int
+	err = statsDB.QueryRow("SELECT COALESCE(SUM(count), 0) FROM hits WHERE day < ? AND (? = '' OR page = ?)", since, page, page).Scan(&running)
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+	for i := len(vm.Days) - 1; i >= 0; i-- {
+		running += vm.Days[i].Total
+		vm.Days[i].RunningTotal = running
+	}
+
+	return vm, nil
+}
+
+// dailyVisitors returns how many different visitors came each day since
+// since, to page or to any page.
+func dailyVisitors(since, page string) (map[string]int, error) {
+	rows, err := statsDB.Query("SELECT day, COUNT(DISTINCT visitor) FROM visitors WHERE day >= ? AND (? = '' OR page = ?) GROUP BY day", since, page, page)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visitors := make(map[string]int)
+	for rows.Next() {
+		var day string
+		var count int
+		err = rows.Scan(&day, &count)
+		if err != nil {
+			return nil, err
+		}
+		visitors[day] = count
+	}
+
+	return visitors, rows.Err()
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	vm, err := getStatsPageViewModel()
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not read the stats", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(r.Context(), "stats", vm, w)
+}
+
+// statsLogHandler shows the hits per page per hour, day or week, as
+// statsLogGranularity says, for the last statsLogDays days or ?days=, and
+// for one page with ?page=.
+func statsLogHandler(w http.ResponseWriter, r *http.Request) {
+	days := statsLogDays
+	if s := r.FormValue("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			httpError(w, r, "days must be a positive number", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	var vm statsLogViewModel
+	var err error
+	switch conf.StatsLogGranularity {
+	case statsHourly:
+		vm, err = getHourlyStatsLogViewModel(days, r.FormValue("page"))
+	case statsWeekly:
+		vm, err = getWeeklyStatsLogViewModel(days, r.FormValue("page"))
+	default:
+		vm, err = getStatsLogViewModel(days, r.FormValue("page"))
+	}
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "Could not read the stats", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(r.Context(), "stats_log", vm, w)
+}
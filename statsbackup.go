@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// statsBackupInterval is how often the stats database is backed up while
+// the server runs. It is also backed up on shutdown.
+const statsBackupInterval = 24 * time.Hour
+
+// statsBackupPath returns the path of the nth newest backup of the stats
+// database, counting from 1.
+func statsBackupPath(n int) string {
+	return fmt.Sprintf("%v.%v", conf.StatsDatabase, n)
+}
+
+// checkStatsDatabase runs SQLite's integrity check on db.
+func checkStatsDatabase(db *sql.DB) error {
+	var result string
+	err := db.QueryRow("PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %v", result)
+	}
+
+	return nil
+}
+
+func backupStatsPeriodically() {
+	for range time.Tick(statsBackupInterval) {
+		backupStats()
+	}
+}
+
+// backupStats snapshots the stats database beside it as backup 1, moving
+// the older backups along and dropping any beyond statsBackups. The snapshot
+// is synced and renamed into place, so a crash leaves either the old set of
+// backups or the new one.
+func backupStats() {
+	if conf.StatsBackups < 1 || conf.ReadOnly {
+		return
+	}
+
+	err := writeStatsBackup()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeStatsBackup() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(conf.StatsDatabase), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	// VACUUM INTO needs the file not to exist, or to be empty.
+	_, err = statsDB.Exec("VACUUM INTO ?", tmp.Name())
+	if err != nil {
+		return fmt.Errorf("backing up %v: %v", conf.StatsDatabase, err)
+	}
+
+	err = syncFile(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	// The oldest is dropped, along with any left from a larger
+	// statsBackups.
+	for n := conf.StatsBackups; fileExists(statsBackupPath(n)); n++ {
+		err = os.Remove(statsBackupPath(n))
+		if err != nil {
+			return err
+		}
+	}
+	for n := conf.StatsBackups; n > 1; n-- {
+		err = os.Rename(statsBackupPath(n-1), statsBackupPath(n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(tmp.Name(), statsBackupPath(1))
+}
+
+func syncFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// recoverStats moves a broken stats database aside and puts the newest
+// backup that passes its integrity check in its place. With no good backup
+// it starts a new database.
+func recoverStats() (*sql.DB, error) {
+	broken := fmt.Sprintf("%v.broken-%v", conf.StatsDatabase, time.Now().Format("20060102-150405"))
+	err := os.Rename(conf.StatsDatabase, broken)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("moved the broken stats database to", broken)
+
+	// The write-ahead log belongs to the broken database, not the backup.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Rename(conf.StatsDatabase+suffix, broken+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	for n := 1; n <= conf.StatsBackups; n++ {
+		backup := statsBackupPath(n)
+		if !fileExists(backup) {
+			continue
+		}
+		err := checkStatsBackup(backup)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = copyFile(backup, conf.StatsDatabase)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("restored the stats database from", backup)
+
+		return openStatsDatabase(conf.StatsDatabase)
+	}
+
+	log.Println("no good stats backup; starting the stats database again")
+	return openStatsDatabase(conf.StatsDatabase)
+}
+
+// checkStatsBackup opens the backup in filename read-only and checks that
+// it is sound.
+func checkStatsBackup(filename string) error {
+	db, err := sql.Open("sqlite", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = checkStatsDatabase(db)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	var rows int
+	err = db.QueryRow("SELECT COUNT(*) FROM hits").Scan(&rows)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filename, err)
+	}
+
+	return nil
+}
+
+// copyFile copies src over dst, replacing it only once the copy is complete.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return syncFile(dst)
+}
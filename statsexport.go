@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiStatsPath exports the stats per page per day, for spreadsheets and
+// scripts.
+const apiStatsPath = "/api/v1/stats"
+
+// apiStatsRow is one page's counts on one day.
+type apiStatsRow struct {
+	Day      string `json:"day"`
+	Page     string `json:"page"`
+	Visits   int    `json:"visits"`
+	Visitors int    `json:"visitors"`
+	Crawlers int    `json:"crawlers"`
+
+	// Total is the page's visits up to and including the day.
+	Total int `json:"total"`
+}
+
+type apiStats struct {
+	From string        `json:"from"`
+	To   string        `json:"to"`
+	Page string        `json:"page,omitempty"`
+	Rows []apiStatsRow `json:"rows"`
+}
+
+// queryStatsRange returns each page's counts on each day from from to to,
+// both included, oldest first, for page or for every page. Days on which a
+// page had no visits are left out.
+func queryStatsRange(from, to, page string) ([]apiStatsRow, error) {
+	flushHits()
+
+	rows, err := statsDB.Query(`
+		SELECT d.day, d.page, COALESCE(h.count, 0), COALESCE(v.visitors, 0), COALESCE(c.count, 0),
+			(SELECT COALESCE(SUM(count), 0) FROM hits t WHERE t.page = d.page AND t.day <= d.day)
+		FROM (SELECT page, day FROM hits UNION SELECT page, day FROM crawler_hits) d
+		LEFT JOIN hits h ON h.page = d.page AND h.day = d.day
+		LEFT JOIN crawler_hits c ON c.page = d.page AND c.day = d.day
+		LEFT JOIN (SELECT page, day, COUNT(*) AS visitors FROM visitors GROUP BY page, day) v ON v.page = d.page AND v.day = d.day
+		WHERE d.day >= ? AND d.day <= ? AND (? = '' OR d.page = ?)
+		ORDER BY d.day, d.page`, from, to, page, page)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]apiStatsRow, 0)
+	for rows.Next() {
+		var row apiStatsRow
+		err = rows.Scan(&row.Day, &row.Page, &row.Visits, &row.Visitors, &row.Crawlers, &row.Total)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// apiStatsHandler serves /api/v1/stats, the counts per page per day from
+// ?from= to ?to= (both days, as 2006-01-02, and by default the last
+// statsLogDays days), optionally for one ?page=. It answers in JSON, or in
+// CSV with ?format=csv.
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	now := statsNow()
+	to := now.Format(statsDayFormat)
+	from := now.AddDate(0, 0, 1-statsLogDays).Format(statsDayFormat)
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{{"from", &from}, {"to", &to}} {
+		s := r.FormValue(param.name)
+		if s == "" {
+			continue
+		}
+		if _, err := time.Parse(statsDayFormat, s); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{param.name + " must be a day, as " + statsDayFormat})
+			return
+		}
+		*param.value = s
+	}
+	if from > to {
+		writeJSON(w, http.StatusBadRequest, apiError{"from must not be after to"})
+		return
+	}
+
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeJSON(w, http.StatusBadRequest, apiError{"format must be json or csv"})
+		return
+	}
+
+	page := r.FormValue("page")
+	rows, err := queryStatsRange(from, to, page)
+	if err != nil {
+		logRequestError(r, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{"could not read the stats"})
+		return
+	}
+
+	if format != "csv" {
+		writeJSON(w, http.StatusOK, apiStats{From: from, To: to, Page: page, Rows: rows})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "stats-"+from+"-"+to+".csv"))
+	out := csv.NewWriter(w)
+	out.Write([]string{"day", "page", "visits", "visitors", "crawlers", "total"})
+	for _, row := range rows {
+		out.Write([]string{row.Day, row.Page, strconv.Itoa(row.Visits), strconv.Itoa(row.Visitors), strconv.Itoa(row.Crawlers), strconv.Itoa(row.Total)})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		logRequestError(r, err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What /stats-log counts visits per.
+const (
+	statsHourly = "hourly"
+	statsDaily  = "daily"
+	statsWeekly = "weekly"
+)
+
+// statsHourFormat is how hours are stored in the stats database. It sorts
+// after the day the hour is on, in statsDayFormat.
+const statsHourFormat = "2006-01-02 15:00"
+
+var (
+	statsZoneLock sync.Mutex
+	statsZoneName string
+	statsZone     *time.Location
+)
+
+// statsNow is the time in statsTimeZone, by which visits are counted
+// towards a day or an hour, so that the days roll over at its midnight.
+func statsNow() time.Time {
+	statsZoneLock.Lock()
+	defer statsZoneLock.Unlock()
+
+	if statsZone == nil || statsZoneName != conf.StatsTimeZone {
+		zone, err := time.LoadLocation(conf.StatsTimeZone)
+		if err != nil {
+			log.Println(err)
+			zone = time.Local
+		}
+		statsZone, statsZoneName = zone, conf.StatsTimeZone
+	}
+
+	return time.Now().In(statsZone)
+}
+
+func writeHourlyHits(tx *sql.Tx, hits map[hitKey]int) error {
+	stmt, err := tx.Prepare("INSERT INTO hourly_hits (page, hour, count) VALUES (?, ?, ?) ON CONFLICT (page, hour) DO UPDATE SET count = count + excluded.count")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key, count := range hits {
+		_, err = stmt.Exec(key.page, key.day, count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// weekStart returns the Monday of the week day is in.
+func weekStart(day string) string {
+	t, err := time.Parse(statsDayFormat, day)
+	if err != nil {
+		return day
+	}
+
+	return t.AddDate(0, 0, -daysSinceMonday(t)).Format(statsDayFormat)
+}
+
+func daysSinceMonday(t time.Time) int {
+	return (int(t.Weekday()) + 6) % 7
+}
+
+// getHourlyStatsLogViewModel returns the hits on each hour of the last days
+// days, newest first, optionally for one page only. Visitors aren't told
+// apart by the hour.
+func getHourlyStatsLogViewModel(days int, page string) (statsLogViewModel, error) {
+	flushHits()
+
+	since := statsNow().AddDate(0, 0, 1-days).Format(statsDayFormat)
+
+	rows, err := statsDB.Query(`
+		SELECT hour, page, count
+		FROM hourly_hits
+		WHERE hour >= ? AND (? = '' OR page = ?)
+		ORDER BY hour DESC, count DESC, page`, since, page, page)
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+	defer rows.Close()
+
+	vm := statsLogViewModel{Period: "Hour", Days: make([]dayHitCountViewModel, 0)}
+	for rows.Next() {
+		var hour string
+		var p pageHitCountViewModel
+		err = rows.Scan(&hour, &p.Page, &p.HitCount)
+		if err != nil {
+			return statsLogViewModel{}, err
+		}
+
+		if len(vm.Days) == 0 || vm.Days[len(vm.Days)-1].Day != hour {
+			vm.Days = append(vm.Days, dayHitCountViewModel{Day: hour})
+		}
+		h := &vm.Days[len(vm.Days)-1]
+		h.Total += p.HitCount
+		h.PageHitCounts = append(h.PageHitCounts, p)
+	}
+
+	return vm, rows.Err()
+}
+
+// getWeeklyStatsLogViewModel returns the hits on each week, from Monday,
+// that the last days days fall in, newest first, optionally for one page
+// only. As over any span longer than a day, visitors are the sum of each
+// day's. The running totals are those at the end of each week.
+func getWeeklyStatsLogViewModel(days int, page string) (statsLogViewModel, error) {
+	first := statsNow().AddDate(0, 0, 1-days)
+	days += daysSinceMonday(first)
+
+	daily, err := getStatsLogViewModel(days, page)
+	if err != nil {
+		return statsLogViewModel{}, err
+	}
+
+	vm := statsLogViewModel{Period: "Week from", HasVisitors: true, HasRunningTotals: true, Days: make([]dayHitCountViewModel, 0)}
+	var pages map[string]int
+	for _, d := range daily.Days {
+		week := weekStart(d.Day)
+		if len(vm.Days) == 0 || vm.Days[len(vm.Days)-1].Day != week {
+			vm.Days = append(vm.Days, dayHitCountViewModel{Day: week, RunningTotal: d.RunningTotal})
+			pages = make(map[string]int)
+		}
+
+		w := &vm.Days[len(vm.Days)-1]
+		w.Total += d.Total
+		w.Visitors += d.Visitors
+		for _, p := range d.PageHitCounts {
+			i, ok := pages[p.Page]
+			if !ok {
+				i = len(w.PageHitCounts)
+				pages[p.Page] = i
+				w.PageHitCounts = append(w.PageHitCounts, pageHitCountViewModel{Page: p.Page, RunningTotal: p.RunningTotal})
+			}
+			w.PageHitCounts[i].HitCount += p.HitCount
+			w.PageHitCounts[i].Visitors += p.Visitors
+		}
+	}
+
+	for _, w := range vm.Days {
+		sort.SliceStable(w.PageHitCounts, func(i, j int) bool {
+			a, b := w.PageHitCounts[i], w.PageHitCounts[j]
+			return a.HitCount > b.HitCount || a.HitCount == b.HitCount && a.Page < b.Page
+		})
+	}
+
+	return vm, nil
+}
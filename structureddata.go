@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+)
+
+// siteAuthor is credited as the author of every gallery.
+const siteAuthor = "Chez Watts"
+
+// imageGalleryLD is a schema.org ImageGallery, https://schema.org/ImageGallery.
+type imageGalleryLD struct {
+	Context     string          `json:"@context"`
+	Type        string          `json:"@type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	URL         string          `json:"url"`
+	Author      personLD        `json:"author"`
+	Keywords    []string        `json:"keywords,omitempty"`
+	Images      []imageObjectLD `json:"image"`
+}
+
+type personLD struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type imageObjectLD struct {
+	Type       string `json:"@type"`
+	ContentURL string `json:"contentUrl"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	Caption    string `json:"caption,omitempty"`
+}
+
+// galleryStructuredData describes the images on a gallery page as JSON-LD,
+// so that search engines can index them together with their gallery.
+func galleryStructuredData(vm galleryViewModel) template.JS {
+	ld := imageGalleryLD{
+		Context:     "https://schema.org",
+		Type:        "ImageGallery",
+		Name:        vm.Title,
+		Description: vm.Description,
+		URL:         vm.Meta.Canonical,
+		Author:      personLD{Type: "Person", Name: siteAuthor},
+		Images:      make([]imageObjectLD, 0, len(vm.Images)),
+	}
+
+	for _, tag := range vm.Tags {
+		ld.Keywords = append(ld.Keywords, tag.Name)
+	}
+
+	for _, image := range vm.Images {
+		ld.Images = append(ld.Images, imageObjectLD{
+			Type:       "ImageObject",
+			ContentURL: absoluteURL(image.URL),
+			Width:      image.Width,
+			Height:     image.Height,
+			Caption:    htmlToText(string(image.Caption)),
+		})
+	}
+
+	// json.Marshal escapes <, > and &, so the result cannot close the
+	// script element it is written into.
+	data, err := json.Marshal(ld)
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+
+	return template.JS(data)
+}
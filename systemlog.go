@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"strings"
+	"sync"
+)
+
+// The system logs the log can be sent to instead.
+const (
+	logSyslog   = "syslog"
+	logJournald = "journald"
+)
+
+// The names the server's log and the access log go by in the system log.
+const (
+	systemLogTag       = "chezwatts.gallery"
+	systemAccessLogTag = "chezwatts.gallery-access"
+)
+
+// journalSocket is where systemd-journald takes entries in its native
+// protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// systemLog sends lines to syslog or the journal, at a priority that
+// follows their level.
+type systemLog interface {
+	send(level slog.Level, line string) error
+}
+
+// openSystemLog connects to log.system under tag.
+func openSystemLog(tag string) (systemLog, error) {
+	if conf.Log.System == logJournald {
+		conn, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return nil, err
+		}
+		return &journal{conn: conn, tag: tag}, nil
+	}
+
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
+
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+func (s syslogWriter) send(level slog.Level, line string) error {
+	switch {
+	case level >= slog.LevelError:
+		return s.Err(line)
+	case level >= slog.LevelWarn:
+		return s.Warning(line)
+	case level >= slog.LevelInfo:
+		return s.Info(line)
+	default:
+		return s.Debug(line)
+	}
+}
+
+type journal struct {
+	lock sync.Mutex
+	conn net.Conn
+	tag  string
+}
+
+func (j *journal) send(level slog.Level, line string) error {
+	var entry bytes.Buffer
+	journalField(&entry, "PRIORITY", fmt.Sprint(syslogPriority(level)))
+	journalField(&entry, "SYSLOG_IDENTIFIER", j.tag)
+	journalField(&entry, "MESSAGE", line)
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	_, err := j.conn.Write(entry.Bytes())
+	return err
+}
+
+// journalField adds a field to an entry in the journal's native protocol.
+// Values with newlines in are sent with their length instead.
+func journalField(entry *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(entry, "%v=%v\n", name, value)
+		return
+	}
+
+	entry.WriteString(name + "\n")
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
+
+// syslogPriority is the syslog severity for level.
+func syslogPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+// systemLogHandler formats records in log.format, without the time, which
+// the system log adds, and sends each one on at the priority for its level.
+type systemLogHandler struct {
+	slog.Handler
+	out *systemLogOutput
+}
+
+// systemLogOutput is what a systemLogHandler and those derived from it
+// format records into, one at a time.
+type systemLogOutput struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+	log  systemLog
+}
+
+func newSystemLogHandler(log systemLog) *systemLogHandler {
+	out := &systemLogOutput{log: log}
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+
+	if conf.Log.Format == logJSON {
+		return &systemLogHandler{slog.NewJSONHandler(&out.buf, opts), out}
+	}
+	return &systemLogHandler{slog.NewTextHandler(&out.buf, opts), out}
+}
+
+func (h *systemLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.lock.Lock()
+	defer h.out.lock.Unlock()
+
+	h.out.buf.Reset()
+	err := h.Handler.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	return h.out.log.send(r.Level, strings.TrimSuffix(h.out.buf.String(), "\n"))
+}
+
+func (h *systemLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &systemLogHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h *systemLogHandler) WithGroup(name string) slog.Handler {
+	return &systemLogHandler{h.Handler.WithGroup(name), h.out}
+}
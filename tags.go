@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tagsFile is an alternative to the tags list in gallery.yaml: one tag per
+// line in the gallery directory.
+const tagsFile = "tags.txt"
+
+// tagIndex maps each tag to the directories of the listed galleries that
+// carry it. It is built at startup and rebuilt when the content changes.
+type tagIndex struct {
+	lock      sync.RWMutex
+	galleries map[string][]string
+}
+
+var tags = &tagIndex{}
+
+func (t *tagIndex) rebuild() {
+	index := make(map[string][]string)
+	for _, g := range listGalleries() {
+		if !g.listed() {
+			continue
+		}
+
+		for _, tag := range g.Tags {
+			index[tag] = append(index[tag], g.Dir)
+		}
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.galleries = index
+}
+
+// counts returns every tag with the number of galleries carrying it, by
+// name.
+func (t *tagIndex) counts() []tagLinkViewModel {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	result := make([]tagLinkViewModel, 0, len(t.galleries))
+	for tag, dirs := range t.galleries {
+		result = append(result, tagLinkViewModel{
+			Name:  tag,
+			URL:   tagURL(tag),
+			Count: len(dirs),
+		})
+	}
+
+	sort.Sort(byTagName(result))
+
+	return result
+}
+
+func (t *tagIndex) lookup(tag string) ([]string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	dirs, ok := t.galleries[tag]
+	return dirs, ok
+}
+
+// readTagsFile returns the tags listed in a gallery's tags.txt, if any.
+func readTagsFile(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(contentPath("galleries", dir, tagsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(string(data), "\n"), nil
+}
+
+// normalizeTags lower-cases and trims tags, dropping blanks and duplicates.
+func normalizeTags(raw []string) []string {
+	result := make([]string, 0, len(raw))
+	seen := make(map[string]bool)
+	for _, tag := range raw {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+func getTagLinks(tags []string) []tagLinkViewModel {
+	result := make([]tagLinkViewModel, 0, len(tags))
+	for _, tag := range tags {
+		result = append(result, tagLinkViewModel{
+			Name: tag,
+			URL:  tagURL(tag),
+		})
+	}
+
+	return result
+}
+
+func tagURL(tag string) string {
+	return "/tag/" + url.PathEscape(tag)
+}
+
+type tagLinkViewModel struct {
+	Name  string
+	URL   string
+	Count int
+}
+
+type tagsViewModel struct {
+	Meta pageMetadata
+	Tags []tagLinkViewModel
+}
+
+type tagViewModel struct {
+	Meta      pageMetadata
+	Tag       string
+	Galleries []galleryLinkViewModel
+}
+
+func tagsHandler(w http.ResponseWriter, r *http.Request) {
+	incrementHitCount(r, "tags")
+
+	vm := tagsViewModel{
+		Meta: newPageMetadata("Tags", "", "", "/tags"),
+		Tags: tags.counts(),
+	}
+
+	renderTemplate(r.Context(), "tags", vm, w)
+}
+
+func tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/tag/"))
+
+	dirs, ok := tags.lookup(tag)
+	if !ok {
+		notFoundHandler(w, r)
+		return
+	}
+
+	incrementHitCount(r, "tag/"+tag)
+
+	tagged := make(map[string]bool)
+	for _, dir := range dirs {
+		tagged[dir] = true
+	}
+
+	galleries := make([]galleryLinkViewModel, 0, len(dirs))
+	for _, g := range getGalleries() {
+		if tagged[g.Dir] {
+			galleries = append(galleries, g)
+		}
+	}
+
+	var image string
+	if len(galleries) > 0 {
+		image = galleries[0].PreviewImage
+	}
+
+	vm := tagViewModel{
+		Meta:      newPageMetadata(tag, "Galleries tagged "+tag, image, tagURL(tag)),
+		Tag:       tag,
+		Galleries: galleries,
+	}
+
+	renderTemplate(r.Context(), "tag", vm, w)
+}
+
+type byTagName []tagLinkViewModel
+
+func (a byTagName) Len() int           { return len(a) }
+func (a byTagName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTagName) Less(i, j int) bool { return a[i].Name < a[j].Name }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"sync"
+)
+
+// layoutFile is the page chrome shared by templates built on it. It renders
+// the "title" and "content" templates defined by the page.
+const layoutFile = "page.html"
+
+// templateFiles maps each template name to the files it is parsed from,
+// among the site files. The first file is the one executed.
+var templateFiles = map[string][]string{
+	"index":           {layoutFile, "index.html"},
+	"gallery":         {layoutFile, "gallery.html"},
+	"tags":            {layoutFile, "tags.html"},
+	"tag":             {layoutFile, "tag.html"},
+	"search":          {layoutFile, "search.html"},
+	"not_found":       {layoutFile, "not_found.html"},
+	"error":           {layoutFile, "error.html"},
+	"admin":           {layoutFile, "admin.html"},
+	"admin_edit":      {layoutFile, "admin_edit.html"},
+	"admin_login":     {layoutFile, "admin_login.html"},
+	"admin_totp":      {layoutFile, "admin_totp.html"},
+	"admin_audit":     {layoutFile, "admin_audit.html"},
+	"admin_selects":   {layoutFile, "admin_selects.html"},
+	"stats":           {"stats.html"},
+	"stats_log":       {"stats_log.html"},
+	"stats_referrers": {"stats_referrers.html"},
+	"stats_gallery":   {"stats_gallery.html"},
+}
+
+// templateFuncs are the functions every template can call.
+var templateFuncs = template.FuncMap{
+	"assetURL": assetURL,
+}
+
+// templateRegistry holds the parsed templates. They are parsed once at
+// startup; in dev mode they are re-parsed before every render so edits show
+// up without a restart.
+type templateRegistry struct {
+	lock      sync.RWMutex
+	templates map[string]*template.Template
+	reload    bool
+}
+
+var templates = &templateRegistry{}
+
+// load parses every template. On error the previously loaded set is kept.
+func (r *templateRegistry) load() error {
+	parsed := make(map[string]*template.Template)
+	for name, filenames := range templateFiles {
+		t, err := template.New(filenames[0]).Funcs(templateFuncs).ParseFS(siteFiles(), filenames...)
+		if err != nil {
+			return err
+		}
+
+		parsed[name] = t
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.templates = parsed
+
+	return nil
+}
+
+// check reports whether every template is parsed. In dev mode, it parses
+// them again.
+func (r *templateRegistry) check() error {
+	if r.reload {
+		return r.load()
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for name := range templateFiles {
+		if r.templates[name] == nil {
+			return fmt.Errorf("template %v is not parsed", name)
+		}
+	}
+
+	return nil
+}
+
+// get returns the named template, re-parsing the set first in dev mode.
+func (r *templateRegistry) get(name string) (*template.Template, error) {
+	if r.reload {
+		err := r.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	t, ok := r.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("no template named %v", name)
+	}
+
+	return t, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newCertManager returns an autocert manager that obtains and renews
+// certificates from Let's Encrypt for the configured domains, or nil if
+// autocert is disabled and the certificate files from the config should be
+// used instead.
+func newCertManager() *autocert.Manager {
+	if !conf.Autocert.Enabled {
+		return nil
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: galleryHostPolicy(autocert.HostWhitelist(append(virtualHostNames(), conf.Autocert.Domains...)...)),
+		Cache:      autocert.DirCache(conf.Autocert.CacheDir),
+		Email:      conf.Autocert.Email,
+	}
+}
+
+// newHttpsServer builds the TLS server for handler, taking certificates from
+// m when it is non-nil.
+func newHttpsServer(addr string, handler http.Handler, m *autocert.Manager) *http.Server {
+	s := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	if m != nil {
+		s.TLSConfig = m.TLSConfig()
+	}
+
+	return s
+}
+
+// serveHttps serves s on l using either the autocert certificates or the
+// configured certificate files.
+func serveHttps(s *http.Server, l net.Listener) error {
+	if s.TLSConfig != nil && s.TLSConfig.GetCertificate != nil {
+		return s.ServeTLS(l, "", "")
+	}
+
+	return s.ServeTLS(l, conf.HttpsCertificate, conf.HttpsPrivateKey)
+}
+
+// acmeChallengeOrRedirect answers ACME http-01 challenges when autocert is
+// enabled, and otherwise hands the request to the plain http mux which
+// redirects everything else to https.
+func acmeChallengeOrRedirect(handler http.Handler, m *autocert.Manager) http.Handler {
+	if m == nil {
+		return handler
+	}
+
+	return m.HTTPHandler(handler)
+}
+
+// siteHosts are the site's own names: siteURL's, httpsRedirectRoot's and
+// autocert.domains.
+func siteHosts() []string {
+	hosts := append([]string{}, conf.Autocert.Domains...)
+	for _, root := range []string{conf.SiteURL, conf.HttpsRedirectRoot} {
+		if u, err := url.Parse(root); err == nil {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	return hosts
+}
+
+// siteHost reports whether host, without a port, is one of siteHosts, a
+// virtual host's or a gallery's domain or subdomain.
+func siteHost(host string) bool {
+	for _, h := range append(siteHosts(), virtualHostNames()...) {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+
+	_, ok := hostGallery(host)
+	return ok
+}
+
+// httpsRedirectURL is where a plain http request goes: the same path and
+// query over https, at the host it asked for if that is one of the site's
+// own, so that www stays www, and at httpsRedirectRoot otherwise, so that
+// a made-up Host header can't send visitors elsewhere.
+func httpsRedirectURL(r *http.Request) string {
+	root, err := url.Parse(conf.HttpsRedirectRoot)
+	host := strings.TrimSuffix(r.Host, ".")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if err != nil || host == "" || !siteHost(host) {
+		return conf.HttpsRedirectRoot + r.URL.RequestURI()
+	}
+
+	if port := root.Port(); port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	return "https://" + strings.ToLower(host) + r.URL.RequestURI()
+}
+
+// redirectToHttpsHandler sends plain http requests to https for good.
+// Anything but GET and HEAD gets a 308, which keeps the method and body.
+func redirectToHttpsHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		status = http.StatusPermanentRedirect
+	}
+
+	http.Redirect(w, r, httpsRedirectURL(r), status)
+}
+
+// addHSTS tells browsers, with Strict-Transport-Security, to only ever use
+// https for the site, for hsts.maxAge seconds after each visit.
+func addHSTS(handler http.Handler) http.Handler {
+	if conf.HSTS.MaxAge == 0 {
+		return handler
+	}
+
+	value := fmt.Sprintf("max-age=%d", conf.HSTS.MaxAge)
+	if conf.HSTS.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if conf.HSTS.Preload {
+		value += "; preload"
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", value)
+		handler.ServeHTTP(w, r)
+	})
+}
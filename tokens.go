@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiToken is a bearer token that lets a script use the admin endpoints
+// without signing in. Only a SHA-256 hash of the token is kept; the token
+// itself is shown once, when it is issued.
+type apiToken struct {
+	Hash    string
+	Name    string
+	Created time.Time
+}
+
+// tokensLock serialises changes to the tokens file.
+var tokensLock sync.Mutex
+
+const apiTokenKey contextKey = "apiToken"
+
+// readTokens reads the tokens file, one tab-separated hash, name and
+// creation time per line. A missing file means no tokens.
+func readTokens() ([]apiToken, error) {
+	data, err := ioutil.ReadFile(conf.Admin.TokensFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []apiToken
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimRight(line, "\r"), "\t", 3)
+		if len(fields) != 3 || fields[0] == "" {
+			continue
+		}
+
+		created, _ := time.Parse(time.RFC3339, fields[2])
+		tokens = append(tokens, apiToken{Hash: fields[0], Name: fields[1], Created: created})
+	}
+
+	return tokens, nil
+}
+
+func writeTokens(tokens []apiToken) error {
+	return writeFileAtomic(conf.Admin.TokensFile, func(w io.Writer) error {
+		for _, t := range tokens {
+			_, err := fmt.Fprintf(w, "%v\t%v\t%v\n", t.Hash, t.Name, t.Created.Format(time.RFC3339))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random, URL-safe token.
+func newToken() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// issueToken creates a token called name and returns it.
+func issueToken(name string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	tokens, err := readTokens()
+	if err != nil {
+		return "", err
+	}
+
+	tokens = append(tokens, apiToken{Hash: hashToken(token), Name: name, Created: time.Now()})
+	return token, writeTokens(tokens)
+}
+
+// revokeToken removes the token with the given hash and returns it, if
+// there was one.
+func revokeToken(hash string) (apiToken, bool, error) {
+	tokensLock.Lock()
+	defer tokensLock.Unlock()
+
+	tokens, err := readTokens()
+	if err != nil {
+		return apiToken{}, false, err
+	}
+
+	var revoked apiToken
+	found := false
+	kept := make([]apiToken, 0, len(tokens))
+	for _, t := range tokens {
+		if t.Hash == hash {
+			revoked, found = t, true
+			continue
+		}
+		kept = append(kept, t)
+	}
+	if !found {
+		return apiToken{}, false, nil
+	}
+
+	return revoked, true, writeTokens(kept)
+}
+
+// bearerToken returns the token from the request's Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// findToken returns the issued, unrevoked token that token is, if any.
+func findToken(token string) (apiToken, bool) {
+	tokens, err := readTokens()
+	if err != nil {
+		log.Println(err)
+		return apiToken{}, false
+	}
+
+	hash := []byte(hashToken(token))
+	var found apiToken
+	ok := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			found, ok = t, true
+		}
+	}
+
+	return found, ok
+}
+
+// withAPIToken marks a request as authorized by a token, so that admin
+// handlers answer it in JSON rather than with pages for a browser.
+func withAPIToken(r *http.Request, t apiToken) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), apiTokenKey, t.Name))
+	return withActor(r, "token "+t.Name)
+}
+
+func isTokenRequest(r *http.Request) bool {
+	_, ok := r.Context().Value(apiTokenKey).(string)
+	return ok
+}
+
+func refuseToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeJSON(w, http.StatusUnauthorized, apiError{"invalid token"})
+}
+
+// apiTokenAuthorized reports whether a JSON API request carries a valid
+// token. A request with no token at all is simply a public one.
+func apiTokenAuthorized(w http.ResponseWriter, r *http.Request) (authorized, ok bool) {
+	token, present := bearerToken(r)
+	if !present {
+		return false, true
+	}
+
+	if _, ok := findToken(token); !ok {
+		refuseToken(w)
+		return false, false
+	}
+
+	return true, true
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gopkg.in/yaml.v2"
+	"html/template"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recoveryCodeCount is how many single-use recovery codes are issued when
+// two-factor authentication is turned on.
+const recoveryCodeCount = 10
+
+// totpPeriod is the TOTP time step; codes one step either side of now are
+// accepted to allow for clock drift.
+const totpPeriod = 30
+
+// totpState is the admin's second factor, kept in admin.totpFile. The
+// secret has to be stored as it is to check codes against, so the file is
+// only readable by its owner. Recovery codes, like API tokens, are only
+// kept hashed.
+type totpState struct {
+	Secret        string   `yaml:"secret"`
+	RecoveryCodes []string `yaml:"recoveryCodes"`
+}
+
+var (
+	totpLock sync.Mutex
+
+	// totpLastCounter is the time step of the last code accepted, so that a
+	// code cannot be used twice.
+	totpLastCounter int64
+)
+
+// readTOTP returns the stored second factor, or nil if none is set up.
+func readTOTP() (*totpState, error) {
+	data, err := ioutil.ReadFile(conf.Admin.TOTPFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state totpState
+	err = yaml.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", conf.Admin.TOTPFile, err)
+	}
+	if state.Secret == "" {
+		return nil, nil
+	}
+
+	return &state, nil
+}
+
+func writeTOTP(state *totpState) error {
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(conf.Admin.TOTPFile, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// totpEnabled reports whether password sign-in needs a code as well.
+func totpEnabled() bool {
+	state, err := readTOTP()
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+
+	return state != nil
+}
+
+// checkTOTP checks a code from the authenticator app, or else a recovery
+// code, which is used up. It reports true if no second factor is set up.
+func checkTOTP(code string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	state, err := readTOTP()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if state == nil {
+		return true
+	}
+
+	code = strings.Join(strings.Fields(code), "")
+	if code == "" {
+		return false
+	}
+
+	if counter, ok := validTOTPCode(state.Secret, code, time.Now()); ok {
+		if counter <= totpLastCounter {
+			return false
+		}
+		totpLastCounter = counter
+		return true
+	}
+
+	// Using a recovery code up would mean writing the file.
+	if conf.ReadOnly {
+		return false
+	}
+
+	hash := []byte(hashToken(normalizeRecoveryCode(code)))
+	for i, h := range state.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			state.RecoveryCodes = append(state.RecoveryCodes[:i], state.RecoveryCodes[i+1:]...)
+			err = writeTOTP(state)
+			if err != nil {
+				log.Println(err)
+				return false
+			}
+
+			log.Printf("a recovery code was used; %v are left", len(state.RecoveryCodes))
+			appendAudit(conf.Admin.Username, "used a recovery code", conf.Admin.TOTPFile, fmt.Sprintf("%v left", len(state.RecoveryCodes)))
+			return true
+		}
+	}
+
+	return false
+}
+
+// validTOTPCode reports whether code is right for the time step of now or
+// one either side of it, and which step it was right for.
+func validTOTPCode(secret, code string, now time.Time) (int64, bool) {
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	for _, skew := range []int64{-1, 0, 1} {
+		t := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, t, opts)
+		if err == nil && hmac.Equal([]byte(expected), []byte(code)) {
+			return t.Unix() / totpPeriod, true
+		}
+	}
+
+	return 0, false
+}
+
+// newRecoveryCodes returns fresh recovery codes and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := fmt.Sprintf("%x", raw)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode forgives the dash and capitals when a recovery code
+// is typed in.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(code, "-", "", -1))
+}
+
+type adminTOTPViewModel struct {
+	Meta pageMetadata
+	CSRF string
+
+	// Secret, SecretSignature and QRCode are set while enrolling.
+	Secret          string
+	SecretSignature string
+	QRCode          template.URL
+
+	// RecoveryCodes are set once, when enrollment is confirmed.
+	RecoveryCodes []string
+
+	Enabled bool
+	Error   string
+}
+
+func newAdminTOTPViewModel(r *http.Request) adminTOTPViewModel {
+	return adminTOTPViewModel{
+		Meta:    newPageMetadata("Two-factor authentication", "", "", "/admin/totp"),
+		CSRF:    csrfToken(r),
+		Enabled: totpEnabled(),
+	}
+}
+
+// signTOTPSecret ties a secret being enrolled to the session, so that the
+// confirmation form can carry it without the server keeping it.
+func signTOTPSecret(r *http.Request, secret string) string {
+	return sessions.sign("totp:" + csrfToken(r) + ":" + secret)
+}
+
+// adminTOTPHandler serves /admin/totp, which shows whether a second factor
+// is set up and, on POST, starts enrolling a new one.
+func adminTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && !signedIn(w, r) {
+		return
+	}
+
+	vm := newAdminTOTPViewModel(r)
+	if r.Method != http.MethodPost || vm.Enabled {
+		renderTemplate(r.Context(), "admin_totp", vm, w)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: feedTitle, AccountName: conf.Admin.Username})
+	if err == nil {
+		vm.QRCode, err = qrCode(key.Secret())
+	}
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not start enrolling", http.StatusInternalServerError)
+		return
+	}
+
+	vm.Secret = key.Secret()
+	vm.SecretSignature = signTOTPSecret(r, vm.Secret)
+	renderTemplate(r.Context(), "admin_totp", vm, w)
+}
+
+// qrCode renders the otpauth:// URL for secret as a QR code, for an
+// authenticator app to scan.
+func qrCode(secret string) (template.URL, error) {
+	q := url.Values{"secret": {secret}, "issuer": {feedTitle}}
+	label := url.PathEscape(feedTitle + ":" + conf.Admin.Username)
+
+	key, err := otp.NewKeyFromURL("otpauth://totp/" + label + "?" + q.Encode())
+	if err != nil {
+		return "", err
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", err
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// adminTOTPConfirmHandler turns on the second factor once a code from the
+// newly set up app checks out, and shows the recovery codes.
+func adminTOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) || !signedIn(w, r) {
+		return
+	}
+
+	vm := newAdminTOTPViewModel(r)
+	vm.Secret = r.FormValue("secret")
+	vm.SecretSignature = r.FormValue("signature")
+
+	if vm.Enabled {
+		vm.Error = "Two-factor authentication is already on."
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(r.Context(), "admin_totp", vm, w)
+		return
+	}
+
+	if !hmac.Equal([]byte(vm.SecretSignature), []byte(signTOTPSecret(r, vm.Secret))) {
+		httpError(w, r, "enrollment expired, start again", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	counter, ok := validTOTPCode(vm.Secret, strings.TrimSpace(r.FormValue("code")), time.Now())
+	if !ok {
+		vm.Error = "That code is not right. Check the time on your phone and try again."
+		vm.QRCode, err = qrCode(vm.Secret)
+		if err != nil {
+			logRequestError(r, err)
+		}
+
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(r.Context(), "admin_totp", vm, w)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err == nil {
+		totpLock.Lock()
+		err = writeTOTP(&totpState{Secret: vm.Secret, RecoveryCodes: hashes})
+		totpLastCounter = counter
+		totpLock.Unlock()
+	}
+	if err != nil {
+		logRequestError(r, err)
+		httpError(w, r, "could not turn on two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, "turned on two-factor authentication", conf.Admin.TOTPFile, "")
+
+	vm = newAdminTOTPViewModel(r)
+	vm.RecoveryCodes = codes
+	renderTemplate(r.Context(), "admin_totp", vm, w)
+}
+
+// adminTOTPDisableHandler turns the second factor off, given a current code
+// or a recovery code.
+func adminTOTPDisableHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminForm(w, r) || !signedIn(w, r) {
+		return
+	}
+
+	if !checkTOTP(r.FormValue("code")) {
+		vm := newAdminTOTPViewModel(r)
+		vm.Error = "That code is not right."
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(r.Context(), "admin_totp", vm, w)
+		return
+	}
+
+	totpLock.Lock()
+	err := os.Remove(conf.Admin.TOTPFile)
+	totpLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		logRequestError(r, err)
+		httpError(w, r, "could not turn off two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	audit(r, "turned off two-factor authentication", conf.Admin.TOTPFile, "")
+	http.Redirect(w, r, "/admin/totp", http.StatusSeeOther)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"log"
+	"net/http"
+	"os"
+)
+
+// tracer makes the spans for the site's own work. Until initTracing sets up
+// a provider, they go nowhere.
+var tracer = otel.Tracer("chezwatts.gallery")
+
+// tracingEnabled reports whether the environment names an OTLP endpoint to
+// send traces to.
+func tracingEnabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return false
+	}
+
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// initTracing sends spans over OTLP/HTTP to the endpoint the environment
+// names, if it names one. The exporter and sampler take the rest of their
+// settings, such as OTEL_EXPORTER_OTLP_HEADERS and OTEL_TRACES_SAMPLER,
+// from the environment too. It returns a function that sends any spans left
+// over, for shutdown.
+func initTracing() func() {
+	if !tracingEnabled() {
+		return func() {}
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		log.Println(err)
+		return func() {}
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "chezwatts.gallery")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK())
+	if err != nil {
+		log.Println(err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := provider.Shutdown(ctx)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// traceRequests starts a span for each request handler answers, named by
+// the method and the pattern mux routes it by, carrying on any trace the
+// client started.
+func traceRequests(mux *http.ServeMux, handler http.Handler) http.Handler {
+	if !tracingEnabled() {
+		return handler
+	}
+
+	return otelhttp.NewHandler(handler, "https", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		return r.Method + " " + pattern
+	}))
+}
+
+// startSpan starts a span for one step of answering a request, under
+// whatever span ctx carries. The caller must end it.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// spanError marks span as failed with err, if err is not nil.
+func spanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	spanError(span, err)
+	span.End()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// socketMode parses unixSocket.mode, such as 0660.
+func socketMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("unixSocket.mode must be permissions in octal, such as 0660, got %q", s)
+	}
+
+	return fs.FileMode(mode), nil
+}
+
+// listenUnixSocket listens on unixSocket.path, or takes over the socket the
+// process this one replaced was using, and gives the socket file the
+// configured mode and owner. Those of a socket systemd made are left to its
+// SocketMode=, SocketUser= and SocketGroup=.
+func listenUnixSocket() (net.Listener, error) {
+	c := conf.UnixSocket
+	l, err := listen("unix", "unix", c.Path)
+	if err != nil || systemdSockets["unix"] {
+		return l, err
+	}
+
+	mode, err := socketMode(c.Mode)
+	if err == nil {
+		err = os.Chmod(c.Path, mode)
+	}
+	if err == nil && (c.Owner != "" || c.Group != "") {
+		err = chownSocket(c.Path, c.Owner, c.Group)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// chownSocket gives path to owner and group, either of which may be empty to
+// leave it be.
+func chownSocket(path, owner, group string) error {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			u, err = user.LookupId(owner)
+		}
+		if err != nil {
+			return fmt.Errorf("unixSocket.owner: %v", err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return fmt.Errorf("unixSocket.group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// removeStaleSocket removes the socket at path, left behind by a process
+// that didn't get to remove it itself, so that it can be listened on again.
+// A socket something is still listening on is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%v is in the way of the unix socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is already being listened on", path)
+	}
+
+	return os.Remove(path)
+}
+
+// viaUnixSocket reports whether r came in on the unix socket, and so from
+// the proxy in front.
+func viaUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
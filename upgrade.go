@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv tells a process started by upgrade which listeners it has
+// been handed, by name, in the order of its file descriptors from 3 on.
+// Names of systemd's sockets start with "systemd:". The last, "ready", is
+// a pipe it writes to once it is serving.
+const upgradeEnv = "CHEZWATTS_LISTENERS"
+
+// upgradeTimeout is how long the new process has to start serving before
+// the old one gives up on it and carries on.
+const upgradeTimeout = time.Minute
+
+// fileListener is a listener whose socket can be handed to a new process,
+// such as a *net.TCPListener or a *net.UnixListener.
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+	SyscallConn() (syscall.RawConn, error)
+}
+
+type namedListener struct {
+	name     string
+	listener fileListener
+}
+
+var (
+	// inheritedListeners are those handed over by the process this one
+	// replaced, until listen takes them.
+	inheritedListeners = make(map[string]net.Listener)
+
+	// upgradeReady is the pipe to write to once serving, if this process
+	// replaced another.
+	upgradeReady *os.File
+
+	// openListeners are those to hand over on the next upgrade.
+	openListeners []namedListener
+)
+
+// inheritListeners picks up the listeners handed over by upgrade, if this
+// process was started by one, or else by systemd.
+func inheritListeners() error {
+	names := os.Getenv(upgradeEnv)
+	if names == "" {
+		return inheritSystemdSockets()
+	}
+	os.Unsetenv(upgradeEnv)
+
+	for i, name := range strings.Split(names, ",") {
+		f := os.NewFile(uintptr(3+i), name)
+		if name == "ready" {
+			upgradeReady = f
+			continue
+		}
+
+		systemd := strings.HasPrefix(name, "systemd:")
+		name = strings.TrimPrefix(name, "systemd:")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %v: %v", name, err)
+		}
+		// As if this process had made the socket file, it removes it on
+		// the way out, unless systemd made it.
+		if unix, ok := l.(*net.UnixListener); ok && !systemd {
+			unix.SetUnlinkOnClose(true)
+		}
+		inheritedListeners[name] = l
+		systemdSockets[name] = systemd
+	}
+
+	return nil
+}
+
+// listen listens on addr, on network tcp or unix, or takes over the
+// listener for name that the process this one replaced was using.
+func listen(name, network, addr string) (net.Listener, error) {
+	l, ok := inheritedListeners[name]
+	if ok {
+		delete(inheritedListeners, name)
+	} else {
+		if network == "unix" {
+			err := removeStaleSocket(addr)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		l, err = net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f, ok := l.(fileListener); ok {
+		openListeners = append(openListeners, namedListener{name, f})
+	}
+
+	return l, nil
+}
+
+// serving tells the process this one replaced, and systemd, that this
+// one is answering requests now.
+func serving() {
+	if upgradeReady != nil {
+		upgradeReady.Write([]byte{1})
+		upgradeReady.Close()
+		upgradeReady = nil
+	}
+
+	notifySystemd(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
+}
+
+// upgrade starts the executable again, as it is on disk now, handing it
+// the listeners, and waits for it to start serving. The caller can then
+// shut down, letting its own requests finish while the new process
+// accepts the new ones. Connections wait on the shared sockets, so none
+// are refused in between. If the new process fails to start, the old one
+// is none the worse and carries on.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range openListeners {
+		f, err := l.listener.File()
+		if err != nil {
+			return err
+		}
+		name := l.name
+		if systemdSockets[name] {
+			name = "systemd:" + name
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	names = append(names, "ready")
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), upgradeEnv+"="+strings.Join(names, ","))
+	err = cmd.Start()
+	// Handing the files over put them in blocking mode, and with them the
+	// sockets the listeners share, which would then block in accept and
+	// hold up shutdown.
+	for _, l := range openListeners {
+		setNonblock(l.listener)
+	}
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	// Only the new process holds the pipe open now, so the read ends with
+	// the byte it writes once serving, or when it exits.
+	readyWriter.Close()
+	files = files[:len(files)-1]
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return errors.New("the new process exited before serving")
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return errors.New("the new process did not start serving in time")
+	}
+
+	// The socket files are the new process's now, to remove when it exits.
+	for _, l := range openListeners {
+		if unix, ok := l.listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+
+	log.Println("process", cmd.Process.Pid, "is serving now")
+	return nil
+}
+
+func setNonblock(l fileListener) {
+	raw, err := l.SyscallConn()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetNonblock(int(fd), true)
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// notifySystemd sends state to systemd, if it is running the server as a
+// Type=notify service.
+func notifySystemd(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		log.Println(err)
+	}
+}
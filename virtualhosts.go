@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// virtualHostEnv tells a process started for one of virtualHosts which host
+// it is for, and to serve its site alone, on the listener it is handed.
+const virtualHostEnv = "CHEZWATTS_VIRTUAL_HOST"
+
+// virtualHostRestartDelay is how long a virtual host's process that exited
+// is left before it is started again.
+const virtualHostRestartDelay = 5 * time.Second
+
+// virtualHost is one of virtualHosts, with its own process serving its
+// site on a unix socket that requests for it are passed on to.
+type virtualHost struct {
+	config virtualHostConfig
+	socket string
+	proxy  *httputil.ReverseProxy
+
+	stop chan struct{}
+	done chan struct{}
+
+	lock sync.Mutex
+	cmd  *exec.Cmd
+}
+
+var (
+	// virtualHostProcess is set in a process serving one of virtualHosts
+	// for another.
+	virtualHostProcess bool
+
+	// virtualHostDir holds the virtual hosts' sockets.
+	virtualHostDir string
+
+	// virtualHostsByName are the virtual hosts by each of their host names,
+	// in lower case.
+	virtualHostsByName = make(map[string]*virtualHost)
+	virtualHostList    []*virtualHost
+)
+
+// startVirtualHosts starts a process for each of virtualHosts, and keeps it
+// running until stopVirtualHosts, starting it again if it exits. In a
+// virtual host's own process it only notes that it is one.
+func startVirtualHosts() error {
+	if os.Getenv(virtualHostEnv) != "" {
+		os.Unsetenv(virtualHostEnv)
+		virtualHostProcess = true
+		return nil
+	}
+	if len(conf.VirtualHosts) == 0 {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "chezwatts-hosts-")
+	if err != nil {
+		return err
+	}
+	virtualHostDir = dir
+
+	for i, c := range conf.VirtualHosts {
+		vh := &virtualHost{
+			config: c,
+			socket: filepath.Join(dir, strconv.Itoa(i)+".sock"),
+			stop:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+		vh.proxy = newVirtualHostProxy(vh.socket)
+		for _, host := range c.Hosts {
+			virtualHostsByName[strings.ToLower(host)] = vh
+		}
+		virtualHostList = append(virtualHostList, vh)
+
+		go vh.supervise()
+	}
+
+	return nil
+}
+
+// newVirtualHostProxy passes requests on to the process listening on
+// socket, saying who they came from and under which request ID they are
+// logged here.
+func newVirtualHostProxy(socket string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Host
+			r.Out.Header.Set("X-Forwarded-For", remoteIP(r.In))
+			r.Out.Header.Set(requestIDHeader, requestID(r.In.Context()))
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+			MaxIdleConnsPerHost: 32,
+			IdleConnTimeout:     time.Minute,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logRequestError(r, err)
+			http.Error(w, "This site is not available right now. Please try again later.", http.StatusBadGateway)
+		},
+	}
+}
+
+// routeVirtualHosts passes requests for one of virtualHosts on to its
+// process, within this server's rate limits, and everything else to site.
+// It goes inside the request IDs and logging, so that a virtual host's
+// requests are logged here too, but outside the headers and compression
+// its own process adds.
+func routeVirtualHosts(site http.Handler) http.Handler {
+	if len(virtualHostsByName) == 0 {
+		return site
+	}
+
+	proxy := limitRates(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vh, _ := virtualHostFor(r)
+		vh.proxy.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := virtualHostFor(r); !ok {
+			site.ServeHTTP(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// virtualHostFor returns the one of virtualHosts r is for, if any.
+func virtualHostFor(r *http.Request) (*virtualHost, bool) {
+	host := strings.TrimSuffix(r.Host, ".")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	vh, ok := virtualHostsByName[strings.ToLower(host)]
+	return vh, ok
+}
+
+// virtualHostNames lists the host names of all of virtualHosts.
+func virtualHostNames() []string {
+	var names []string
+	for _, c := range conf.VirtualHosts {
+		names = append(names, c.Hosts...)
+	}
+
+	return names
+}
+
+// supervise runs the virtual host's process, again whenever it exits,
+// until stopped.
+func (vh *virtualHost) supervise() {
+	defer close(vh.done)
+
+	for {
+		err := vh.run()
+		select {
+		case <-vh.stop:
+			return
+		default:
+		}
+
+		log.Printf("the process for %v exited: %v", vh.config.Hosts[0], err)
+		select {
+		case <-vh.stop:
+			return
+		case <-time.After(virtualHostRestartDelay):
+		}
+	}
+}
+
+// run starts the virtual host's process, listening for it on its socket,
+// and waits for it to exit. Requests wait on the socket until the
+// process is ready for them.
+func (vh *virtualHost) run() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(vh.socket)
+	l, err := net.Listen("unix", vh.socket)
+	if err != nil {
+		return err
+	}
+	unix := l.(*net.UnixListener)
+	unix.SetUnlinkOnClose(false)
+	f, err := unix.File()
+	unix.Close()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(exe, "-config", vh.config.Config)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Env = append(os.Environ(), upgradeEnv+"=site", virtualHostEnv+"="+vh.config.Hosts[0], "NOTIFY_SOCKET=")
+	// Its own process group keeps a Ctrl-C in the terminal from stopping it
+	// behind this process's back.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// Once started, only the process holds the socket open, so requests
+	// are refused rather than left waiting if it exits.
+	vh.lock.Lock()
+	select {
+	case <-vh.stop:
+	default:
+		err = cmd.Start()
+		if err == nil {
+			vh.cmd = cmd
+		}
+	}
+	vh.lock.Unlock()
+	f.Close()
+	if err != nil || vh.cmd != cmd {
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// stopVirtualHosts asks each virtual host's process to finish its requests
+// and exit, waiting up to shutdownTimeout before killing it.
+func stopVirtualHosts() {
+	var wg sync.WaitGroup
+	for _, vh := range virtualHostList {
+		wg.Add(1)
+		go func(vh *virtualHost) {
+			defer wg.Done()
+
+			vh.lock.Lock()
+			close(vh.stop)
+			cmd := vh.cmd
+			vh.lock.Unlock()
+			if cmd == nil {
+				<-vh.done
+				return
+			}
+
+			cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-vh.done:
+			case <-time.After(shutdownTimeout):
+				cmd.Process.Kill()
+				<-vh.done
+			}
+		}(vh)
+	}
+	wg.Wait()
+
+	if virtualHostDir != "" {
+		os.RemoveAll(virtualHostDir)
+	}
+}
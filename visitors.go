@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// visitKey is a visitor to a page on a day. Visitors are told apart by a
+// hash of their address and user agent with a salt that changes every day,
+// so that they can't be followed from one day to the next, nor their
+// address recovered once the salt is gone.
+type visitKey struct {
+	page    string
+	day     string
+	visitor string
+}
+
+// The salt for visitorSaltDay, kept in the stats database so that a restart
+// doesn't count everyone again.
+var (
+	visitorSalt    string
+	visitorSaltDay string
+	visitorLock    sync.Mutex
+)
+
+// visitorHash identifies the request's visitor on day.
+func visitorHash(r *http.Request, day string) (string, error) {
+	salt, err := saltFor(day)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\n%v\n%v", salt, loggedIP(r), r.UserAgent())))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// saltFor returns the salt for day, making it on the first visit of the day
+// and forgetting the salts of earlier days.
+func saltFor(day string) (string, error) {
+	visitorLock.Lock()
+	defer visitorLock.Unlock()
+
+	if visitorSaltDay == day {
+		return visitorSalt, nil
+	}
+
+	salt, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := statsDB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO salts (day, salt) VALUES (?, ?)", day, salt)
+	if err != nil {
+		return "", err
+	}
+	err = tx.QueryRow("SELECT salt FROM salts WHERE day = ?", day).Scan(&salt)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("DELETE FROM salts WHERE day < ?", day)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+
+	visitorSalt, visitorSaltDay = salt, day
+	return salt, nil
+}
+
+func writeVisitors(tx *sql.Tx, visitors map[visitKey]bool) error {
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO visitors (page, day, visitor) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for key := range visitors {
+		_, err = stmt.Exec(key.page, key.day, key.visitor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
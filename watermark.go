@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+)
+
+// Where the watermark goes on a picture.
+const (
+	watermarkCenter      = "center"
+	watermarkTopLeft     = "top-left"
+	watermarkTopRight    = "top-right"
+	watermarkBottomLeft  = "bottom-left"
+	watermarkBottomRight = "bottom-right"
+)
+
+// galleryWatermark returns the watermark for pictures derived from gallery,
+// and whether they get one at all. The manifest can turn it on or off and
+// give the gallery its own image or text.
+func galleryWatermark(gallery string) (watermarkConfig, bool) {
+	g := loadGallery(gallery)
+	wc := conf.Images.Watermark
+	custom := g.WatermarkImage != "" || g.WatermarkText != ""
+	if g.WatermarkImage != "" {
+		wc.Image = contentPath("galleries", g.Dir, filepath.Base(g.WatermarkImage))
+	} else if g.WatermarkText != "" {
+		wc.Image, wc.Text = "", g.WatermarkText
+	}
+
+	if g.Watermark != nil {
+		return wc, *g.Watermark
+	}
+
+	return wc, wc.Enabled || custom
+}
+
+// watermarkID identifies the watermark settings, so that derived images are
+// made again when they change.
+func watermarkID(wc watermarkConfig) string {
+	id := fmt.Sprintf("%v\n%v\n%v\n%v\n%v", wc.Image, wc.Text, wc.Position, wc.Opacity, wc.Scale)
+	if info, err := os.Stat(wc.Image); wc.Image != "" && err == nil {
+		id += fmt.Sprintf("\n%v", info.ModTime().UnixNano())
+	}
+
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:4])
+}
+
+// applyWatermark draws the watermark's PNG, or its text if there is none,
+// over img, scaled to its scale of img's width.
+func applyWatermark(img image.Image, wc watermarkConfig) (image.Image, error) {
+	bounds := img.Bounds()
+	width := int(float64(bounds.Dx()) * wc.Scale)
+	if width < 1 {
+		return img, nil
+	}
+
+	var mark image.Image
+	var err error
+	if wc.Image != "" {
+		mark, err = watermarkImage(wc.Image, width)
+	} else {
+		mark, err = watermarkText(wc.Text, width)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+
+	at := watermarkOrigin(wc.Position, out.Bounds(), mark.Bounds())
+	opacity := image.NewUniform(color.Alpha{uint8(wc.Opacity * 255)})
+	draw.DrawMask(out, mark.Bounds().Add(at), mark, mark.Bounds().Min, opacity, image.Point{}, draw.Over)
+
+	return out, nil
+}
+
+// watermarkImage reads the watermark PNG in filename and scales it to width,
+// keeping its aspect ratio.
+func watermarkImage(filename string, width int) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", filename, err)
+	}
+
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, bounds, draw.Over, nil)
+
+	return scaled, nil
+}
+
+// watermarkText renders text in white over a soft shadow, sized to fill
+// width.
+func watermarkText(text string, width int) (image.Image, error) {
+	parsed, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	// Measure at a nominal size, then scale the size to the width wanted.
+	const nominal = 100.0
+	face, err := opentype.NewFace(parsed, &opentype.FaceOptions{Size: nominal, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	measured := font.MeasureString(face, text).Ceil()
+	face.Close()
+	if measured < 1 {
+		return image.NewRGBA(image.Rect(0, 0, 1, 1)), nil
+	}
+
+	size := nominal * float64(width) / float64(measured)
+	face, err = opentype.NewFace(parsed, &opentype.FaceOptions{Size: size, DPI: 72})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := int(size/20) + 1
+	height := (metrics.Ascent + metrics.Descent).Ceil() + shadow
+	mark := image.NewRGBA(image.Rect(0, 0, width+shadow, height))
+
+	d := font.Drawer{Dst: mark, Face: face}
+	baseline := metrics.Ascent.Ceil()
+	d.Src = image.NewUniform(color.RGBA{0, 0, 0, 160})
+	d.Dot = fixed.P(shadow, baseline+shadow)
+	d.DrawString(text)
+	d.Src = image.White
+	d.Dot = fixed.P(0, baseline)
+	d.DrawString(text)
+
+	return mark, nil
+}
+
+// watermarkOrigin is where the top left of a mark of the given bounds goes
+// on a picture, leaving a margin of 3% of the picture's width.
+func watermarkOrigin(position string, picture, mark image.Rectangle) image.Point {
+	margin := picture.Dx() * 3 / 100
+	left := margin
+	right := picture.Dx() - mark.Dx() - margin
+	top := margin
+	bottom := picture.Dy() - mark.Dy() - margin
+
+	switch position {
+	case watermarkCenter:
+		return image.Pt((picture.Dx()-mark.Dx())/2, (picture.Dy()-mark.Dy())/2)
+	case watermarkTopLeft:
+		return image.Pt(left, top)
+	case watermarkTopRight:
+		return image.Pt(right, top)
+	case watermarkBottomLeft:
+		return image.Pt(left, bottom)
+	default:
+		return image.Pt(right, bottom)
+	}
+}